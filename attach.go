@@ -0,0 +1,306 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// forwardedSignals are passed on to the attached process
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// outputTimeout is how long the remaining output is copied after the command exited
+const outputTimeout = 500 * time.Millisecond
+
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// IsTerminal returns true if the file descriptor is a terminal
+func IsTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	return ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
+
+// makeRaw switches the terminal into raw mode like cfmakeraw and returns the previous state
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); err != nil {
+		return nil, err
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+func restoreTerminal(fd uintptr, state *syscall.Termios) {
+	ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(state)))
+}
+
+// copyWindowSize sets the size of the terminal to to the one of from
+func copyWindowSize(from uintptr, to uintptr) {
+	var size winsize
+	if ioctl(from, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))) == nil {
+		ioctl(to, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+	}
+}
+
+// openPty returns the master and the slave of a new pseudo terminal
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32
+	var number uint32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number)))
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("Unable to setup the pseudo terminal: %v", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// rootfsFile returns the path of a file in the rootfs of the container, for
+// overlay snapshots in the directory that contains it, empty without a rootfs
+func rootfsFile(container ContainerBackend, name string) string {
+	dirs := RootfsDirs(container.ConfigItem(ConfigKey("lxc.rootfs.path"))[0])
+	if len(dirs[0]) == 0 {
+		return ""
+	}
+
+	for _, dir := range dirs {
+		fileName := filepath.Join(dir, name)
+		if _, err := os.Lstat(fileName); err == nil {
+			return fileName
+		}
+	}
+	return filepath.Join(dirs[0], name)
+}
+
+/*
+containerSetsid returns the setsid of the container, which makes the pseudo
+terminal the controlling terminal of the command, so job control and keys
+like Ctrl+C work. Empty if the container has none.
+*/
+func containerSetsid(container ContainerBackend) string {
+	for _, setsid := range []string{"/usr/bin/setsid", "/bin/setsid"} {
+		fileName := rootfsFile(container, setsid)
+		if _, err := os.Stat(fileName); len(fileName) > 0 && err == nil {
+			return setsid
+		}
+	}
+	return ""
+}
+
+// ttyShellScript passes on the exit code of the command, the shell ignores the
+// signals sent to the foreground process group, so it does not die before the command
+const ttyShellScript = `trap : INT TERM HUP QUIT USR1 USR2; "$@"; exit $?`
+
+/*
+ttyCommand runs args in a new session with the pseudo terminal as controlling
+terminal. setsid forks if the attached process is a process group leader, --wait
+then returns the raw wait status of a command killed by a signal. The shell in
+between turns it into 128+signal, which setsid passes on as exit code.
+*/
+func ttyCommand(setsid string, args []string) []string {
+	return append([]string{setsid, "--ctty", "--wait", "/bin/sh", "-c", ttyShellScript, "sh"}, args...)
+}
+
+// foregroundGroup returns the foreground process group of the pseudo terminal, 0 if there is none
+func foregroundGroup(master *os.File) int {
+	if master == nil {
+		return 0
+	}
+	var pgrp int32
+	if err := ioctl(master.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); err != nil {
+		return 0
+	}
+	return int(pgrp)
+}
+
+// exitCode converts a wait status into a shell like exit code
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+/*
+RunAttached runs a command in the container and waits for it. If stdin is a
+terminal the command gets a pseudo terminal, the local terminal is switched
+to raw mode and size changes are forwarded. Signals received by this process
+are passed on to the command. The std fds of the options are replaced.
+
+Returns the exit code of the command, or 128+signal if it was killed.
+*/
+func RunAttached(container ContainerBackend, args []string, options lxc.AttachOptions) (int, error) {
+	var master *os.File
+	var outputDone sync.WaitGroup
+
+	stdinFd := os.Stdin.Fd()
+	useTerminal := IsTerminal(stdinFd)
+
+	options.StdinFd = stdinFd
+	options.StdoutFd = os.Stdout.Fd()
+	options.StderrFd = os.Stderr.Fd()
+
+	if useTerminal {
+		var slave *os.File
+		var err error
+		master, slave, err = openPty()
+		if err != nil {
+			return -1, err
+		}
+		defer master.Close()
+
+		copyWindowSize(stdinFd, master.Fd())
+		options.StdinFd = slave.Fd()
+		options.StdoutFd = slave.Fd()
+		options.StderrFd = slave.Fd()
+
+		if setsid := containerSetsid(container); len(setsid) > 0 {
+			args = ttyCommand(setsid, args)
+		}
+
+		state, err := makeRaw(stdinFd)
+		if err != nil {
+			slave.Close()
+			return -1, err
+		}
+		defer restoreTerminal(stdinFd, state)
+
+		pid, err := container.RunCommandNoWait(args, options)
+		//only the attached process keeps the slave open, so reading the master ends with it
+		slave.Close()
+		if err != nil {
+			return -1, err
+		}
+
+		go io.Copy(master, os.Stdin)
+		outputDone.Add(1)
+		go func() {
+			io.Copy(os.Stdout, master)
+			outputDone.Done()
+		}()
+
+		return waitAttached(pid, master, &outputDone)
+	}
+
+	pid, err := container.RunCommandNoWait(args, options)
+	if err != nil {
+		return -1, err
+	}
+	return waitAttached(pid, nil, &outputDone)
+}
+
+// waitAttached forwards signals and terminal size changes until the process exits
+func waitAttached(pid int, master *os.File, outputDone *sync.WaitGroup) (int, error) {
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, append(forwardedSignals, syscall.SIGWINCH)...)
+	defer signal.Stop(signals)
+
+	exited := make(chan error, 1)
+	var status syscall.WaitStatus
+	go func() {
+		for {
+			_, err := syscall.Wait4(pid, &status, 0, nil)
+			if err != syscall.EINTR {
+				exited <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGWINCH {
+				if master != nil {
+					copyWindowSize(os.Stdin.Fd(), master.Fd())
+				}
+				continue
+			}
+			//like a local terminal the signal goes to the foreground process group
+			if pgrp := foregroundGroup(master); pgrp > 0 {
+				syscall.Kill(-pgrp, sig.(syscall.Signal))
+			} else {
+				syscall.Kill(pid, sig.(syscall.Signal))
+			}
+		case err := <-exited:
+			if err != nil {
+				return -1, fmt.Errorf("Waiting for the command failed: %v", err)
+			}
+			//processes left in the background can keep the terminal open
+			output := make(chan bool)
+			go func() {
+				outputDone.Wait()
+				close(output)
+			}()
+			select {
+			case <-output:
+			case <-time.After(outputTimeout):
+			}
+			return exitCode(status), nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestTtyCommandExitCode(t *testing.T) {
+	setsid, err := exec.LookPath("setsid")
+	if err != nil {
+		t.Skip("setsid is not installed")
+	}
+
+	tests := []struct {
+		script string
+		code   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + int(syscall.SIGTERM)},
+		{"kill -KILL $$", 128 + int(syscall.SIGKILL)},
+	}
+
+	for _, test := range tests {
+		//setsid only forks and waits if the attached process leads its process group
+		for _, groupLeader := range []bool{false, true} {
+			master, slave, err := openPty()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			args := ttyCommand(setsid, []string{"/bin/sh", "-c", test.script})
+			process, err := os.StartProcess(args[0], args, &os.ProcAttr{
+				Files: []*os.File{slave, slave, slave},
+				Sys:   &syscall.SysProcAttr{Setpgid: groupLeader},
+			})
+			slave.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var outputDone sync.WaitGroup
+			code, err := waitAttached(process.Pid, master, &outputDone)
+			if err != nil || code != test.code {
+				t.Errorf("%q (group leader %v): exit code %d, %v, expected %d", test.script, groupLeader, code, err, test.code)
+			}
+			master.Close()
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// ContainerBackend is the set of container operations used by the SDK tools.
+// *lxc.Container implements it, FakeContainer provides an in-memory version.
+type ContainerBackend interface {
+	Name() string
+	Defined() bool
+	State() lxc.State
+	Wait(state lxc.State, timeout time.Duration) bool
+
+	Create(options lxc.TemplateOptions) error
+	Start() error
+	Stop() error
+	Shutdown(timeout time.Duration) error
+	Destroy() error
+	Clone(name string, options lxc.CloneOptions) error
+	SetVerbosity(verbosity lxc.Verbosity)
+
+	ConfigFileName() string
+	ConfigItem(key string) []string
+	SetConfigItem(key string, value string) error
+	ClearConfigItem(key string) error
+	ClearConfig()
+	LoadConfigFile(path string) error
+	SaveConfigFile(path string) error
+
+	RunCommandStatus(args []string, options lxc.AttachOptions) (int, error)
+	RunCommandNoWait(args []string, options lxc.AttachOptions) (int, error)
+	WaitIPAddresses(timeout time.Duration) ([]string, error)
+	IPv4Address(interfaceName string) ([]string, error)
+
+	Snapshots() ([]lxc.Snapshot, error)
+	CreateSnapshot() (*lxc.Snapshot, error)
+	RestoreSnapshot(snapshot lxc.Snapshot, name string) error
+	DestroySnapshot(snapshot lxc.Snapshot) error
+	DestroyAllSnapshots() error
+}
+
+// Backend hands out containers stored in a lxcpath.
+type Backend interface {
+	NewContainer(name string, lxcpath string) (ContainerBackend, error)
+	Containers(lxcpath string) []ContainerBackend
+	Version() string
+}
+
+// LxcBackend is the default Backend, implemented on top of go-lxc.
+type LxcBackend struct{}
+
+func (LxcBackend) NewContainer(name string, lxcpath string) (ContainerBackend, error) {
+	c, err := lxc.NewContainer(name, lxcpath)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (LxcBackend) Containers(lxcpath string) []ContainerBackend {
+	all := lxc.Containers(lxcpath)
+
+	containers := make([]ContainerBackend, 0, len(all))
+	for _, c := range all {
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+func (LxcBackend) Version() string {
+	return lxc.Version()
+}
+
+var backend Backend = LxcBackend{}
+
+// SetBackend replaces the backend used by all helpers and returns the previous one.
+func SetBackend(b Backend) Backend {
+	old := backend
+	backend = b
+	return old
+}
+
+// NewContainer returns the container with the given name from LMTargetPath()
+func NewContainer(name string) (ContainerBackend, error) {
+	return backend.NewContainer(name, LMTargetPath())
+}
+
+// Containers returns all containers in LMTargetPath()
+func Containers() []ContainerBackend {
+	return backend.Containers(LMTargetPath())
+}
+
+// LXCVersion returns the version of the lxc library used by the backend
+func LXCVersion() string {
+	return backend.Version()
+}
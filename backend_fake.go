@@ -0,0 +1,451 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// FakeBackend is an in-memory Backend, it allows running the SDK tools
+// without a working LXC installation. Container configs and rootfs
+// directories are still created below the lxcpath, so the config-lm
+// files and tool links behave like on a real target.
+type FakeBackend struct {
+	// LxcVersion is returned by Version()
+	LxcVersion string
+
+	// RunHook is called for every command executed in a container,
+	// the returned value is used as exit code of the command.
+	RunHook func(c *FakeContainer, args []string, options lxc.AttachOptions) (int, error)
+
+	mutex      sync.Mutex
+	containers map[string]*FakeContainer
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		LxcVersion: "2.1.1",
+		containers: map[string]*FakeContainer{},
+	}
+}
+
+func (b *FakeBackend) NewContainer(name string, lxcpath string) (ContainerBackend, error) {
+	return b.Container(name, lxcpath), nil
+}
+
+// configKey returns the name of a config key in the format of LxcVersion
+func (b *FakeBackend) configKey(key string) string {
+	return LXCConfigKey(key, IsNewConfigFormat(b.LxcVersion))
+}
+
+// Container returns the fake container, creating a undefined one if required
+func (b *FakeBackend) Container(name string, lxcpath string) *FakeContainer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := filepath.Join(lxcpath, name)
+	c, ok := b.containers[key]
+	if !ok {
+		c = &FakeContainer{
+			backend: b,
+			name:    name,
+			lxcpath: lxcpath,
+			state:   lxc.STOPPED,
+		}
+		b.containers[key] = c
+	}
+	return c
+}
+
+func (b *FakeBackend) Containers(lxcpath string) []ContainerBackend {
+	b.mutex.Lock()
+	var names []string
+	for _, c := range b.containers {
+		if c.lxcpath == lxcpath && c.defined {
+			names = append(names, c.name)
+		}
+	}
+	b.mutex.Unlock()
+
+	sort.Strings(names)
+	containers := make([]ContainerBackend, 0, len(names))
+	for _, name := range names {
+		containers = append(containers, b.Container(name, lxcpath))
+	}
+	return containers
+}
+
+func (b *FakeBackend) Version() string {
+	return b.LxcVersion
+}
+
+type fakeConfigItem struct {
+	key   string
+	value string
+}
+
+type fakeSnapshot struct {
+	snapshot lxc.Snapshot
+	config   []fakeConfigItem
+}
+
+// FakeContainer is the ContainerBackend handed out by FakeBackend
+type FakeContainer struct {
+	// Commands records all commands executed in the container
+	Commands [][]string
+	// IPv4 is the address reported for every interface of a running container
+	IPv4 string
+	// IgnoreShutdown keeps the container running on Shutdown, like a target hanging while shutting down
+	IgnoreShutdown bool
+
+	backend   *FakeBackend
+	name      string
+	lxcpath   string
+	defined   bool
+	state     lxc.State
+	config    []fakeConfigItem
+	snapshots []fakeSnapshot
+}
+
+func (c *FakeContainer) Name() string {
+	return c.name
+}
+
+func (c *FakeContainer) Defined() bool {
+	return c.defined
+}
+
+func (c *FakeContainer) State() lxc.State {
+	return c.state
+}
+
+func (c *FakeContainer) Wait(state lxc.State, timeout time.Duration) bool {
+	return c.state == state
+}
+
+func (c *FakeContainer) Create(options lxc.TemplateOptions) error {
+	if c.defined {
+		return fmt.Errorf("Container %s exists already", c.name)
+	}
+
+	rootfs := filepath.Join(c.lxcpath, c.name, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+
+	c.setItem(c.backend.configKey("lxc.rootfs.path"), rootfs)
+	c.setItem(c.backend.configKey("lxc.uts.name"), c.name)
+	c.setItem("lxc.arch", options.Arch)
+	c.defined = true
+	return c.SaveConfigFile(c.ConfigFileName())
+}
+
+func (c *FakeContainer) Start() error {
+	if !c.defined {
+		return fmt.Errorf("Container %s is not defined", c.name)
+	}
+	c.state = lxc.RUNNING
+	return nil
+}
+
+func (c *FakeContainer) Stop() error {
+	if c.state == lxc.STOPPED {
+		return fmt.Errorf("Container %s is not running", c.name)
+	}
+	c.state = lxc.STOPPED
+	return nil
+}
+
+func (c *FakeContainer) Shutdown(timeout time.Duration) error {
+	if c.state != lxc.RUNNING {
+		return fmt.Errorf("Container %s is not running", c.name)
+	}
+	if c.IgnoreShutdown {
+		return fmt.Errorf("Container %s did not shut down within %v", c.name, timeout)
+	}
+	c.state = lxc.STOPPED
+	return nil
+}
+
+func (c *FakeContainer) Destroy() error {
+	if !c.defined {
+		return fmt.Errorf("Container %s is not defined", c.name)
+	}
+	if c.state != lxc.STOPPED {
+		return fmt.Errorf("Container %s is running", c.name)
+	}
+	if len(c.snapshots) > 0 {
+		return fmt.Errorf("Container %s has snapshots", c.name)
+	}
+	if err := os.RemoveAll(filepath.Join(c.lxcpath, c.name)); err != nil {
+		return err
+	}
+	c.defined = false
+	c.config = nil
+	return nil
+}
+
+func (c *FakeContainer) Clone(name string, options lxc.CloneOptions) error {
+	if !c.defined {
+		return fmt.Errorf("Container %s is not defined", c.name)
+	}
+	if c.state != lxc.STOPPED {
+		return fmt.Errorf("Container %s is running", c.name)
+	}
+
+	lxcpath := c.lxcpath
+	if len(options.ConfigPath) > 0 {
+		lxcpath = options.ConfigPath
+	}
+
+	target := c.backend.Container(name, lxcpath)
+	if target.defined {
+		return fmt.Errorf("Container %s exists already", name)
+	}
+
+	rootfs := filepath.Join(lxcpath, name, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+
+	target.config = make([]fakeConfigItem, len(c.config))
+	copy(target.config, c.config)
+	target.setItem(c.backend.configKey("lxc.rootfs.path"), rootfs)
+	if !options.KeepName {
+		target.setItem(c.backend.configKey("lxc.uts.name"), name)
+	}
+	target.defined = true
+	return target.SaveConfigFile(target.ConfigFileName())
+}
+
+func (c *FakeContainer) SetVerbosity(verbosity lxc.Verbosity) {
+}
+
+func (c *FakeContainer) ConfigFileName() string {
+	return filepath.Join(c.lxcpath, c.name, "config")
+}
+
+func (c *FakeContainer) ConfigItem(key string) []string {
+	var values []string
+	for _, item := range c.config {
+		if item.key == key {
+			values = append(values, item.value)
+		}
+	}
+	if len(values) == 0 {
+		return []string{""}
+	}
+	return values
+}
+
+func (c *FakeContainer) SetConfigItem(key string, value string) error {
+	c.config = append(c.config, fakeConfigItem{key: key, value: value})
+	return nil
+}
+
+func (c *FakeContainer) setItem(key string, value string) {
+	c.ClearConfigItem(key)
+	c.SetConfigItem(key, value)
+}
+
+func (c *FakeContainer) ClearConfigItem(key string) error {
+	var items []fakeConfigItem
+	for _, item := range c.config {
+		if item.key != key && !strings.HasPrefix(item.key, key+".") {
+			items = append(items, item)
+		}
+	}
+	c.config = items
+	return nil
+}
+
+func (c *FakeContainer) ClearConfig() {
+	c.config = nil
+}
+
+func (c *FakeContainer) LoadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 {
+			return fmt.Errorf("Invalid config line in %s: %s", path, line)
+		}
+		c.SetConfigItem(strings.TrimSpace(keyValue[0]), strings.TrimSpace(keyValue[1]))
+	}
+	return nil
+}
+
+func (c *FakeContainer) SaveConfigFile(path string) error {
+	buffer := bytes.Buffer{}
+	for _, item := range c.config {
+		buffer.WriteString(fmt.Sprintf("%s = %s\n", item.key, item.value))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+func (c *FakeContainer) RunCommandStatus(args []string, options lxc.AttachOptions) (int, error) {
+	if c.state != lxc.RUNNING {
+		return -1, fmt.Errorf("Container %s is not running", c.name)
+	}
+
+	c.Commands = append(c.Commands, args)
+	if c.backend.RunHook == nil {
+		return 0, nil
+	}
+
+	exitCode, err := c.backend.RunHook(c, args, options)
+	//mimic the wait status returned by lxc
+	return exitCode << 8, err
+}
+
+// RunCommandNoWait runs the RunHook and returns the pid of a host process exiting with its code
+func (c *FakeContainer) RunCommandNoWait(args []string, options lxc.AttachOptions) (int, error) {
+	status, err := c.RunCommandStatus(args, options)
+	if err != nil {
+		return -1, err
+	}
+
+	process, err := os.StartProcess("/bin/sh", []string{"sh", "-c", fmt.Sprintf("exit %d", status>>8)}, &os.ProcAttr{})
+	if err != nil {
+		return -1, err
+	}
+	return process.Pid, nil
+}
+
+func (c *FakeContainer) WaitIPAddresses(timeout time.Duration) ([]string, error) {
+	if c.state != lxc.RUNNING || len(c.IPv4) == 0 {
+		return nil, fmt.Errorf("Container %s has no IP address", c.name)
+	}
+	return []string{c.IPv4}, nil
+}
+
+func (c *FakeContainer) IPv4Address(interfaceName string) ([]string, error) {
+	return c.WaitIPAddresses(0)
+}
+
+func (c *FakeContainer) Snapshots() ([]lxc.Snapshot, error) {
+	snapshots := make([]lxc.Snapshot, 0, len(c.snapshots))
+	for _, snap := range c.snapshots {
+		snapshots = append(snapshots, snap.snapshot)
+	}
+	return snapshots, nil
+}
+
+func (c *FakeContainer) CreateSnapshot() (*lxc.Snapshot, error) {
+	if !c.defined {
+		return nil, fmt.Errorf("Container %s is not defined", c.name)
+	}
+
+	idx := 0
+	for _, snap := range c.snapshots {
+		var snapIdx int
+		if _, err := fmt.Sscanf(snap.snapshot.Name, "snap%d", &snapIdx); err == nil && snapIdx >= idx {
+			idx = snapIdx + 1
+		}
+	}
+
+	name := fmt.Sprintf("snap%d", idx)
+	snapshot := lxc.Snapshot{
+		Name:      name,
+		Timestamp: time.Now().Format("2006:01:02 15:04:05"),
+		Path:      filepath.Join(c.lxcpath, c.name, "snaps", name),
+	}
+
+	if err := os.MkdirAll(snapshot.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	config := make([]fakeConfigItem, len(c.config))
+	copy(config, c.config)
+	c.snapshots = append(c.snapshots, fakeSnapshot{snapshot: snapshot, config: config})
+	return &snapshot, nil
+}
+
+func (c *FakeContainer) findSnapshot(snapshot lxc.Snapshot) int {
+	for i, snap := range c.snapshots {
+		if snap.snapshot.Name == snapshot.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *FakeContainer) RestoreSnapshot(snapshot lxc.Snapshot, name string) error {
+	idx := c.findSnapshot(snapshot)
+	if idx < 0 {
+		return fmt.Errorf("Snapshot %s not found", snapshot.Name)
+	}
+
+	target := c
+	if name != c.name {
+		target = c.backend.Container(name, c.lxcpath)
+		if target.defined {
+			return fmt.Errorf("Container %s exists already", name)
+		}
+		target.defined = true
+	}
+
+	target.config = make([]fakeConfigItem, len(c.snapshots[idx].config))
+	copy(target.config, c.snapshots[idx].config)
+	return target.SaveConfigFile(target.ConfigFileName())
+}
+
+func (c *FakeContainer) DestroySnapshot(snapshot lxc.Snapshot) error {
+	idx := c.findSnapshot(snapshot)
+	if idx < 0 {
+		return fmt.Errorf("Snapshot %s not found", snapshot.Name)
+	}
+
+	os.RemoveAll(c.snapshots[idx].snapshot.Path)
+	c.snapshots = append(c.snapshots[:idx], c.snapshots[idx+1:]...)
+	return nil
+}
+
+func (c *FakeContainer) DestroyAllSnapshots() error {
+	for len(c.snapshots) > 0 {
+		if err := c.DestroySnapshot(c.snapshots[0].snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
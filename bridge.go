@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const DefaultLxcBridge = "lxcbr0"
+
+// BridgeSettings describes how the lxc bridge is configured
+type BridgeSettings struct {
+	Name     string
+	Previous string
+	Network  *net.IPNet
+	IPv6     *net.IPNet
+}
+
+// addToIP returns ip + n, the result wraps around if it leaves the address space
+func addToIP(ip net.IP, n uint64) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	for i := len(result) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(result[i]) + n&0xff
+		result[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	return result
+}
+
+// lastIP returns the highest address of network
+func lastIP(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	if ip == nil {
+		ip = network.IP
+	}
+	result := make(net.IP, len(ip))
+	for i := range ip {
+		result[i] = ip[i] | ^network.Mask[i]
+	}
+	return result
+}
+
+// ParseNetwork parses a CIDR of the given family and checks the network is big enough
+func ParseNetwork(value string, ipv6 bool) (*net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid network %s: %v", value, err)
+	}
+
+	if (ip.To4() == nil) != ipv6 {
+		if ipv6 {
+			return nil, fmt.Errorf("%s is not a IPv6 network", value)
+		}
+		return nil, fmt.Errorf("%s is not a IPv4 network", value)
+	}
+
+	ones, bits := network.Mask.Size()
+	//the bridge address, at least one container address and the broadcast address
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("The network %s is too small", value)
+	}
+	return network, nil
+}
+
+// CheckNetworkConflicts fails if the network is already used on the host, except on the bridge itself
+func CheckNetworkConflicts(hostNetworks []HostNetwork, network *net.IPNet, bridge string) error {
+	conflicts := FindNetworkConflicts(hostNetworks, network, bridge)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	descriptions := []string{}
+	for _, conflict := range conflicts {
+		descriptions = append(descriptions, conflict.String())
+	}
+	return fmt.Errorf("The network %s conflicts with: %s", network, strings.Join(descriptions, ", "))
+}
+
+// DetectNetwork finds the first 10.0.x.0/24 network that does not collide with the host networks
+func DetectNetwork(hostNetworks []HostNetwork, bridge string) (*net.IPNet, error) {
+	for subnet := 1; subnet <= 254; subnet++ {
+		network := &net.IPNet{
+			IP:   net.IPv4(10, 0, byte(subnet), 0).To4(),
+			Mask: net.CIDRMask(24, 32),
+		}
+		if len(FindNetworkConflicts(hostNetworks, network, bridge)) == 0 {
+			return network, nil
+		}
+	}
+	return nil, fmt.Errorf("No valid subnet available, please select one with --network")
+}
+
+/*
+NewBridgeSettings decides how the lxc bridge is configured. Empty values keep
+the current bridge name and network, a network is detected if there is none
+or it conflicts with the host. IPv6 is only enabled if a network is given.
+*/
+func NewBridgeSettings(name string, network string, ipv6 string) (*BridgeSettings, error) {
+	configured := LxcBridgeConfigured() == nil
+
+	settings := &BridgeSettings{Name: name, Previous: DefaultLxcBridge}
+	currentNetwork := ""
+	if bridgeConf, err := ReadLxcBridgeConfig(); err == nil && len(bridgeConf["LXC_BRIDGE"]) > 0 {
+		settings.Previous = bridgeConf["LXC_BRIDGE"]
+		currentNetwork = bridgeConf["LXC_NETWORK"]
+	}
+	if len(settings.Name) == 0 {
+		settings.Name = settings.Previous
+	}
+	if err := CheckBridgeName(settings.Name); err != nil {
+		return nil, err
+	}
+
+	hostNetworks, err := HostNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(network) > 0 {
+		if settings.Network, err = ParseNetwork(network, false); err != nil {
+			return nil, err
+		}
+		if err = CheckNetworkConflicts(hostNetworks, settings.Network, settings.Name); err != nil {
+			return nil, err
+		}
+	} else if current, err := ParseNetwork(currentNetwork, false); configured && err == nil &&
+		CheckNetworkConflicts(hostNetworks, current, settings.Name) == nil {
+		//keep the network if only the bridge name or IPv6 changes
+		settings.Network = current
+	} else {
+		if settings.Network, err = DetectNetwork(hostNetworks, settings.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ipv6) > 0 {
+		if settings.IPv6, err = ParseNetwork(ipv6, true); err != nil {
+			return nil, err
+		}
+		if err = CheckNetworkConflicts(hostNetworks, settings.IPv6, settings.Name); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// bridgeConfigValues returns the lxc-net keys to set, in the order they are added to the file
+func (s *BridgeSettings) bridgeConfigValues() ([]string, map[string]string) {
+	ones, bits := s.Network.Mask.Size()
+	size := uint64(1) << uint(bits-ones)
+
+	keys := []string{"USE_LXC_BRIDGE", "LXC_BRIDGE", "LXC_ADDR", "LXC_NETMASK", "LXC_NETWORK", "LXC_DHCP_RANGE", "LXC_DHCP_MAX"}
+	values := map[string]string{
+		"USE_LXC_BRIDGE": "true",
+		"LXC_BRIDGE":     s.Name,
+		"LXC_ADDR":       addToIP(s.Network.IP, 1).String(),
+		"LXC_NETMASK":    net.IP(s.Network.Mask).String(),
+		"LXC_NETWORK":    s.Network.String(),
+		"LXC_DHCP_RANGE": fmt.Sprintf("%s,%s", addToIP(s.Network.IP, 2), addToIP(lastIP(s.Network), ^uint64(0))),
+		"LXC_DHCP_MAX":   strconv.FormatUint(size-3, 10),
+	}
+
+	if s.IPv6 != nil {
+		ones, _ := s.IPv6.Mask.Size()
+		keys = append(keys, "LXC_IPV6_ADDR", "LXC_IPV6_MASK", "LXC_IPV6_NETWORK", "LXC_IPV6_NAT")
+		values["LXC_IPV6_ADDR"] = addToIP(s.IPv6.IP, 1).String()
+		values["LXC_IPV6_MASK"] = strconv.Itoa(ones)
+		values["LXC_IPV6_NETWORK"] = s.IPv6.String()
+		values["LXC_IPV6_NAT"] = "true"
+	}
+	return keys, values
+}
+
+// PlanLxcBridgeFile returns the current and the new content of the lxc-net config
+func PlanLxcBridgeFile(settings *BridgeSettings) (string, string, error) {
+	buffer := bytes.Buffer{}
+
+	data, err := ioutil.ReadFile(LxcBridgeFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	input := string(data)
+	keys, newValues := settings.bridgeConfigValues()
+
+	found := map[string]bool{}
+
+	for _, line := range SplitLines(input) {
+		out := line
+
+		if !strings.HasPrefix(line, "#") {
+			for prefix, value := range newValues {
+				if strings.HasPrefix(line, prefix+"=") {
+					out = fmt.Sprintf(`%s="%s"`, prefix, value)
+					found[prefix] = true
+					break
+				}
+			}
+		}
+
+		buffer.WriteString(out)
+		buffer.WriteString("\n")
+	}
+
+	for _, prefix := range keys {
+		if !found[prefix] {
+			buffer.WriteString(prefix)
+			buffer.WriteString("=")
+			buffer.WriteString(newValues[prefix])
+			buffer.WriteString("\n")
+			found[prefix] = true // not necessary but keeps "found" logically consistent
+		}
+	}
+
+	return input, buffer.String(), nil
+}
+
+func editLxcBridgeFile(settings *BridgeSettings) error {
+	_, content, err := PlanLxcBridgeFile(settings)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(LxcBridgeFile)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(LxcBridgeFile, []byte(content), info.Mode().Perm())
+}
+
+/*
+PlanLxcDefaultConfig moves the network links of the lxc default config, which
+every target includes, from the previous bridge to the new one. Returns the
+current and the new content.
+*/
+func PlanLxcDefaultConfig(settings *BridgeSettings) (string, string, error) {
+	data, err := ioutil.ReadFile(LxcDefaultInclude)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	content := string(data)
+	if settings.Name == settings.Previous {
+		return content, content, nil
+	}
+
+	buffer := bytes.Buffer{}
+	for _, line := range SplitLines(content) {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) == 2 && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			key := strings.TrimSpace(keyValue[0])
+			if (key == "lxc.net.0.link" || key == "lxc.network.link") && strings.TrimSpace(keyValue[1]) == settings.Previous {
+				line = fmt.Sprintf("%s = %s", key, settings.Name)
+			}
+		}
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+	}
+	return content, buffer.String(), nil
+}
+
+func editLxcDefaultConfig(settings *BridgeSettings) error {
+	content, newContent, err := PlanLxcDefaultConfig(settings)
+	if err != nil || content == newContent {
+		return err
+	}
+
+	info, err := os.Stat(LxcDefaultInclude)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(LxcDefaultInclude, []byte(newContent), info.Mode().Perm())
+}
+
+/*
+ConfigureLxcBridge writes the lxc-net config and the lxc default config for
+the bridge, then enables and restarts lxc-net. Every change is recorded in
+state, so lmsdk-target teardown can undo it.
+*/
+func ConfigureLxcBridge(state *HostSetupState, settings *BridgeSettings) error {
+	err := state.RecordFileChange(LxcBridgeFile, func() error {
+		return editLxcBridgeFile(settings)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = state.RecordFileChange(LxcDefaultInclude, func() error {
+		return editLxcDefaultConfig(settings)
+	})
+	if err != nil {
+		return err
+	}
+
+	wasEnabled := exec.Command("systemctl", "is-enabled", "--quiet", "lxc-net").Run() == nil
+	if err = state.RecordService("lxc-net", wasEnabled); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("bash", "-c", "systemctl enable lxc-net && systemctl restart lxc-net")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("Restarting the LXC network service failed. error: %v", err)
+	}
+	return nil
+}
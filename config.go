@@ -0,0 +1,380 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LxcDefaultInclude = "/etc/lxc/default.conf"
+
+type ConfigItem struct {
+	Key   string
+	Value string
+}
+
+func (i ConfigItem) String() string {
+	return fmt.Sprintf("%s = %s", i.Key, i.Value)
+}
+
+// IdMapConfigKey returns the id map key understood by the installed lxc version
+func IdMapConfigKey() string {
+	return ConfigKey("lxc.idmap")
+}
+
+// DefaultIdMap maps the subuid/subgid ranges of the current user into the container,
+// the container user is mapped 1:1 to the current user.
+func DefaultIdMap(containerUser ContainerUser, idMapKey string) ([]ConfigItem, error) {
+	currUser, err := LxcContainerUser()
+	if err != nil {
+		return nil, err
+	}
+
+	t_uid, err := strconv.ParseUint(currUser.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	t_gid, err := strconv.ParseUint(currUser.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	uidRanges, err := GetOrCreateUidRange(false)
+	if err != nil {
+		return nil, err
+	}
+
+	gidRanges, err := GetOrCreateGuidRange(false)
+	if err != nil {
+		return nil, err
+	}
+
+	uidBelow, uidUser, uidAbove, err := SubIdMap("u", uidRanges, containerUser.Uid, uint32(t_uid))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to map the container user %s: %v", containerUser.Name, err)
+	}
+
+	gidBelow, gidUser, gidAbove, err := SubIdMap("g", gidRanges, containerUser.Gid, uint32(t_gid))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to map the container group of %s: %v", containerUser.Name, err)
+	}
+
+	//the ids before the container user, the container user 1:1 and the rest
+	idMap := []ConfigItem{}
+	for _, group := range [][]string{uidBelow, gidBelow, uidUser, gidUser, uidAbove, gidAbove} {
+		for _, value := range group {
+			idMap = append(idMap, ConfigItem{idMapKey, value})
+		}
+	}
+	return idMap, nil
+}
+
+// IdMapEntry is a parsed lxc.idmap value
+type IdMapEntry struct {
+	Kind        string
+	ContainerId uint32
+	HostId      uint32
+	Count       uint32
+}
+
+// ParseIdMap parses lxc.idmap values, which are u|g|b <container id> <host id> <count>
+func ParseIdMap(values []string) ([]IdMapEntry, error) {
+	entries := []IdMapEntry{}
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) != 4 || (fields[0] != "u" && fields[0] != "g" && fields[0] != "b") {
+			return nil, fmt.Errorf("Invalid id mapping: %s", value)
+		}
+
+		ids := [3]uint32{}
+		for i, field := range fields[1:] {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid id mapping: %s", value)
+			}
+			ids[i] = uint32(id)
+		}
+		entries = append(entries, IdMapEntry{fields[0], ids[0], ids[1], ids[2]})
+	}
+	return entries, nil
+}
+
+// IdMapToHost returns the host id of a container id of kind "u" or "g"
+func IdMapToHost(entries []IdMapEntry, kind string, containerId uint32) (uint32, bool) {
+	for _, e := range entries {
+		if (e.Kind == kind || e.Kind == "b") && containerId >= e.ContainerId &&
+			uint64(containerId) < uint64(e.ContainerId)+uint64(e.Count) {
+			return e.HostId + (containerId - e.ContainerId), true
+		}
+	}
+	return 0, false
+}
+
+// IdMapToContainer returns the container id of a host id of kind "u" or "g"
+func IdMapToContainer(entries []IdMapEntry, kind string, hostId uint32) (uint32, bool) {
+	for _, e := range entries {
+		if (e.Kind == kind || e.Kind == "b") && hostId >= e.HostId &&
+			uint64(hostId) < uint64(e.HostId)+uint64(e.Count) {
+			return e.ContainerId + (hostId - e.HostId), true
+		}
+	}
+	return 0, false
+}
+
+// sharedMountEntries are the standard mount entries besides the home directory
+var sharedMountEntries = []string{
+	"/tmp tmp none rbind,create=dir 0 0",
+	"/media media none rbind,create=dir 0 0",
+}
+
+// HomeMountEntry returns the lxc.mount.entry value binding the home directory into the target
+func HomeMountEntry(homeDir string) string {
+	return fmt.Sprintf("%s %s none rbind,create=dir 0 0", homeDir, homeDir[1:])
+}
+
+// StandardMountEntries returns the lxc.mount.entry values every target gets
+func StandardMountEntries(homeDir string) []string {
+	return append([]string{HomeMountEntry(homeDir)}, sharedMountEntries...)
+}
+
+// isStandardMountEntry detects the exact entries written by StandardMountEntries and the
+// home mount recorded in the config-lm file, other mounts below /home are added by the user and kept
+func isStandardMountEntry(entry string, container *LMTargetContainer, homeDir string) bool {
+	fields := strings.Join(strings.Fields(entry), " ")
+	if len(container.HomeMount) > 0 && fields == container.HomeMount {
+		return true
+	}
+	for _, standard := range StandardMountEntries(homeDir) {
+		if fields == standard {
+			return true
+		}
+	}
+	return false
+}
+
+// recordHomeMount stores the home mount of the container config in the config-lm file,
+// so it is replaced if the home directory changes
+func recordHomeMount(container *LMTargetContainer, homeDir string) error {
+	if homeMount := HomeMountEntry(homeDir); container.HomeMount != homeMount {
+		container.HomeMount = homeMount
+		return WriteLMContainerConfig(container)
+	}
+	return nil
+}
+
+func configLineKey(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "#") {
+		return ""
+	}
+
+	keyValue := strings.SplitN(trimmed, "=", 2)
+	if len(keyValue) != 2 {
+		return ""
+	}
+	return strings.TrimSpace(keyValue[0])
+}
+
+func configLineValue(line string) string {
+	keyValue := strings.SplitN(line, "=", 2)
+	if len(keyValue) != 2 {
+		return ""
+	}
+	return strings.TrimSpace(keyValue[1])
+}
+
+/*
+GenerateContainerConfig regenerates the host specific parts of the container config,
+which are the lxc.include, the id mappings, the standard mount entries and the
+network mode. All other lines are kept in place.
+
+Returns the lines of the current and the regenerated config file.
+*/
+func GenerateContainerConfig(container *LMTargetContainer) ([]string, []string, error) {
+	data, err := ioutil.ReadFile(container.Container.ConfigFileName())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read container config: %v", err)
+	}
+	oldConfig := SplitLines(string(data))
+
+	currUser, err := LxcContainerUser()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idMapKey := IdMapConfigKey()
+	idMap, err := DefaultIdMap(container.User, idMapKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups := map[string][]string{
+		"include": {ConfigItem{"lxc.include", LxcDefaultInclude}.String()},
+		"mounts":  {},
+		"idmap":   {},
+		"network": NetworkConfigLines(container.NetworkMode(), LXCNewVersion()),
+	}
+	for _, item := range idMap {
+		groups["idmap"] = append(groups["idmap"], item.String())
+	}
+	for _, entry := range StandardMountEntries(currUser.HomeDir) {
+		groups["mounts"] = append(groups["mounts"], ConfigItem{"lxc.mount.entry", entry}.String())
+	}
+
+	emitted := map[string]bool{}
+	newConfig := []string{}
+	for _, line := range oldConfig {
+		group := ""
+		switch key := configLineKey(line); {
+		case key == "lxc.include" && configLineValue(line) == LxcDefaultInclude:
+			group = "include"
+		case key == "lxc.idmap" || key == "lxc.id_map":
+			group = "idmap"
+		case key == "lxc.mount.entry" && isStandardMountEntry(configLineValue(line), container, currUser.HomeDir):
+			group = "mounts"
+		case isNetworkModeLine(line):
+			group = "network"
+		}
+
+		if group == "" {
+			newConfig = append(newConfig, line)
+			continue
+		}
+
+		//the new group replaces the first line of the old one
+		if !emitted[group] {
+			newConfig = append(newConfig, groups[group]...)
+			emitted[group] = true
+		}
+	}
+
+	if !emitted["include"] {
+		newConfig = append(groups["include"], newConfig...)
+	}
+	for _, group := range []string{"idmap", "mounts", "network"} {
+		if !emitted[group] {
+			newConfig = append(newConfig, groups[group]...)
+		}
+	}
+
+	return oldConfig, newConfig, nil
+}
+
+// TimestampedBackupName returns a backup file name next to fileName containing the current time
+func TimestampedBackupName(fileName string) string {
+	return fmt.Sprintf("%s.bak-%s", fileName, time.Now().Format("20060102150405"))
+}
+
+// BackupFile copies a file next to itself and returns the name of the copy
+func BackupFile(fileName string) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	backupName := TimestampedBackupName(fileName)
+	if err = ioutil.WriteFile(backupName, data, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("Unable to write backup file %s: %v", backupName, err)
+	}
+	return backupName, nil
+}
+
+// WriteFileAtomic replaces the file by renaming a completely written temporary file over it
+func WriteFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomicOwned(fileName, data, perm, -1, -1)
+}
+
+/*
+WriteFileAtomicOwned is WriteFileAtomic for a file owned by uid and gid, -1 keeps the
+owner. The mode and owner are set on the open temporary file, so replacing it with a
+symlink in a directory writable by the user can not change another file.
+*/
+func WriteFileAtomicOwned(fileName string, data []byte, perm os.FileMode, uid int, gid int) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err == nil && (uid >= 0 || gid >= 0) {
+		err = tmpFile.Chown(uid, gid)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return nil
+}
+
+/*
+UpdateConfigSync writes the regenerated container config, see GenerateContainerConfig,
+and records the new home mount in the config-lm file. The old config is kept as backup,
+its file name is returned. If the config is already up to date nothing is written
+and a empty string is returned.
+*/
+func UpdateConfigSync(container *LMTargetContainer) (string, error) {
+	_, newConfig, err := GenerateContainerConfig(container)
+	if err != nil {
+		return "", err
+	}
+
+	currUser, err := LxcContainerUser()
+	if err != nil {
+		return "", err
+	}
+
+	edit, err := LoadConfigEdit(container.Container.ConfigFileName())
+	if err != nil {
+		return "", err
+	}
+	edit.ReplaceLines(newConfig)
+
+	backup := ""
+	if edit.Changed() {
+		//reconfigure keeps every old version
+		edit.BackupName = TimestampedBackupName(edit.FileName)
+		if backup, err = edit.Apply(container.Container); err != nil {
+			return "", err
+		}
+	}
+	return backup, recordHomeMount(container, currUser.HomeDir)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateConfigSyncHomeMount(t *testing.T) {
+	_, restore := useFakeBackend(t, "2.1.1")
+	defer restore()
+
+	if _, err := DefaultIdMap(DefaultContainerUser, "lxc.idmap"); err != nil {
+		t.Skipf("The user can not map the container user: %v", err)
+	}
+	currUser, err := LxcContainerUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the target was created before the home directory moved
+	oldHomeMount := HomeMountEntry("/srv/olduser")
+	userMount := "/srv/olduser/src srv/olduser/src none bind,create=dir 0 0"
+	tests := []struct {
+		name     string
+		lmConfig string
+	}{
+		{"recorded", `{"configVersion": 2, "name": "target", "homeMount": "` + oldHomeMount + `"}`},
+		//version 1 did not record the home mount
+		{"migrated", `{"configVersion": 1, "name": "target"}`},
+	}
+
+	for _, test := range tests {
+		c := createFakeContainer(t, "target")
+		mounts := append([]string{oldHomeMount}, append(sharedMountEntries, userMount)...)
+		config := []string{"lxc.uts.name = target"}
+		for _, entry := range mounts {
+			config = append(config, "lxc.mount.entry = "+entry)
+		}
+		ioutil.WriteFile(c.ConfigFileName(), []byte(strings.Join(config, "\n")+"\n"), 0644)
+		ioutil.WriteFile(c.ConfigFileName()+"-lm", []byte(test.lmConfig), 0644)
+		c.ClearConfig()
+		c.LoadConfigFile(c.ConfigFileName())
+
+		target, err := LoadLMContainer("target")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if target.HomeMount != oldHomeMount {
+			t.Errorf("%s: the home mount of the loaded target is %q, expected %q", test.name, target.HomeMount, oldHomeMount)
+		}
+
+		if _, err = UpdateConfigSync(target); err != nil {
+			t.Fatalf("%s: UpdateConfigSync() failed: %v", test.name, err)
+		}
+
+		//the old home mount is replaced, the mount added by the user is kept
+		wanted := append([]string{HomeMountEntry(currUser.HomeDir)}, append(sharedMountEntries, userMount)...)
+		if mounts := c.ConfigItem("lxc.mount.entry"); !reflect.DeepEqual(mounts, wanted) {
+			t.Errorf("%s: the mount entries are %v, expected %v", test.name, mounts, wanted)
+		}
+
+		target, err = LoadLMContainer("target")
+		if err != nil || target.HomeMount != HomeMountEntry(currUser.HomeDir) || target.ConfigOutdated() {
+			t.Errorf("%s: the config-lm file was not updated: %+v, %v", test.name, target, err)
+		}
+		c.Destroy()
+	}
+}
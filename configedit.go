@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+ConfigEdit is a edit of a lxc config file. The file is loaded once, changed
+in memory and written with Commit, which validates the new content, keeps
+the old one as backup and replaces the file atomically. Lines that are not
+touched keep their position, comments and formatting.
+
+	edit, err := LoadConfigEdit(container.ConfigFileName())
+	edit.Set("lxc.uts.name", "target")
+	fmt.Print(edit.Diff())
+	backup, err := edit.Apply(container)
+*/
+type ConfigEdit struct {
+	FileName string
+	//the backup written by Commit, defaults to FileName.bak
+	BackupName string
+
+	perm     os.FileMode
+	exists   bool
+	original []string
+	lines    []string
+}
+
+// LoadConfigEdit starts a edit of a existing config file
+func LoadConfigEdit(fileName string) (*ConfigEdit, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config %s: %v", fileName, err)
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := SplitLines(string(data))
+	return &ConfigEdit{
+		FileName:   fileName,
+		BackupName: fileName + ".bak",
+		perm:       info.Mode().Perm(),
+		exists:     true,
+		original:   lines,
+		lines:      append([]string{}, lines...),
+	}, nil
+}
+
+// NewConfigEdit starts a edit of a config file that does not need to exist yet
+func NewConfigEdit(fileName string) (*ConfigEdit, error) {
+	if _, err := os.Stat(fileName); err == nil {
+		return LoadConfigEdit(fileName)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &ConfigEdit{FileName: fileName, BackupName: fileName + ".bak", perm: 0644}, nil
+}
+
+// Lines returns the current lines of the config
+func (e *ConfigEdit) Lines() []string {
+	return append([]string{}, e.lines...)
+}
+
+// Items returns the values of all items with the given key
+func (e *ConfigEdit) Items(key string) []string {
+	values := []string{}
+	for _, line := range e.lines {
+		if configLineKey(line) == key {
+			values = append(values, configLineValue(line))
+		}
+	}
+	return values
+}
+
+// Append adds a item after the last item with the same key, or at the end
+func (e *ConfigEdit) Append(key string, value string) {
+	line := ConfigItem{key, value}.String()
+	for i := len(e.lines) - 1; i >= 0; i-- {
+		if configLineKey(e.lines[i]) == key {
+			e.lines = append(e.lines[:i+1], append([]string{line}, e.lines[i+1:]...)...)
+			return
+		}
+	}
+	e.lines = append(e.lines, line)
+}
+
+// Set replaces all items of key by the given values, at the position of the first one
+func (e *ConfigEdit) Set(key string, values ...string) {
+	newLines := []string{}
+	inserted := false
+	for _, line := range e.lines {
+		if configLineKey(line) != key {
+			newLines = append(newLines, line)
+			continue
+		}
+		if !inserted {
+			for _, value := range values {
+				newLines = append(newLines, ConfigItem{key, value}.String())
+			}
+			inserted = true
+		}
+	}
+	if !inserted {
+		for _, value := range values {
+			newLines = append(newLines, ConfigItem{key, value}.String())
+		}
+	}
+	e.lines = newLines
+}
+
+// Clear removes all items of key
+func (e *ConfigEdit) Clear(key string) {
+	e.Set(key)
+}
+
+// RemoveItems removes the items of key for which remove returns true and returns their values
+func (e *ConfigEdit) RemoveItems(key string, remove func(value string) bool) []string {
+	removed := []string{}
+	newLines := []string{}
+	for _, line := range e.lines {
+		if configLineKey(line) == key && remove(configLineValue(line)) {
+			removed = append(removed, configLineValue(line))
+			continue
+		}
+		newLines = append(newLines, line)
+	}
+	e.lines = newLines
+	return removed
+}
+
+// ReplaceLines replaces the whole content, for edits that work on the lines directly
+func (e *ConfigEdit) ReplaceLines(lines []string) {
+	e.lines = append([]string{}, lines...)
+}
+
+// Validate checks that every line is a comment or a lxc key with a valid value
+func (e *ConfigEdit) Validate() error {
+	for i, line := range e.lines {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		key := configLineKey(line)
+		if !strings.HasPrefix(key, "lxc.") || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("%s:%d: invalid config line: %s", e.FileName, i+1, line)
+		}
+
+		value := configLineValue(line)
+		switch key {
+		case "lxc.idmap", "lxc.id_map":
+			if _, err := ParseIdMap([]string{value}); err != nil {
+				return fmt.Errorf("%s:%d: %v", e.FileName, i+1, err)
+			}
+		case "lxc.mount.entry":
+			if len(strings.Fields(value)) < 4 {
+				return fmt.Errorf("%s:%d: invalid mount entry: %s", e.FileName, i+1, value)
+			}
+		}
+	}
+	return nil
+}
+
+// Changed returns true if the content differs from the loaded file
+func (e *ConfigEdit) Changed() bool {
+	return !e.exists || UnifiedDiff("", "", e.original, e.lines) != ""
+}
+
+// Diff returns the pending changes in unified diff format, empty if there are none
+func (e *ConfigEdit) Diff() string {
+	return UnifiedDiff(e.FileName, e.FileName, e.original, e.lines)
+}
+
+/*
+Commit validates and writes the config. The previous content is written to
+BackupName first, its name is returned. If nothing changed nothing is written
+and a empty string is returned, as for a new file that has no backup.
+*/
+func (e *ConfigEdit) Commit() (string, error) {
+	if !e.Changed() {
+		return "", nil
+	}
+	if err := e.Validate(); err != nil {
+		return "", err
+	}
+
+	backupName := ""
+	if e.exists {
+		backupName = e.BackupName
+		content := strings.Join(e.original, "\n") + "\n"
+		if err := WriteFileAtomic(backupName, []byte(content), e.perm); err != nil {
+			return "", fmt.Errorf("Unable to write backup file %s: %v", backupName, err)
+		}
+	}
+
+	if err := WriteFileAtomic(e.FileName, []byte(strings.Join(e.lines, "\n")+"\n"), e.perm); err != nil {
+		return "", fmt.Errorf("Unable to write config %s: %v", e.FileName, err)
+	}
+
+	e.original = append([]string{}, e.lines...)
+	e.exists = true
+	return backupName, nil
+}
+
+// Apply commits the edit and reloads the config of the container from the new file
+func (e *ConfigEdit) Apply(container ContainerBackend) (string, error) {
+	changed := e.Changed()
+	backupName, err := e.Commit()
+	if err != nil || !changed {
+		return backupName, err
+	}
+
+	container.ClearConfig()
+	if err = container.LoadConfigFile(e.FileName); err != nil {
+		return backupName, fmt.Errorf("Unable to load the new container config: %v", err)
+	}
+	return backupName, nil
+}
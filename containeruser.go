@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ContainerUser is the default user inside a container, it is mapped to the host user
+type ContainerUser struct {
+	Name string `json:"name"`
+	Uid  uint32 `json:"uid"`
+	Gid  uint32 `json:"gid"`
+}
+
+// DefaultContainerUser is used if neither the image nor the user config define the container user
+var DefaultContainerUser = ContainerUser{Name: "system", Uid: 20000, Gid: 1002}
+
+// distroContainerUsers are the users of the images of the known distros, for images without user metadata
+var distroContainerUsers = map[string]ContainerUser{
+	"link-motion-autoos": {Name: "org.c4c.ui_cluster", Uid: 20000, Gid: 1002},
+	"link-motion-ivios":  {Name: "system", Uid: 20000, Gid: 1002},
+}
+
+// ImageUserFile is the file in the container directory the image metadata about the user is copied to
+const ImageUserFile = "image-user"
+
+// ContainerUsersFile is the name of the user config file in ConfigPath()
+const ContainerUsersFile = "container-users.json"
+
+func (u ContainerUser) validate() error {
+	if len(u.Name) == 0 || strings.ContainsAny(u.Name, " \t\n:;") {
+		return fmt.Errorf("Invalid container user name: '%s'", u.Name)
+	}
+	if u.Uid == 0 || u.Gid == 0 {
+		return fmt.Errorf("The container user %s can not be root", u.Name)
+	}
+	return nil
+}
+
+/*
+ReadImageUser parses the user metadata of a image, the file contains
+key=value lines:
+
+	name=system
+	uid=20000
+	gid=1002
+
+Returns nil if the file does not exist.
+*/
+func ReadImageUser(fileName string) (*ContainerUser, error) {
+	values, err := ReadKeyValueFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	containerUser := ContainerUser{Name: values["name"]}
+	for _, key := range []string{"uid", "gid"} {
+		id, err := strconv.ParseUint(values[key], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in %s: '%s'", key, fileName, values[key])
+		}
+		if key == "uid" {
+			containerUser.Uid = uint32(id)
+		} else {
+			containerUser.Gid = uint32(id)
+		}
+	}
+
+	if err = containerUser.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return &containerUser, nil
+}
+
+// ReadConfiguredUser returns the container user configured for the distro in
+// ContainerUsersFile, or nil if there is none
+func ReadConfiguredUser(distro string) (*ContainerUser, error) {
+	confDir, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := path.Join(confDir, ContainerUsersFile)
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	users := map[string]ContainerUser{}
+	if err = json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", fileName, err)
+	}
+
+	containerUser, ok := users[distro]
+	if !ok {
+		return nil, nil
+	}
+	if err = containerUser.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return &containerUser, nil
+}
+
+/*
+ResolveContainerUser returns the container user for a new target of the distro.
+A entry in ~/.config/lm-sdk/container-users.json wins over the image metadata
+in imageUserFile, if neither exist the user of the distro is taken from
+distroContainerUsers. For unknown distros DefaultContainerUser is used.
+
+The user config file maps distros to users:
+
+	{"link-motion-ivios": {"name": "system", "uid": 20000, "gid": 1002}}
+*/
+func ResolveContainerUser(distro string, imageUserFile string) (ContainerUser, error) {
+	configured, err := ReadConfiguredUser(distro)
+	if err != nil {
+		return ContainerUser{}, err
+	}
+	if configured != nil {
+		return *configured, nil
+	}
+
+	if len(imageUserFile) > 0 {
+		imageUser, err := ReadImageUser(imageUserFile)
+		if err != nil {
+			return ContainerUser{}, err
+		}
+		if imageUser != nil {
+			return *imageUser, nil
+		}
+	}
+
+	if distroUser, ok := distroContainerUsers[distro]; ok {
+		return distroUser, nil
+	}
+	return DefaultContainerUser, nil
+}
+
+// PasswdEntry is a user of the passwd file in the container rootfs
+type PasswdEntry struct {
+	Name  string
+	Uid   uint32
+	Gid   uint32
+	Home  string
+	Shell string
+}
+
+// LookupContainerPasswd returns the passwd entry of the user in the rootfs of the container
+func LookupContainerPasswd(container ContainerBackend, name string) (*PasswdEntry, error) {
+	fileName := rootfsFile(container, "etc/passwd")
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range SplitLines(string(data)) {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] != name {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid uid of %s in %s: '%s'", name, fileName, fields[2])
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gid of %s in %s: '%s'", name, fileName, fields[3])
+		}
+		return &PasswdEntry{Name: name, Uid: uint32(uid), Gid: uint32(gid), Home: fields[5], Shell: fields[6]}, nil
+	}
+	return nil, fmt.Errorf("The user %s does not exist in the container", name)
+}
+
+// LookupContainerGroups returns the ids of the supplementary groups of the user in the rootfs of the container
+func LookupContainerGroups(container ContainerBackend, name string) ([]int, error) {
+	fileName := rootfsFile(container, "etc/group")
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []int{}
+	for _, line := range SplitLines(string(data)) {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if strings.TrimSpace(member) != name {
+				continue
+			}
+			gid, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid gid of %s in %s: '%s'", fields[0], fileName, fields[2])
+			}
+			groups = append(groups, int(gid))
+			break
+		}
+	}
+	return groups, nil
+}
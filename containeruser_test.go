@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveContainerUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imageUser := filepath.Join(dir, "image-user")
+	ioutil.WriteFile(imageUser, []byte("name=developer\nuid=30000\ngid=30000\n"), 0644)
+
+	tests := []struct {
+		distro    string
+		imageUser string
+		user      ContainerUser
+	}{
+		//the users of the images without user metadata
+		{"link-motion-autoos", "", ContainerUser{Name: "org.c4c.ui_cluster", Uid: 20000, Gid: 1002}},
+		{"link-motion-ivios", "", ContainerUser{Name: "system", Uid: 20000, Gid: 1002}},
+		{"unknown", filepath.Join(dir, "missing"), DefaultContainerUser},
+		{"link-motion-autoos", imageUser, ContainerUser{Name: "developer", Uid: 30000, Gid: 30000}},
+	}
+
+	for _, test := range tests {
+		if configured, _ := ReadConfiguredUser(test.distro); configured != nil {
+			t.Logf("Skipping %s, a user is configured for it in %s", test.distro, ContainerUsersFile)
+			continue
+		}
+
+		user, err := ResolveContainerUser(test.distro, test.imageUser)
+		if err != nil {
+			t.Errorf("ResolveContainerUser(%s, %q) failed: %v", test.distro, test.imageUser, err)
+		} else if user != test.user {
+			t.Errorf("ResolveContainerUser(%s, %q) = %+v, expected %+v", test.distro, test.imageUser, user, test.user)
+		}
+	}
+}
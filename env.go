@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// EnvFileEnvVar names a env file that is applied to all commands, the wrapper can not take options
+const EnvFileEnvVar = "LMSDK_ENV_FILE"
+
+var envNameRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+var envPatternRegex = regexp.MustCompile(`^[A-Za-z_*][A-Za-z0-9_*]*$`)
+
+// IsValidEnvName returns true if name can be used as environment variable
+func IsValidEnvName(name string) bool {
+	return envNameRegex.MatchString(name)
+}
+
+// reservedEnvNames are set for the target by the exec paths, the values of the host break it
+var reservedEnvNames = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LC_ALL", "LD_LIBRARY_PATH", "LD_PRELOAD"}
+
+// IsReservedEnvName returns true for variables that are never passed through from the host
+func IsReservedEnvName(name string) bool {
+	return strings.HasPrefix(name, "LD_") || containsEnvName(reservedEnvNames, name)
+}
+
+func containsEnvName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+CheckEnvPattern validates an entry of the passthrough allowlist, a variable
+name that may contain * wildcards, e.g. CCACHE_*. Patterns matching one of
+the variables the exec paths set themselves are rejected.
+*/
+func CheckEnvPattern(pattern string) error {
+	if !envPatternRegex.MatchString(pattern) || len(strings.Trim(pattern, "*")) == 0 {
+		return fmt.Errorf("Invalid environment variable name: '%s'", pattern)
+	}
+	if strings.HasPrefix(pattern, "LD_") {
+		return fmt.Errorf("%s can not be passed through, it is set for the target", pattern)
+	}
+	for _, name := range reservedEnvNames {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return fmt.Errorf("%s can not be passed through, it is set for the target", pattern)
+		}
+	}
+	return nil
+}
+
+// ParseEnvAssignment splits a KEY=VALUE assignment and validates the name
+func ParseEnvAssignment(assignment string) (string, string, error) {
+	keyValue := strings.SplitN(assignment, "=", 2)
+	if len(keyValue) != 2 || !IsValidEnvName(keyValue[0]) {
+		return "", "", fmt.Errorf("Invalid environment assignment '%s', expected KEY=VALUE", assignment)
+	}
+	return keyValue[0], keyValue[1], nil
+}
+
+/*
+ReadEnvFile parses a file of KEY=VALUE lines and returns them as
+assignments in the order of the file. Empty lines and lines starting
+with # are ignored, a leading export and quotes around the value
+are removed:
+
+	CFLAGS="-O2 -g"
+	export CCACHE_DIR=/home/user/.ccache
+*/
+func ReadEnvFile(fileName string) ([]string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	env := []string{}
+	for _, line := range SplitLines(string(data)) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, err := ParseEnvAssignment(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// PassthroughEnvironment returns the variables of the host that match the allowlist of the target,
+// reserved variables are left out even if a pattern matches them
+func (c *LMTargetContainer) PassthroughEnvironment() []string {
+	env := []string{}
+	for _, envVar := range os.Environ() {
+		key := strings.SplitN(envVar, "=", 2)[0]
+		if IsReservedEnvName(key) {
+			continue
+		}
+		for _, pattern := range c.EnvPassthrough {
+			if matched, _ := filepath.Match(pattern, key); matched {
+				env = append(env, envVar)
+				break
+			}
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+/*
+CommandEnvironment returns the environment commands in the target are run
+with, as KEY=VALUE pairs where later ones win. The C locale comes first,
+followed by the persistent environment of the target, the host variables
+on its passthrough allowlist, the file in EnvFileEnvVar and finally extra,
+which holds what was given on the command line.
+*/
+func (c *LMTargetContainer) CommandEnvironment(extra []string) ([]string, error) {
+	//force C locale as QtCreator needs it
+	env := []string{"LC_ALL=C"}
+	env = append(env, c.EnvironmentList()...)
+	env = append(env, c.PassthroughEnvironment()...)
+
+	if envFile := os.Getenv(EnvFileEnvVar); len(envFile) > 0 {
+		fileEnv, err := ReadEnvFile(envFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the %s file: %v", EnvFileEnvVar, err)
+		}
+		env = append(env, fileEnv...)
+	}
+	return append(env, extra...), nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+/*
+BridgeFixable configures the lxc bridge if it is not set up. The current
+bridge name is kept, the network is the first 10.0.x.0/24 network that does
+not conflict with the host. Use lmsdk-target autosetup to choose others.
+*/
+type BridgeFixable struct{}
+
+func (*BridgeFixable) Name() string {
+	return "bridge"
+}
+
+func (*BridgeFixable) Description() string {
+	return "Configures and starts the lxc bridge if it is not set up"
+}
+
+func (*BridgeFixable) Check() error {
+	return lm_sdk_tools.LxcBridgeConfigured()
+}
+
+func (c *BridgeFixable) Fix() error {
+	if c.Check() == nil {
+		return nil
+	}
+
+	settings, err := lm_sdk_tools.NewBridgeSettings("", "", "")
+	if err != nil {
+		return err
+	}
+
+	state, err := lm_sdk_tools.LoadHostSetupState()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("... Using bridge %s with network %s\n", settings.Name, settings.Network)
+	return lm_sdk_tools.ConfigureLxcBridge(state, settings)
+}
+
+// CheckContainer checks the host, the network of every target is linked to the bridge
+func (c *BridgeFixable) CheckContainer(container string) error {
+	return c.Check()
+}
+
+func (c *BridgeFixable) FixContainer(container string) error {
+	return c.Fix()
+}
+
+func (*BridgeFixable) NeedsRoot() bool {
+	return true
+}
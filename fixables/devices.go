@@ -21,22 +21,24 @@ package fixables
 import (
 	"fmt"
 	"os"
-
-	"bufio"
-	"bytes"
-	"io/ioutil"
 	"strings"
 
-	"gopkg.in/lxc/go-lxc.v2"
 	"link-motion.com/lm-toolchain-sdk-tools"
 )
 
 type DevicesFixable struct{}
 
-func (c *DevicesFixable) run(container *lxc.Container, doFix bool) error {
+func (*DevicesFixable) Name() string {
+	return "devices"
+}
+
+func (*DevicesFixable) Description() string {
+	return "Removes mount entries of devices that do not exist on the host"
+}
+
+func (c *DevicesFixable) run(container lm_sdk_tools.ContainerBackend, doFix bool) error {
 
 	//first check the mounts
-	var cleanDevices []string
 	var brokenDevices []string
 	errorFound := false
 
@@ -51,8 +53,6 @@ func (c *DevicesFixable) run(container *lxc.Container, doFix bool) error {
 		if _, err := os.Stat(mount[0]); os.IsNotExist(err) && mount[2] != "tmpfs" {
 			errorFound = true
 			brokenDevices = append(brokenDevices, mount[0])
-		} else {
-			cleanDevices = append(cleanDevices, mountpt)
 		}
 	}
 
@@ -60,35 +60,24 @@ func (c *DevicesFixable) run(container *lxc.Container, doFix bool) error {
 		if doFix {
 			fmt.Printf("Devices %s does not exist on the host.\n", brokenDevices)
 
-			//read config file
-			conf, err := ioutil.ReadFile(container.ConfigFileName())
+			edit, err := lm_sdk_tools.LoadConfigEdit(container.ConfigFileName())
 			if err != nil {
-				return fmt.Errorf("Unable to read container config: %s", err)
+				return err
 			}
 
-			fi, err := os.Create(container.ConfigFileName())
-			if err != nil {
-				return fmt.Errorf("Unable to write container config: %s", err)
+			broken := map[string]bool{}
+			for _, device := range brokenDevices {
+				broken[device] = true
 			}
+			edit.RemoveItems("lxc.mount.entry", func(value string) bool {
+				mount := strings.Fields(value)
+				return len(mount) == 6 && mount[2] != "tmpfs" && broken[mount[0]]
+			})
 
-			writer := bufio.NewWriter(fi)
-
-			reader := bufio.NewScanner(bytes.NewReader(conf))
-			for reader.Scan() {
-				line := reader.Text()
-				for _, mountpt := range brokenDevices {
-					if !strings.Contains(line, mountpt) {
-						writer.WriteString(fmt.Sprintf("%s\n", line))
-					}
-				}
+			if _, err = edit.Apply(container); err != nil {
+				return fmt.Errorf("Unable to update container config: %v", err)
 			}
 
-			writer.Flush()
-			fi.Close()
-
-			container.ClearConfig()
-			container.LoadConfigFile(container.ConfigFileName())
-
 		} else {
 			return fmt.Errorf("Devices %s does not exist on the host.", brokenDevices)
 		}
@@ -97,7 +86,7 @@ func (c *DevicesFixable) run(container *lxc.Container, doFix bool) error {
 }
 
 func (c *DevicesFixable) CheckContainer(container string) error {
-	cont, err := lxc.NewContainer(container, lm_sdk_tools.LMTargetPath())
+	cont, err := lm_sdk_tools.NewContainer(container)
 	if err != nil {
 		return err
 	}
@@ -110,7 +99,7 @@ func (c *DevicesFixable) CheckContainer(container string) error {
 }
 
 func (c *DevicesFixable) FixContainer(container string) error {
-	cont, err := lxc.NewContainer(container, lm_sdk_tools.LMTargetPath())
+	cont, err := lm_sdk_tools.NewContainer(container)
 	if err != nil {
 		return err
 	}
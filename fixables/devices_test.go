@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDevicesFixable(t *testing.T) {
+	device := os.TempDir()
+	tests := []struct {
+		entries []string
+		broken  bool
+		kept    []string
+	}{
+		{nil, false, []string{""}},
+		{[]string{device + " dev/existing none bind,create=dir 0 0"}, false, []string{device + " dev/existing none bind,create=dir 0 0"}},
+		{
+			[]string{
+				"/dev/lmsdk-missing dev/missing none bind,create=file 0 0",
+				device + " dev/existing none bind,create=dir 0 0",
+			},
+			true,
+			[]string{device + " dev/existing none bind,create=dir 0 0"},
+		},
+		//tmpfs mounts have no device and invalid entries are left alone
+		{[]string{"none tmp tmpfs defaults 0 0", "/dev/lmsdk-missing invalid"}, false, []string{"none tmp tmpfs defaults 0 0", "/dev/lmsdk-missing invalid"}},
+	}
+
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	fixable := &DevicesFixable{}
+	for _, test := range tests {
+		target := createTarget(t, "target")
+		for _, entry := range test.entries {
+			target.Container.SetConfigItem("lxc.mount.entry", entry)
+		}
+		target.Container.SaveConfigFile(target.Container.ConfigFileName())
+
+		if err := fixable.Check(); (err != nil) != test.broken {
+			t.Errorf("%v: Check() returned %v", test.entries, err)
+		}
+		if err := fixable.CheckContainer("target"); (err != nil) != test.broken {
+			t.Errorf("%v: CheckContainer() returned %v", test.entries, err)
+		}
+		if err := fixable.Fix(); err != nil {
+			t.Errorf("%v: Fix() failed: %v", test.entries, err)
+		}
+		if err := fixable.Check(); err != nil {
+			t.Errorf("%v: Check() after Fix() returned %v", test.entries, err)
+		}
+
+		if entries := target.Container.ConfigItem("lxc.mount.entry"); !reflect.DeepEqual(entries, test.kept) {
+			t.Errorf("%v: the mount entries are %q after Fix(), expected %q", test.entries, entries, test.kept)
+		}
+		removeTarget(t, "target")
+	}
+}
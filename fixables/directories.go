@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// DirectoriesFixable creates the directories the targets are stored in
+type DirectoriesFixable struct{}
+
+func (*DirectoriesFixable) Name() string {
+	return "directories"
+}
+
+func (*DirectoriesFixable) Description() string {
+	return "Creates the storage directories of the targets and fixes their owner and mode"
+}
+
+func (*DirectoriesFixable) Check() error {
+	return lm_sdk_tools.EnsureRequiredDirectoriesExist(false)
+}
+
+func (*DirectoriesFixable) Fix() error {
+	//the created directories are recorded, so lmsdk-target teardown can remove them
+	state, err := lm_sdk_tools.LoadHostSetupState()
+	if err != nil {
+		return err
+	}
+	if err = state.RecordDirectories(); err != nil {
+		return err
+	}
+	if err = state.Save(); err != nil {
+		return err
+	}
+	return lm_sdk_tools.EnsureRequiredDirectoriesExist(true)
+}
+
+// CheckContainer checks the host, every target needs the directories
+func (c *DirectoriesFixable) CheckContainer(container string) error {
+	return c.Check()
+}
+
+func (c *DirectoriesFixable) FixContainer(container string) error {
+	return c.Fix()
+}
+
+func (*DirectoriesFixable) NeedsRoot() bool {
+	return true
+}
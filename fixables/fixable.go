@@ -18,10 +18,67 @@
  */
 package fixables
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Fixable interface {
+	// Name is used to select the fixable, e.g. with autofix --only
+	Name() string
+	Description() string
 	Check() error
 	Fix() error
 	CheckContainer(container string) error
 	FixContainer(container string) error
 	NeedsRoot() bool
 }
+
+// All returns every known fixable, in the order they are run
+func All() []Fixable {
+	return []Fixable{
+		//the host setup autosetup does, the targets need it to start
+		&DirectoriesFixable{},
+		&SubIdsFixable{},
+		//the usernet entry is for the configured bridge
+		&BridgeFixable{},
+		&UsernetFixable{},
+		//the others only see targets with a valid config-lm
+		&LMConfigFixable{},
+		//the others read the config with the keys of the installed lxc
+		&LXCConfigFixable{},
+		&DevicesFixable{},
+		NewToolsFixable(),
+		//the id mapping uses the ranges of the subids fixable and the owners are moved to it
+		&IdMapFixable{},
+		&OwnershipFixable{},
+		/*
+		   &ContainerAccess{},
+		   &DRIFixable{},
+		   &NvidiaFixable{},
+		*/
+	}
+}
+
+// Lookup returns the fixables with the given names, in the order of All()
+func Lookup(names []string) ([]Fixable, error) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			wanted[name] = true
+		}
+	}
+
+	selected := []Fixable{}
+	for _, fixable := range All() {
+		if wanted[fixable.Name()] {
+			selected = append(selected, fixable)
+			delete(wanted, fixable.Name())
+		}
+	}
+
+	for name := range wanted {
+		return nil, fmt.Errorf("Unknown fixable %s, see lmsdk-target autofix --list", name)
+	}
+	return selected, nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// setenv sets a environment variable, the returned function restores the old value
+func setenv(key string, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// useFakeBackend runs the test with a FakeBackend in a temporary storage root,
+// the returned function restores the old backend and removes the storage root
+func useFakeBackend(t *testing.T) (*lm_sdk_tools.FakeBackend, func()) {
+	root, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := []func(){setenv(lm_sdk_tools.LmStorageEnvVar, root)}
+	//as root the container user is the one calling sudo
+	if _, ok := os.LookupEnv("SUDO_UID"); os.Getuid() == 0 && !ok {
+		restore = append(restore, setenv("SUDO_UID", "0"))
+	}
+
+	fake := lm_sdk_tools.NewFakeBackend()
+	oldBackend := lm_sdk_tools.SetBackend(fake)
+
+	return fake, func() {
+		lm_sdk_tools.SetBackend(oldBackend)
+		for _, fn := range restore {
+			fn()
+		}
+		os.RemoveAll(root)
+	}
+}
+
+// createTarget creates a container with a current config-lm file
+func createTarget(t *testing.T, name string) *lm_sdk_tools.LMTargetContainer {
+	c, err := lm_sdk_tools.NewContainer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Create(lxc.TemplateOptions{Arch: "amd64"}); err != nil {
+		t.Fatalf("Create(%s) failed: %v", name, err)
+	}
+
+	target := &lm_sdk_tools.LMTargetContainer{
+		Name:             name,
+		Architecture:     "armv7hl",
+		HostArchitecture: "amd64",
+		Distribution:     "link-motion-autoos",
+		Version:          "1.0",
+		User:             lm_sdk_tools.DefaultContainerUser,
+		Tools:            []string{"gcc", "make"},
+		Container:        c,
+	}
+	if err = lm_sdk_tools.WriteLMContainerConfig(target); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// removeTarget removes a target created by createTarget
+func removeTarget(t *testing.T, name string) {
+	c, err := lm_sdk_tools.NewContainer(name)
+	if err == nil {
+		err = c.Destroy()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		names    string
+		selected string
+		fails    bool
+	}{
+		{"", "", false},
+		{"lmconfig", "lmconfig", false},
+		//the order of All() is kept
+		{"ownership,tools,lxcconfig", "lxcconfig,tools,ownership", false},
+		{" idmap , devices ,", "devices,idmap", false},
+		//the host setup runs before the targets are fixed
+		{"ownership,usernet,subids", "subids,usernet,ownership", false},
+		{"tools,unknown", "", true},
+	}
+
+	for _, test := range tests {
+		fixables, err := Lookup(strings.Split(test.names, ","))
+		if (err != nil) != test.fails {
+			t.Errorf("Lookup(%q) returned error %v", test.names, err)
+			continue
+		}
+
+		names := []string{}
+		for _, fixable := range fixables {
+			names = append(names, fixable.Name())
+		}
+		if strings.Join(names, ",") != test.selected {
+			t.Errorf("Lookup(%q) = %v, expected %s", test.names, names, test.selected)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// IdMapFixable rewrites id mappings that do not match the sub id ranges of the user anymore
+type IdMapFixable struct{}
+
+func (*IdMapFixable) Name() string {
+	return "idmap"
+}
+
+func (*IdMapFixable) Description() string {
+	return "Updates the id mappings of the targets to the subuid and subgid ranges of the user"
+}
+
+func (c *IdMapFixable) run(target *lm_sdk_tools.LMTargetContainer, doFix bool) error {
+	idMapKey := lm_sdk_tools.IdMapConfigKey()
+	idMap, err := lm_sdk_tools.DefaultIdMap(target.User, idMapKey)
+	if err != nil {
+		return fmt.Errorf("%s: %v", target.Name, err)
+	}
+
+	wanted := []string{}
+	for _, item := range idMap {
+		wanted = append(wanted, item.Value)
+	}
+
+	edit, err := lm_sdk_tools.LoadConfigEdit(target.Container.ConfigFileName())
+	if err != nil {
+		return err
+	}
+
+	//configs of older lxc versions use the other key
+	current := append(edit.Items("lxc.idmap"), edit.Items("lxc.id_map")...)
+	if reflect.DeepEqual(current, wanted) && len(edit.Items(idMapKey)) == len(current) {
+		return nil
+	}
+
+	if !doFix {
+		return fmt.Errorf("The id mappings of %s do not match the sub id ranges of the user", target.Name)
+	}
+
+	fmt.Printf("... Updating the id mappings of %s\n", target.Name)
+	edit.Clear("lxc.id_map")
+	edit.Clear("lxc.idmap")
+	edit.Set(idMapKey, wanted...)
+	fmt.Print(edit.Diff())
+
+	if _, err = edit.Apply(target.Container); err != nil {
+		return err
+	}
+	if target.Container.State() != lxc.STOPPED {
+		fmt.Printf("... %s is running, the new mappings are used after the next restart\n", target.Name)
+	}
+	return nil
+}
+
+func (c *IdMapFixable) CheckContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
+	if err != nil {
+		return err
+	}
+
+	return c.run(target, false)
+}
+
+func (c *IdMapFixable) FixContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
+	if err != nil {
+		return err
+	}
+
+	return c.run(target, true)
+}
+
+// runAll runs on all targets, errors of the single targets are combined
+func (c *IdMapFixable) runAll(doFix bool) error {
+	targets, err := lm_sdk_tools.FindLMTargets()
+	if err != nil {
+		return err
+	}
+
+	errors := []string{}
+	for i := range targets {
+		if err = c.run(&targets[i], doFix); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+func (c *IdMapFixable) Check() error {
+	fmt.Printf("Checking the id mappings...\n")
+	return c.runAll(false)
+}
+
+func (c *IdMapFixable) Fix() error {
+	fmt.Printf("Fixing the id mappings...\n")
+	return c.runAll(true)
+}
+
+func (*IdMapFixable) NeedsRoot() bool {
+	return false
+}
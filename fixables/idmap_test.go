@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"reflect"
+	"testing"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// defaultIdMap returns the mappings the idmap fixable writes, the test is skipped
+// if the user has no sub id ranges
+func defaultIdMap(t *testing.T) []string {
+	idMap, err := lm_sdk_tools.DefaultIdMap(lm_sdk_tools.DefaultContainerUser, "lxc.idmap")
+	if err != nil {
+		t.Skipf("The user can not map the container user: %v", err)
+	}
+
+	values := []string{}
+	for _, item := range idMap {
+		values = append(values, item.Value)
+	}
+	return values
+}
+
+func TestIdMapFixable(t *testing.T) {
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	wanted := defaultIdMap(t)
+	tests := []struct {
+		key    string
+		values []string
+		broken bool
+	}{
+		{"lxc.idmap", wanted, false},
+		{"lxc.idmap", nil, true},
+		{"lxc.idmap", []string{"u 0 100000 65536", "g 0 100000 65536"}, true},
+		{"lxc.idmap", wanted[1:], true},
+		//the installed lxc uses the new key
+		{"lxc.id_map", wanted, true},
+	}
+
+	fixable := &IdMapFixable{}
+	for _, test := range tests {
+		target := createTarget(t, "target")
+		for _, value := range test.values {
+			target.Container.SetConfigItem(test.key, value)
+		}
+		target.Container.SaveConfigFile(target.Container.ConfigFileName())
+
+		if err := fixable.Check(); (err != nil) != test.broken {
+			t.Errorf("%s %v: Check() returned %v", test.key, test.values, err)
+		}
+		if err := fixable.FixContainer("target"); err != nil {
+			t.Errorf("%s %v: FixContainer() failed: %v", test.key, test.values, err)
+		}
+		if err := fixable.Check(); err != nil {
+			t.Errorf("%s %v: Check() after FixContainer() returned %v", test.key, test.values, err)
+		}
+
+		if values := target.Container.ConfigItem("lxc.idmap"); !reflect.DeepEqual(values, wanted) {
+			t.Errorf("%s %v: the id mappings are %v, expected %v", test.key, test.values, values, wanted)
+		}
+		if values := target.Container.ConfigItem("lxc.id_map"); values[0] != "" {
+			t.Errorf("%s %v: the legacy id mappings %v were kept", test.key, test.values, values)
+		}
+		removeTarget(t, "target")
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// LMConfigFixable restores config-lm files that are missing or can not be parsed and
+// upgrades the ones written with an older schema
+type LMConfigFixable struct{}
+
+func (*LMConfigFixable) Name() string {
+	return "lmconfig"
+}
+
+func (*LMConfigFixable) Description() string {
+	return "Recreates missing or broken config-lm files of the targets and upgrades outdated ones"
+}
+
+func (c *LMConfigFixable) run(container lm_sdk_tools.ContainerBackend, doFix bool) error {
+	loaded, err := lm_sdk_tools.LoadLMContainer(container.Name())
+	if err == nil {
+		return c.upgrade(loaded, doFix)
+	} else if !lm_sdk_tools.IsLMConfigError(err) {
+		return err
+	}
+
+	if !doFix {
+		return fmt.Errorf("%s: %v", container.Name(), err)
+	}
+	if err.(*lm_sdk_tools.LMConfigError).Newer {
+		return fmt.Errorf("%s: %v, update the SDK tools", container.Name(), err)
+	}
+
+	fmt.Printf("... Recreating the config-lm file of %s: %v\n", container.Name(), err)
+	fileName := container.ConfigFileName() + "-lm"
+	if _, statErr := os.Stat(fileName); statErr == nil {
+		backup, err := lm_sdk_tools.BackupFile(fileName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("... The broken file was saved as %s\n", backup)
+	}
+
+	target, err := lm_sdk_tools.RecoverLMContainer(container)
+	if err != nil {
+		return fmt.Errorf("Unable to recover the settings of %s: %v", container.Name(), err)
+	}
+	if err = lm_sdk_tools.WriteLMContainerConfig(target); err != nil {
+		return err
+	}
+	if len(target.Distribution) == 0 || len(target.Version) == 0 || len(target.Architecture) == 0 {
+		fmt.Printf("... The image of %s is not fully known, distribution: '%s', version: '%s', build architecture: '%s'\n",
+			container.Name(), target.Distribution, target.Version, target.Architecture)
+	}
+	return nil
+}
+
+// upgrade stores the settings migrated on load if the file uses an older schema
+func (c *LMConfigFixable) upgrade(target *lm_sdk_tools.LMTargetContainer, doFix bool) error {
+	if !target.ConfigOutdated() {
+		return nil
+	}
+	if !doFix {
+		return fmt.Errorf("%s: The config-lm file uses an outdated schema", target.Name)
+	}
+
+	fmt.Printf("... Upgrading the config-lm file of %s\n", target.Name)
+	return lm_sdk_tools.WriteLMContainerConfig(target)
+}
+
+func (c *LMConfigFixable) CheckContainer(container string) error {
+	cont, err := lm_sdk_tools.NewContainer(container)
+	if err != nil {
+		return err
+	}
+
+	if !cont.Defined() {
+		return fmt.Errorf("Container %s not found.", container)
+	}
+
+	return c.run(cont, false)
+}
+
+func (c *LMConfigFixable) FixContainer(container string) error {
+	cont, err := lm_sdk_tools.NewContainer(container)
+	if err != nil {
+		return err
+	}
+
+	if !cont.Defined() {
+		return fmt.Errorf("Container %s not found.", container)
+	}
+
+	return c.run(cont, true)
+}
+
+// runAll checks every container, FindLMTargets skips exactly the ones this fixable is about
+func (c *LMConfigFixable) runAll(doFix bool) error {
+	errors := []string{}
+	for _, container := range lm_sdk_tools.Containers() {
+		if err := c.run(container, doFix); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+func (c *LMConfigFixable) Check() error {
+	fmt.Printf("Checking for broken or outdated config-lm files...\n")
+	return c.runAll(false)
+}
+
+func (c *LMConfigFixable) Fix() error {
+	fmt.Printf("Fixing broken or outdated config-lm files...\n")
+	return c.runAll(true)
+}
+
+func (*LMConfigFixable) NeedsRoot() bool {
+	return false
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+func TestLMConfigFixable(t *testing.T) {
+	tests := []struct {
+		name string
+		//replaces the config-lm file, nil removes it
+		config []byte
+		keep   bool
+		//files written into the container directory and the rootfs
+		imageInfo string
+		osRelease string
+		broken    bool
+		recovers  bool
+		//the image the fixed target was created from, distribution version build architecture
+		image string
+	}{
+		{"current", nil, true, "", "", false, false, "link-motion-autoos 1.0 armv7hl"},
+		{"missing", nil, false, "distribution=link-motion-ivios\nversion=2.0\nvariant=i686\n", "", true, true, "link-motion-ivios 2.0 i686"},
+		//targets created before the image was recorded use the os-release of the rootfs
+		{"broken", []byte("{\"name\": "), false, "", "ID=\"link-motion-autoos\"\nVERSION_ID=\"1.1\"\n", true, true, "link-motion-autoos 1.1 "},
+		//the settings of the old file are kept
+		{"outdated", []byte(`{"name": "target", "architecture": "armv7hl", "version": "1.0"}`), false, "", "", true, false, " 1.0 armv7hl"},
+	}
+
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	fixable := &LMConfigFixable{}
+	for _, test := range tests {
+		target := createTarget(t, "target")
+		dir := filepath.Dir(target.Container.ConfigFileName())
+		fileName := target.Container.ConfigFileName() + "-lm"
+		if !test.keep {
+			os.Remove(fileName)
+		}
+		if test.config != nil {
+			ioutil.WriteFile(fileName, test.config, 0664)
+		}
+		ioutil.WriteFile(filepath.Join(dir, lm_sdk_tools.ImageInfoFile), []byte(test.imageInfo), 0644)
+		os.MkdirAll(filepath.Join(dir, "rootfs", "etc"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "rootfs", "etc", "os-release"), []byte(test.osRelease), 0644)
+		before, _ := ioutil.ReadFile(fileName)
+
+		if err := fixable.Check(); (err != nil) != test.broken {
+			t.Errorf("%s: Check() returned %v", test.name, err)
+		}
+		//neither the check nor loading the target writes the file
+		if after, _ := ioutil.ReadFile(fileName); string(after) != string(before) {
+			t.Errorf("%s: Check() changed the config-lm file", test.name)
+		}
+
+		if err := fixable.Fix(); err != nil {
+			t.Errorf("%s: Fix() failed: %v", test.name, err)
+		}
+		if err := fixable.Check(); err != nil {
+			t.Errorf("%s: Check() after Fix() returned %v", test.name, err)
+		}
+
+		fixed, err := lm_sdk_tools.LoadLMContainer("target")
+		if err != nil {
+			t.Fatalf("%s: Loading the fixed target failed: %v", test.name, err)
+		}
+		if fixed.ConfigOutdated() || fixed.ConfigVersion != lm_sdk_tools.LMConfigVersion {
+			t.Errorf("%s: the fixed config-lm file has version %d", test.name, fixed.ConfigVersion)
+		}
+		if image := fixed.Distribution + " " + fixed.Version + " " + fixed.Architecture; image != test.image {
+			t.Errorf("%s: the image of the fixed target is '%s', expected '%s'", test.name, image, test.image)
+		}
+		//lxc.arch is the host architecture
+		if test.recovers && (fixed.HostArchitecture != "amd64" || fixed.User != lm_sdk_tools.DefaultContainerUser) {
+			t.Errorf("%s: recovered %+v", test.name, fixed)
+		}
+
+		backups, _ := filepath.Glob(fileName + ".*")
+		if hasBackup := len(backups) > 0; hasBackup != (test.config != nil && test.recovers) {
+			t.Errorf("%s: backups of the config-lm file: %v", test.name, backups)
+		}
+
+		os.RemoveAll(filepath.Join(dir, "rootfs", "etc"))
+		removeTarget(t, "target")
+	}
+}
+
+func TestLMConfigFixableNewerVersion(t *testing.T) {
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	createTarget(t, "valid")
+	target := createTarget(t, "newer")
+	fileName := target.Container.ConfigFileName() + "-lm"
+	config := []byte(`{"configVersion": 1000, "name": "newer"}`)
+	ioutil.WriteFile(fileName, config, 0664)
+
+	//the other targets are still found
+	targets, err := lm_sdk_tools.FindLMTargets()
+	if err != nil || len(targets) != 1 || targets[0].Name != "valid" {
+		t.Errorf("FindLMTargets() = %v, %v, expected only the valid target", targets, err)
+	}
+
+	fixable := &LMConfigFixable{}
+	if err := fixable.Check(); err == nil {
+		t.Errorf("Check() accepted the config-lm file of a newer version")
+	}
+	if err := fixable.Fix(); err == nil {
+		t.Errorf("Fix() replaced the config-lm file of a newer version")
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != string(config) {
+		t.Errorf("Fix() changed the config-lm file of a newer version to %s", data)
+	}
+
+	removeTarget(t, "valid")
+	removeTarget(t, "newer")
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// LXCConfigFixable upgrades target configs written for lxc 2.0 after lxc was updated
+type LXCConfigFixable struct{}
+
+func (*LXCConfigFixable) Name() string {
+	return "lxcconfig"
+}
+
+func (*LXCConfigFixable) Description() string {
+	return "Upgrades legacy keys in the target configs to the format of the installed lxc"
+}
+
+// legacyConfigFiles returns the configs of the target and its snapshots that contain legacy keys
+func legacyConfigFiles(target *lm_sdk_tools.LMTargetContainer) ([]string, error) {
+	configFile := target.Container.ConfigFileName()
+	snapshots, _ := filepath.Glob(filepath.Join(filepath.Dir(configFile), "snaps", "*", "config"))
+
+	legacy := []string{}
+	for _, fileName := range append([]string{configFile}, snapshots...) {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if _, changed := lm_sdk_tools.UpgradeConfigLines(lm_sdk_tools.SplitLines(string(data))); changed {
+			legacy = append(legacy, fileName)
+		}
+	}
+	return legacy, nil
+}
+
+func (c *LXCConfigFixable) run(target *lm_sdk_tools.LMTargetContainer, doFix bool) error {
+	//old lxc versions only understand the legacy keys
+	if !lm_sdk_tools.LXCNewVersion() {
+		return nil
+	}
+
+	if !doFix {
+		legacy, err := legacyConfigFiles(target)
+		if err != nil {
+			return err
+		}
+		if len(legacy) > 0 {
+			return fmt.Errorf("Legacy lxc config keys in %s", strings.Join(legacy, ", "))
+		}
+		return nil
+	}
+
+	changed, err := lm_sdk_tools.UpgradeContainerConfig(target.Container)
+	for _, fileName := range changed {
+		fmt.Printf("... Upgraded %s\n", fileName)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to upgrade the config of %s: %v", target.Name, err)
+	}
+	return nil
+}
+
+func (c *LXCConfigFixable) CheckContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
+	if err != nil {
+		return err
+	}
+
+	return c.run(target, false)
+}
+
+func (c *LXCConfigFixable) FixContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
+	if err != nil {
+		return err
+	}
+
+	return c.run(target, true)
+}
+
+// runAll runs on all targets, errors of the single targets are combined
+func (c *LXCConfigFixable) runAll(doFix bool) error {
+	targets, err := lm_sdk_tools.FindLMTargets()
+	if err != nil {
+		return err
+	}
+
+	errors := []string{}
+	for i := range targets {
+		if err = c.run(&targets[i], doFix); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+func (c *LXCConfigFixable) Check() error {
+	fmt.Printf("Checking for legacy lxc config keys...\n")
+	return c.runAll(false)
+}
+
+func (c *LXCConfigFixable) Fix() error {
+	fmt.Printf("Upgrading legacy lxc config keys...\n")
+	return c.runAll(true)
+}
+
+func (*LXCConfigFixable) NeedsRoot() bool {
+	return false
+}
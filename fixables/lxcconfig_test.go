@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLXCConfigFixable(t *testing.T) {
+	tests := []struct {
+		lxcVersion string
+		config     string
+		snapshot   string
+		legacy     bool
+	}{
+		{"2.1.1", "", "", false},
+		{"2.1.1", "lxc.seccomp = /usr/share/lxc/config/common.seccomp\n", "", true},
+		{"2.1.1", "", "lxc.id_map = u 0 100000 65536\n", true},
+		//old lxc versions only understand the legacy keys
+		{"2.0.8", "lxc.id_map = u 0 100000 65536\n", "", false},
+	}
+
+	fake, restore := useFakeBackend(t)
+	defer restore()
+
+	fixable := &LXCConfigFixable{}
+	for _, test := range tests {
+		fake.LxcVersion = test.lxcVersion
+		target := createTarget(t, "target")
+
+		configFile := target.Container.ConfigFileName()
+		snapshotConfig := filepath.Join(filepath.Dir(configFile), "snaps", "snap0", "config")
+		os.MkdirAll(filepath.Dir(snapshotConfig), 0755)
+		for fileName, lines := range map[string]string{configFile: test.config, snapshotConfig: test.snapshot} {
+			data, _ := ioutil.ReadFile(fileName)
+			ioutil.WriteFile(fileName, append(data, lines...), 0644)
+		}
+
+		if err := fixable.Check(); (err != nil) != test.legacy {
+			t.Errorf("lxc %s %q %q: Check() returned %v", test.lxcVersion, test.config, test.snapshot, err)
+		}
+		if err := fixable.Fix(); err != nil {
+			t.Errorf("lxc %s %q %q: Fix() failed: %v", test.lxcVersion, test.config, test.snapshot, err)
+		}
+		if err := fixable.Check(); err != nil {
+			t.Errorf("lxc %s %q %q: Check() after Fix() returned %v", test.lxcVersion, test.config, test.snapshot, err)
+		}
+
+		data, _ := ioutil.ReadFile(configFile)
+		if test.legacy && len(test.config) > 0 {
+			if !strings.Contains(string(data), "lxc.seccomp.profile = ") {
+				t.Errorf("lxc %s: the config was not upgraded:\n%s", test.lxcVersion, data)
+			}
+			//the container uses the upgraded config
+			if target.Container.ConfigItem("lxc.seccomp.profile")[0] == "" {
+				t.Errorf("lxc %s: the upgraded config was not loaded", test.lxcVersion)
+			}
+		}
+		if !test.legacy && !strings.HasSuffix(string(data), test.config) {
+			t.Errorf("lxc %s: the config was changed:\n%s", test.lxcVersion, data)
+		}
+
+		snapshotData, _ := ioutil.ReadFile(snapshotConfig)
+		if test.legacy && len(test.snapshot) > 0 && string(snapshotData) != "lxc.idmap = u 0 100000 65536\n" {
+			t.Errorf("lxc %s: the snapshot config was not upgraded:\n%s", test.lxcVersion, snapshotData)
+		}
+
+		os.RemoveAll(filepath.Dir(filepath.Dir(snapshotConfig)))
+		removeTarget(t, "target")
+	}
+}
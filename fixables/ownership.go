@@ -0,0 +1,292 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+/*
+OwnershipFixable finds files of a target that are owned by ids the target
+does not map, which happens when the sub id ranges of the user change or
+files are created with sudo. The files next to the rootfs belong to the
+user. In the rootfs, and in the rootfs and overlay delta directories of the
+snapshots, the ids of the old mapping are moved to the current one. The old
+mapping is taken from the owner of the respective root directory.
+*/
+type OwnershipFixable struct{}
+
+func (*OwnershipFixable) Name() string {
+	return "ownership"
+}
+
+func (*OwnershipFixable) Description() string {
+	return "Moves files of the targets owned by unmapped ids to the current id mapping"
+}
+
+// rootfsOwner is a directory whose files belong to the ids of the container
+type rootfsOwner struct {
+	dir string
+	//host ids of the container root of the old mapping, if the directory itself is stale
+	oldRootUid, oldRootGid int64
+}
+
+// ownershipMapper decides the owner of the files of one target
+type ownershipMapper struct {
+	idMap    []lm_sdk_tools.IdMapEntry
+	uid, gid uint32
+	rootfs   []rootfsOwner
+}
+
+func (m *ownershipMapper) mapped(kind string, hostId uint32) bool {
+	if (kind == "u" && hostId == m.uid) || (kind == "g" && hostId == m.gid) {
+		return true
+	}
+	_, ok := lm_sdk_tools.IdMapToContainer(m.idMap, kind, hostId)
+	return ok
+}
+
+// rootfsOf returns the rootfs the path belongs to, or nil
+func (m *ownershipMapper) rootfsOf(path string) *rootfsOwner {
+	for i := range m.rootfs {
+		if path == m.rootfs[i].dir || strings.HasPrefix(path, m.rootfs[i].dir+"/") {
+			return &m.rootfs[i]
+		}
+	}
+	return nil
+}
+
+// addRootfs registers a directory with container files, the old mapping is read from its owner
+func (m *ownershipMapper) addRootfs(dir string) {
+	owner := rootfsOwner{dir: filepath.Clean(dir), oldRootUid: -1, oldRootGid: -1}
+	if info, err := os.Lstat(owner.dir); err == nil {
+		stat := info.Sys().(*syscall.Stat_t)
+		if !m.mapped("u", stat.Uid) {
+			owner.oldRootUid = int64(stat.Uid)
+		}
+		if !m.mapped("g", stat.Gid) {
+			owner.oldRootGid = int64(stat.Gid)
+		}
+	}
+	m.rootfs = append(m.rootfs, owner)
+}
+
+// newOwner returns the id a unmapped host id is moved to
+func (m *ownershipMapper) newOwner(path string, kind string, hostId uint32) (uint32, bool) {
+	rootfs := m.rootfsOf(path)
+	if rootfs == nil {
+		if kind == "u" {
+			return m.uid, true
+		}
+		return m.gid, true
+	}
+
+	oldRoot := rootfs.oldRootUid
+	if kind == "g" {
+		oldRoot = rootfs.oldRootGid
+	}
+	if oldRoot < 0 || int64(hostId) < oldRoot {
+		return 0, false
+	}
+	return lm_sdk_tools.IdMapToHost(m.idMap, kind, uint32(int64(hostId)-oldRoot))
+}
+
+func newOwnershipMapper(target *lm_sdk_tools.LMTargetContainer) (*ownershipMapper, error) {
+	currUser, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(currUser.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(currUser.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	container := target.Container
+	values := []string{}
+	for _, value := range append(container.ConfigItem("lxc.idmap"), container.ConfigItem("lxc.id_map")...) {
+		//unset keys return a empty value
+		if len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	idMap, err := lm_sdk_tools.ParseIdMap(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", target.Name, err)
+	}
+
+	//the lower directory of a overlay belongs to the source container
+	rootfs := lm_sdk_tools.RootfsDirs(container.ConfigItem(lm_sdk_tools.ConfigKey("lxc.rootfs.path"))[0])[0]
+
+	m := &ownershipMapper{
+		idMap: idMap,
+		uid:   uint32(uid),
+		gid:   uint32(gid),
+	}
+	m.addRootfs(rootfs)
+
+	//snapshots keep a copy of the rootfs, or only the changes if they are overlays
+	snapshotDir := filepath.Join(filepath.Dir(container.ConfigFileName()), "snaps")
+	for _, pattern := range []string{"rootfs", "delta*"} {
+		dirs, _ := filepath.Glob(filepath.Join(snapshotDir, "*", pattern))
+		for _, dir := range dirs {
+			m.addRootfs(dir)
+		}
+	}
+	return m, nil
+}
+
+func (c *OwnershipFixable) run(target *lm_sdk_tools.LMTargetContainer, doFix bool) error {
+	mapper, err := newOwnershipMapper(target)
+	if err != nil {
+		return err
+	}
+	if len(mapper.idMap) == 0 {
+		return fmt.Errorf("%s has no id mappings, run lmsdk-target autofix --only idmap", target.Name)
+	}
+
+	if doFix {
+		fmt.Printf("... Checking the file owners of %s\n", target.Name)
+	}
+
+	stale := 0
+	unfixable := []string{}
+	unreadable := false
+	containerDir := filepath.Dir(target.Container.ConfigFileName())
+	filepath.Walk(containerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			unreadable = true
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || (mapper.mapped("u", stat.Uid) && mapper.mapped("g", stat.Gid)) {
+			return nil
+		}
+		stale++
+		if !doFix {
+			return nil
+		}
+
+		uid, gid := stat.Uid, stat.Gid
+		if !mapper.mapped("u", uid) {
+			uid, ok = mapper.newOwner(path, "u", uid)
+		}
+		if ok && !mapper.mapped("g", gid) {
+			gid, ok = mapper.newOwner(path, "g", gid)
+		}
+		if !ok {
+			unfixable = append(unfixable, path)
+			return nil
+		}
+
+		if err = os.Lchown(path, int(uid), int(gid)); err != nil {
+			unfixable = append(unfixable, fmt.Sprintf("%s (%v)", path, err))
+		} else if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && info.Mode()&os.ModeSymlink == 0 {
+			//chown clears the setuid bits
+			os.Chmod(path, info.Mode())
+		}
+		return nil
+	})
+
+	if unreadable {
+		fmt.Printf("... Some files of %s can not be read, run with sudo to check them\n", target.Name)
+	}
+
+	if !doFix {
+		if stale > 0 {
+			return fmt.Errorf("%d files of %s are owned by ids the target does not map", stale, target.Name)
+		}
+		return nil
+	}
+
+	if len(unfixable) > 0 {
+		if len(unfixable) > 10 {
+			unfixable = append(unfixable[:10], fmt.Sprintf("and %d more", len(unfixable)-10))
+		}
+		return fmt.Errorf("Unable to move the owner of %d files of %s: %s", len(unfixable), target.Name, strings.Join(unfixable, ", "))
+	}
+	if stale > 0 {
+		fmt.Printf("... Moved the owner of %d files\n", stale)
+	}
+	return nil
+}
+
+func (c *OwnershipFixable) CheckContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
+	if err != nil {
+		return err
+	}
+
+	return c.run(target, false)
+}
+
+func (c *OwnershipFixable) FixContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
+	if err != nil {
+		return err
+	}
+
+	return c.run(target, true)
+}
+
+// runAll runs on all targets, errors of the single targets are combined
+func (c *OwnershipFixable) runAll(doFix bool) error {
+	targets, err := lm_sdk_tools.FindLMTargets()
+	if err != nil {
+		return err
+	}
+
+	errors := []string{}
+	for i := range targets {
+		if err = c.run(&targets[i], doFix); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+func (c *OwnershipFixable) Check() error {
+	fmt.Printf("Checking the file owners of the targets...\n")
+	return c.runAll(false)
+}
+
+func (c *OwnershipFixable) Fix() error {
+	fmt.Printf("Fixing the file owners of the targets...\n")
+	return c.runAll(true)
+}
+
+func (*OwnershipFixable) NeedsRoot() bool {
+	return true
+}
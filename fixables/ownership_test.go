@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// ownedFile is a file of the target with the owner before and after the fix,
+// the owner -1 is the container user
+type ownedFile struct {
+	path               string
+	uid, gid           int
+	fixedUid, fixedGid int
+}
+
+// owner returns the owner with -1 replaced by the container user
+func owner(uid int, gid int, containerUser *user.User) (int, int) {
+	if uid < 0 {
+		uid, _ = strconv.Atoi(containerUser.Uid)
+		gid, _ = strconv.Atoi(containerUser.Gid)
+	}
+	return uid, gid
+}
+
+// createOwnedFiles creates the files below dir if they do not exist and sets their
+// owner, directories end with a /
+func createOwnedFiles(t *testing.T, dir string, files []ownedFile, containerUser *user.User) {
+	for _, file := range files {
+		uid, gid := owner(file.uid, file.gid, containerUser)
+		fileName := filepath.Join(dir, file.path)
+		var err error
+		if file.path[len(file.path)-1] == '/' {
+			err = os.MkdirAll(fileName, 0755)
+		} else {
+			var f *os.File
+			if f, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+				f.Close()
+			}
+		}
+		if err == nil {
+			err = os.Lchown(fileName, uid, gid)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOwnershipFixable(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the file owners needs root")
+	}
+
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	currUser, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		files   []ownedFile
+		broken  bool
+		fixable bool
+	}{
+		{[]ownedFile{{"rootfs/", 100000, 100000, 100000, 100000}, {"rootfs/etc", 101002, 101002, 101002, 101002}}, false, true},
+		//the rootfs moves from the mapping starting at 200000 to the one at 100000
+		{
+			[]ownedFile{
+				{"rootfs/", 200000, 200000, 100000, 100000},
+				{"rootfs/home", 220000, 201002, 120000, 101002},
+				{"rootfs/etc", 100000, 200000, 100000, 100000},
+			},
+			true, true,
+		},
+		//files next to the rootfs belong to the user
+		{[]ownedFile{{"rootfs/", 100000, 100000, 100000, 100000}, {"fstab", 54321, 54321, -1, -1}}, true, true},
+		//snapshots keep their own rootfs or overlay delta
+		{
+			[]ownedFile{
+				{"rootfs/", 100000, 100000, 100000, 100000},
+				{"snaps/", -1, -1, -1, -1},
+				{"snaps/snap0/", -1, -1, -1, -1},
+				{"snaps/snap0/rootfs/", 300000, 300000, 100000, 100000},
+				{"snaps/snap0/rootfs/etc", 300010, 300010, 100010, 100010},
+				{"snaps/snap1/", -1, -1, -1, -1},
+				{"snaps/snap1/delta0/", 400000, 400000, 100000, 100000},
+				{"snaps/snap1/delta0/etc", 400002, 400002, 100002, 100002},
+			},
+			true, true,
+		},
+		//ids below the root of the old mapping can not be moved
+		{[]ownedFile{{"rootfs/", 200000, 200000, 100000, 100000}, {"rootfs/etc", 190000, 190000, 190000, 190000}}, true, false},
+	}
+
+	fixable := &OwnershipFixable{}
+	for i, test := range tests {
+		target := createTarget(t, "target")
+		target.Container.SetConfigItem("lxc.idmap", "u 0 100000 65536")
+		target.Container.SetConfigItem("lxc.idmap", "g 0 100000 65536")
+		target.Container.SaveConfigFile(target.Container.ConfigFileName())
+
+		//the target directory and the configs belong to the user
+		dir := filepath.Dir(target.Container.ConfigFileName())
+		createOwnedFiles(t, dir, append([]ownedFile{{"./", -1, -1, -1, -1}, {"config", -1, -1, -1, -1}, {"config-lm", -1, -1, -1, -1}}, test.files...), currUser)
+
+		if err := fixable.Check(); (err != nil) != test.broken {
+			t.Errorf("Test %d: Check() returned %v", i, err)
+		}
+		if err := fixable.Fix(); (err != nil) == test.fixable {
+			t.Errorf("Test %d: Fix() returned %v", i, err)
+		}
+		if err := fixable.CheckContainer("target"); (err != nil) == test.fixable {
+			t.Errorf("Test %d: CheckContainer() after Fix() returned %v", i, err)
+		}
+
+		for _, file := range test.files {
+			fixedUid, fixedGid := owner(file.fixedUid, file.fixedGid, currUser)
+
+			info, err := os.Lstat(filepath.Join(dir, file.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			if int(stat.Uid) != fixedUid || int(stat.Gid) != fixedGid {
+				t.Errorf("Test %d: %s is owned by %d:%d, expected %d:%d", i, file.path, stat.Uid, stat.Gid, fixedUid, fixedGid)
+			}
+		}
+
+		os.RemoveAll(filepath.Join(dir, "snaps"))
+		removeTarget(t, "target")
+	}
+}
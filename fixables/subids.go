@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// SubIdsFixable adds the subuid and subgid ranges the targets of the user are mapped to
+type SubIdsFixable struct{}
+
+func (*SubIdsFixable) Name() string {
+	return "subids"
+}
+
+func (*SubIdsFixable) Description() string {
+	return fmt.Sprintf("Adds the missing ids of the user to %s and %s", lm_sdk_tools.SubUidFile, lm_sdk_tools.SubGidFile)
+}
+
+var subIdFiles = []string{lm_sdk_tools.SubUidFile, lm_sdk_tools.SubGidFile}
+
+func (*SubIdsFixable) Check() error {
+	lxcUser, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range subIdFiles {
+		content, newContent, _, err := lm_sdk_tools.PlanSubIdRange(fileName, lxcUser, lm_sdk_tools.SubIdCount)
+		if err != nil {
+			return err
+		}
+		if content != newContent {
+			return fmt.Errorf("The user %s has less than %d ids in %s", lxcUser.Username, lm_sdk_tools.SubIdCount, fileName)
+		}
+	}
+	return nil
+}
+
+func (*SubIdsFixable) Fix() error {
+	lxcUser, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		return err
+	}
+
+	state, err := lm_sdk_tools.LoadHostSetupState()
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range subIdFiles {
+		err = state.RecordFileChange(fileName, func() error {
+			_, err := lm_sdk_tools.EnsureSubIdRange(fileName, lxcUser, lm_sdk_tools.SubIdCount)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to add the ids of %s to %s: %v", lxcUser.Username, fileName, err)
+		}
+	}
+	return nil
+}
+
+// CheckContainer checks the host, every target is mapped to the ids of the user
+func (c *SubIdsFixable) CheckContainer(container string) error {
+	return c.Check()
+}
+
+func (c *SubIdsFixable) FixContainer(container string) error {
+	return c.Fix()
+}
+
+func (*SubIdsFixable) NeedsRoot() bool {
+	return true
+}
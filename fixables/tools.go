@@ -19,128 +19,224 @@ package fixables
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
-
 	"path"
+	"regexp"
+	"strings"
 
-	"gopkg.in/lxc/go-lxc.v2"
 	"link-motion.com/lm-toolchain-sdk-tools"
 )
 
-type ToolsFixable struct {
-	requiredTools []string
+// DefaultTools are linked into new targets and targets without a tool list
+var DefaultTools = []string{
+	"gcc",
+	"g++",
+	"make",
+	"cmake",
+	"rpmbuild",
+	"pkg-config",
+	"qmake",
+	"qtquickcompiler",
+	"rcc",
+	"uic",
+	"lupdate",
+	"lrelease",
+	"lconvert",
+	"moc",
+	"qdoc",
 }
 
-func NewToolsFixable() *ToolsFixable {
-	return &ToolsFixable{
-		requiredTools: []string{
-			"gcc",
-			"g++",
-			"make",
-			"cmake",
-			"rpmbuild",
-			"pkg-config",
-			"qmake",
-			"qtquickcompiler",
-			"rcc",
-			"uic",
-			"lupdate",
-			"lrelease",
-			"lconvert",
-			"moc",
-			"qdoc",
-		},
-	}
+// reservedToolNames are the files lxc and lmsdk-target keep in the target directory
+var reservedToolNames = map[string]bool{
+	"config":        true,
+	"config-lm":     true,
+	"rootfs":        true,
+	"fstab":         true,
+	"snaps":         true,
+	"ts":            true,
+	"image-user":    true,
+	"image-info":    true,
+	"lmsdk-wrapper": true,
 }
 
-func (this *ToolsFixable) run(container *lxc.Container, doFix bool) error {
+var toolNameRegex = regexp.MustCompile("^[A-Za-z0-9_+][A-Za-z0-9_+.-]*$")
 
-	containerDir := path.Dir(container.ConfigFileName())
+// ValidateToolName makes sure the tool can be linked into the target directory
+func ValidateToolName(tool string) error {
+	if !toolNameRegex.MatchString(tool) || reservedToolNames[tool] {
+		return fmt.Errorf("%s can not be used as tool name", tool)
+	}
+	return nil
+}
+
+// TargetTools returns the tools linked to the wrapper for the target
+func TargetTools(target *lm_sdk_tools.LMTargetContainer) []string {
+	if target.Tools == nil {
+		return append([]string{}, DefaultTools...)
+	}
+	return target.Tools
+}
 
+// wrapperTool returns the lmsdk-wrapper installed next to the running binary
+func wrapperTool() (string, error) {
 	wrapperPath, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("Could not resolve the absolute pathname of the tool")
+		return "", fmt.Errorf("Could not resolve the absolute pathname of the tool")
 	}
+	return path.Dir(wrapperPath) + "/lmsdk-wrapper", nil
+}
 
-	wrapperTool := path.Dir(wrapperPath) + "/lmsdk-wrapper"
+type ToolsFixable struct{}
+
+func NewToolsFixable() *ToolsFixable {
+	return &ToolsFixable{}
+}
+
+func (*ToolsFixable) Name() string {
+	return "tools"
+}
+
+func (*ToolsFixable) Description() string {
+	return "Links the build tools of the targets to lmsdk-wrapper"
+}
+
+/*
+run checks the tool links of the target, missing links and links pointing
+somewhere else are recreated, links of tools that are not configured anymore
+are removed. Without doFix the problems are only reported.
+*/
+func (this *ToolsFixable) run(target *lm_sdk_tools.LMTargetContainer, doFix bool) error {
+
+	containerDir := path.Dir(target.Container.ConfigFileName())
+
+	wrapperTool, err := wrapperTool()
+	if err != nil {
+		return err
+	}
+
+	problems := []string{}
+	wanted := map[string]bool{}
+	for _, tool := range TargetTools(target) {
+		wanted[tool] = true
+		if err := ValidateToolName(tool); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
 
-	for _, tool := range this.requiredTools {
 		toolPath := containerDir + "/" + tool
+		info, err := os.Lstat(toolPath)
+		if err == nil && info.Mode()&os.ModeSymlink == 0 {
+			problems = append(problems, fmt.Sprintf("%s is not a link", toolPath))
+			continue
+		}
 
 		targetPath, err := os.Readlink(toolPath)
-		if err != nil || targetPath != wrapperTool {
-			//a broken link will also report that it does not exist
-			fmt.Printf("... Creating tool %s -> %s\n", tool, wrapperTool)
-			os.Remove(toolPath)
-			err = os.Symlink(wrapperTool, toolPath)
+		if err == nil && targetPath == wrapperTool {
+			continue
+		}
+
+		if !doFix {
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to create tool: %s", toolPath)
+				problems = append(problems, fmt.Sprintf("%s is missing", tool))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s points to %s", tool, targetPath))
 			}
+			continue
+		}
+
+		//a broken link will also report that it does not exist
+		fmt.Printf("... Creating tool %s -> %s\n", tool, wrapperTool)
+		os.Remove(toolPath)
+		if err = os.Symlink(wrapperTool, toolPath); err != nil {
+			problems = append(problems, fmt.Sprintf("Failed to create tool %s: %v", toolPath, err))
 		}
 	}
-	return nil
-}
 
-func (c *ToolsFixable) CheckContainer(container string) error {
-	cont, err := lxc.NewContainer(container, lm_sdk_tools.LMTargetPath())
+	files, err := ioutil.ReadDir(containerDir)
 	if err != nil {
 		return err
 	}
+	for _, file := range files {
+		if wanted[file.Name()] || file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
 
-	if !cont.Defined() {
-		return fmt.Errorf("Container %s not found.", container)
+		toolPath := containerDir + "/" + file.Name()
+		targetPath, err := os.Readlink(toolPath)
+		if err != nil || path.Base(targetPath) != "lmsdk-wrapper" {
+			continue
+		}
+
+		if !doFix {
+			problems = append(problems, fmt.Sprintf("%s is linked but not configured", file.Name()))
+			continue
+		}
+
+		fmt.Printf("... Removing tool %s\n", file.Name())
+		if err = os.Remove(toolPath); err != nil {
+			problems = append(problems, fmt.Sprintf("Failed to remove tool %s: %v", toolPath, err))
+		}
 	}
 
-	return c.run(cont, false)
+	if len(problems) > 0 {
+		return fmt.Errorf("Tools of %s: %s", target.Name, strings.Join(problems, ", "))
+	}
+	return nil
 }
 
-func (c *ToolsFixable) FixContainer(container string) error {
-	cont, err := lxc.NewContainer(container, lm_sdk_tools.LMTargetPath())
+// FixTarget links the tools of a target that has no config-lm file yet
+func (this *ToolsFixable) FixTarget(target *lm_sdk_tools.LMTargetContainer) error {
+	return this.run(target, true)
+}
+
+func (c *ToolsFixable) CheckContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
 	if err != nil {
 		return err
 	}
 
-	if !cont.Defined() {
-		return fmt.Errorf("Container %s not found.", container)
-	}
-
-	return c.run(cont, true)
+	return c.run(target, false)
 }
 
-func (c *ToolsFixable) Check() error {
-	fmt.Printf("Checking for missing tools...\n")
-
-	targets, err := lm_sdk_tools.FindLMTargets()
+func (c *ToolsFixable) FixContainer(container string) error {
+	target, err := lm_sdk_tools.LoadLMContainer(container)
 	if err != nil {
 		return err
 	}
 
-	for _, target := range targets {
-		err = c.run(target.Container, false)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return c.run(target, true)
 }
 
-func (c *ToolsFixable) Fix() error {
-	fmt.Printf("Fixing missing tools...\n")
-
+// runAll runs on all targets, errors of the single targets are combined
+func (c *ToolsFixable) runAll(doFix bool) error {
 	targets, err := lm_sdk_tools.FindLMTargets()
 	if err != nil {
 		return err
 	}
 
-	for _, target := range targets {
-		err = c.run(target.Container, true)
-		if err != nil {
-			return err
+	errors := []string{}
+	for i := range targets {
+		if err = c.run(&targets[i], doFix); err != nil {
+			errors = append(errors, err.Error())
 		}
 	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
 	return nil
 }
 
+func (c *ToolsFixable) Check() error {
+	fmt.Printf("Checking for missing tools...\n")
+	return c.runAll(false)
+}
+
+func (c *ToolsFixable) Fix() error {
+	fmt.Printf("Fixing missing tools...\n")
+	return c.runAll(true)
+}
+
 func (*ToolsFixable) NeedsRoot() bool {
 	return false
 }
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// linkedTools returns the files in the target directory linked to the wrapper
+func linkedTools(dir string, wrapper string) []string {
+	files, _ := ioutil.ReadDir(dir)
+	tools := []string{}
+	for _, file := range files {
+		if target, err := os.Readlink(filepath.Join(dir, file.Name())); err == nil && target == wrapper {
+			tools = append(tools, file.Name())
+		}
+	}
+	sort.Strings(tools)
+	return tools
+}
+
+func TestToolsFixable(t *testing.T) {
+	tests := []struct {
+		tools []string
+		//links and files created before the check
+		links   map[string]string
+		files   []string
+		broken  bool
+		fixable bool
+		linked  string
+	}{
+		{[]string{"gcc", "make"}, nil, nil, true, true, "gcc,make"},
+		{[]string{"gcc"}, map[string]string{"gcc": "/usr/bin/gcc"}, nil, true, true, "gcc"},
+		//links to the wrapper that are not configured are removed
+		{[]string{"gcc"}, map[string]string{"qmake": "/opt/lmsdk-wrapper"}, nil, true, true, "gcc"},
+		//files and invalid names are never replaced
+		{[]string{"gcc", "make"}, nil, []string{"gcc"}, true, false, "make"},
+		{[]string{"config", "gcc"}, nil, nil, true, false, "gcc"},
+	}
+
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	wrapper, err := wrapperTool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixable := NewToolsFixable()
+	for _, test := range tests {
+		target := createTarget(t, "target")
+		target.Tools = test.tools
+		if err := lm_sdk_tools.WriteLMContainerConfig(target); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Dir(target.Container.ConfigFileName())
+		for name, link := range test.links {
+			os.Symlink(link, filepath.Join(dir, name))
+		}
+		for _, name := range test.files {
+			ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0755)
+		}
+
+		if err := fixable.Check(); (err != nil) != test.broken {
+			t.Errorf("%v: Check() returned %v", test.tools, err)
+		}
+		if err := fixable.Fix(); (err != nil) == test.fixable {
+			t.Errorf("%v: Fix() returned %v", test.tools, err)
+		}
+		if err := fixable.CheckContainer("target"); (err != nil) == test.fixable {
+			t.Errorf("%v: CheckContainer() after Fix() returned %v", test.tools, err)
+		}
+
+		if linked := strings.Join(linkedTools(dir, wrapper), ","); linked != test.linked {
+			t.Errorf("%v: the linked tools are %s, expected %s", test.tools, linked, test.linked)
+		}
+		removeTarget(t, "target")
+	}
+}
+
+func TestTargetTools(t *testing.T) {
+	tests := []struct {
+		tools []string
+		used  []string
+	}{
+		//targets without a tool list use the default tools
+		{nil, DefaultTools},
+		{[]string{}, []string{}},
+		{[]string{"gcc"}, []string{"gcc"}},
+	}
+
+	for _, test := range tests {
+		used := TargetTools(&lm_sdk_tools.LMTargetContainer{Tools: test.tools})
+		if strings.Join(used, ",") != strings.Join(test.used, ",") {
+			t.Errorf("TargetTools(%v) = %v, expected %v", test.tools, used, test.used)
+		}
+	}
+}
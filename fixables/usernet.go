@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package fixables
+
+import (
+	"fmt"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// UsernetFixable allows the user to add the network interfaces of the targets to the lxc bridge
+type UsernetFixable struct{}
+
+func (*UsernetFixable) Name() string {
+	return "usernet"
+}
+
+func (*UsernetFixable) Description() string {
+	return fmt.Sprintf("Adds the user to %s for the lxc bridge", lm_sdk_tools.LxcUsernetFile)
+}
+
+func (*UsernetFixable) Check() error {
+	if err := lm_sdk_tools.LxcBridgeConfigured(); err != nil {
+		return fmt.Errorf("Setting up the LXC usernet requires a configured bridge: %v", err)
+	}
+
+	bridgeConf, err := lm_sdk_tools.ReadLxcBridgeConfig()
+	if err != nil {
+		return err
+	}
+
+	content, newContent, err := lm_sdk_tools.PlanLxcUsernet(bridgeConf["LXC_BRIDGE"])
+	if err != nil {
+		return err
+	}
+	if content != newContent {
+		return fmt.Errorf("The user has no entry for %s in %s", bridgeConf["LXC_BRIDGE"], lm_sdk_tools.LxcUsernetFile)
+	}
+	return nil
+}
+
+func (*UsernetFixable) Fix() error {
+	state, err := lm_sdk_tools.LoadHostSetupState()
+	if err != nil {
+		return err
+	}
+	return state.RecordFileChange(lm_sdk_tools.LxcUsernetFile, lm_sdk_tools.EditLxcUsernet)
+}
+
+// CheckContainer checks the host, every target needs the entry to start its network
+func (c *UsernetFixable) CheckContainer(container string) error {
+	return c.Check()
+}
+
+func (c *UsernetFixable) FixContainer(container string) error {
+	return c.Fix()
+}
+
+func (*UsernetFixable) NeedsRoot() bool {
+	return true
+}
@@ -29,40 +29,58 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
-	"bufio"
-
 	"strconv"
 
-	"encoding/json"
-
 	"gopkg.in/lxc/go-lxc.v2"
 )
 
 type LMTargetContainer struct {
-	Name           string         `json:"name"`
-	Architecture   string         `json:"architecture"`
-	Distribution   string         `json:"distribution"`
-	Version        string         `json:"version"`
-	UpdatesEnabled bool           `json:"updatesEnabled"`
-	Container      *lxc.Container `json:"-"`
+	ConfigVersion    int               `json:"configVersion"`
+	Name             string            `json:"name"`
+	Architecture     string            `json:"architecture"`
+	HostArchitecture string            `json:"hostArchitecture,omitempty"`
+	Distribution     string            `json:"distribution"`
+	Version          string            `json:"version"`
+	ImageBuildId     string            `json:"imageBuildId,omitempty"`
+	ImageServer      string            `json:"imageServer,omitempty"`
+	Created          time.Time         `json:"created"`
+	UpdatesEnabled   bool              `json:"updatesEnabled"`
+	User             ContainerUser     `json:"user"`
+	Tools            []string          `json:"tools,omitempty"`
+	Environment      map[string]string `json:"environment,omitempty"`
+	EnvPassthrough   []string          `json:"envPassthrough,omitempty"`
+	Network          string            `json:"network,omitempty"`
+	HomeMount        string            `json:"homeMount,omitempty"`
+	Container        ContainerBackend  `json:"-"`
+
+	//the schema version of the config-lm file before the migration on load
+	storedVersion int
 }
 
 const LxcBridgeFile = "/etc/default/lxc-net"
 const LxcUsernetFile = "/etc/lxc/lxc-usernet"
 const LmImageServerEnvVar = "LM_IMAGE_SERVER"
 
+// LMTargetPath returns the directory the targets of the container user are stored in,
+// which is below StorageRoot()
 func LMTargetPath() string {
-	user, err := LxcContainerUser()
+	root, err := StorageRoot()
 	if err != nil {
-		fmt.Printf("Fatal: Could not query the current user.")
+		fmt.Printf("Fatal: Could not query the storage root: %v\n", err)
 		os.Exit(1)
 	}
 
-	return "/var/lib/lm-sdk/" + user.Username + "/containers"
+	targetPath, err := TargetPathInRoot(root)
+	if err != nil {
+		fmt.Printf("Fatal: Could not query the current user.")
+		os.Exit(1)
+	}
+	return targetPath
 }
 
 func EnsureLXCInitializedOrDie() error {
@@ -70,78 +88,32 @@ func EnsureLXCInitializedOrDie() error {
 	return nil
 }
 
-func GetOrCreateUidRange(doCreate bool) (uint32, uint32, error) {
+// GetOrCreateUidRange returns the subuid ranges of the current user, if doCreate is set
+// missing ids are added to /etc/subuid
+func GetOrCreateUidRange(doCreate bool) ([]SubIdRange, error) {
 	currUser, err := LxcContainerUser()
 	if err != nil {
-		return 0, 0, fmt.Errorf("cannot get user: %v", err)
+		return nil, fmt.Errorf("cannot get user: %v", err)
 	}
 
-	return GetOrCreateIdRange(currUser.Username, "/etc/subuid", doCreate)
+	return GetOrCreateIdRange(currUser, SubUidFile, doCreate)
 }
 
-func GetOrCreateGuidRange(doCreate bool) (uint32, uint32, error) {
-
+// GetOrCreateGuidRange returns the subgid ranges of the current user, if doCreate is set
+// missing ids are added to /etc/subgid
+func GetOrCreateGuidRange(doCreate bool) ([]SubIdRange, error) {
 	currUser, err := LxcContainerUser()
 	if err != nil {
-		return 0, 0, fmt.Errorf("cannot get user: %v", err)
+		return nil, fmt.Errorf("cannot get user: %v", err)
 	}
-	return GetOrCreateIdRange(currUser.Username, "/etc/subgid", doCreate)
+	return GetOrCreateIdRange(currUser, SubGidFile, doCreate)
 }
 
-func GetOrCreateIdRange(user string, fileName string, doCreate bool) (uint32, uint32, error) {
-
-	mode := os.O_RDONLY
-	if doCreate {
-		mode = os.O_RDWR | os.O_CREATE
-	}
-
-	file, err := os.OpenFile(fileName, mode, 0644)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	defer file.Close()
-
-	nextSubIdStart := uint32(100000)
-	reader := bufio.NewScanner(file)
-	for reader.Scan() {
-		line := reader.Text()
-
-		values := strings.Split(line, ":")
-		if len(values) != 3 {
-			continue
-		}
-
-		idStart, err := strconv.ParseUint(values[1], 10, 32)
-		if err != nil {
-			return 0, 0, fmt.Errorf("Invalid number in %s %v", fileName, err)
-		}
-
-		idCount, err := strconv.ParseUint(values[2], 10, 32)
-		if err != nil {
-			return 0, 0, fmt.Errorf("Invalid number in %s %v", fileName, err)
-		}
-
-		//if our user has already a entry, we do not need to care
-		if values[0] == user {
-			fmt.Printf("Found ID range: %d %d\n", idStart, idCount)
-			return uint32(idStart), uint32(idCount), nil
-		}
-
-		nextId := uint32(idStart) + uint32(idCount)
-		if nextId > nextSubIdStart {
-			nextSubIdStart = nextId
-		}
-	}
-
+func GetOrCreateIdRange(owner *user.User, fileName string, doCreate bool) ([]SubIdRange, error) {
 	if os.Getuid() != 0 || !doCreate {
-		return 0, 0, fmt.Errorf("No sub id was found, please run lmsdk-target initialize.")
+		return ReadSubIdRanges(fileName, owner)
 	}
-
-	fmt.Printf("Create ID range: %d 65536\n", nextSubIdStart)
-	fmt.Fprintf(file, "%s:%d:65536", user, nextSubIdStart)
-	return nextSubIdStart, 65536, nil
-
+	return EnsureSubIdRange(fileName, owner, SubIdCount)
 }
 
 func BootContainerSync(container *LMTargetContainer) error {
@@ -163,21 +135,55 @@ func BootContainerSync(container *LMTargetContainer) error {
 		if err != nil {
 			return fmt.Errorf("Error while starting the container: %v\n", err)
 		}
-		container.Container.Wait(lxc.RUNNING, time.Second*5)
+		if !container.Container.Wait(lxc.RUNNING, time.Second*5) {
+			return fmt.Errorf("Container did not reach the running state")
+		}
 	}
 	return nil
 }
 
-func StopContainerSync(container string) error {
-	return nil
-}
+// DefaultStopTimeout is the time a container gets to shut down cleanly before it is killed
+const DefaultStopTimeout = 30 * time.Second
+
+/*
+StopContainerSync stops the container and waits until it reached the stopped state.
+The container is asked to shut down cleanly first, if it does not stop within
+timeout it is killed. A timeout of 0 kills the container right away.
+*/
+func StopContainerSync(container *LMTargetContainer, timeout time.Duration) error {
+	switch container.Container.State() {
+	case lxc.STARTING:
+		container.Container.Wait(lxc.RUNNING, time.Second*5)
+	case lxc.STOPPING:
+		container.Container.Wait(lxc.STOPPED, timeout)
+	case lxc.FREEZING:
+		container.Container.Wait(lxc.FROZEN, time.Second*5)
+	}
 
-func UpdateConfigSync(container string) error {
+	if container.Container.State() == lxc.STOPPED {
+		return nil
+	}
+
+	if timeout > 0 && container.Container.State() == lxc.RUNNING {
+		err := container.Container.Shutdown(timeout)
+		if err == nil && container.Container.Wait(lxc.STOPPED, time.Second*5) {
+			return nil
+		}
+		fmt.Printf("Container did not shut down within %v, killing it.\n", timeout)
+	}
+
+	if err := container.Container.Stop(); err != nil {
+		return fmt.Errorf("Error while stopping the container: %v", err)
+	}
+
+	if !container.Container.Wait(lxc.STOPPED, time.Second*5) {
+		return fmt.Errorf("Container did not reach the stopped state")
+	}
 	return nil
 }
 
 func RemoveContainerSync(container string) error {
-	c, err := lxc.NewContainer(container, LMTargetPath())
+	c, err := NewContainer(container)
 	if err != nil {
 		return fmt.Errorf("ERROR: %s", err.Error())
 	}
@@ -223,7 +229,7 @@ func GetUserConfirmation(question string) bool {
 }
 
 func ContainerRootfs(container string) (string, error) {
-	c, err := lxc.NewContainer(container, LMTargetPath())
+	c, err := NewContainer(container)
 	if err != nil {
 		return "", fmt.Errorf("ERROR: %s", err.Error())
 	}
@@ -232,51 +238,61 @@ func ContainerRootfs(container string) (string, error) {
 		return "", fmt.Errorf("Container %s does not exist", container)
 	}
 
-	return c.ConfigItem("lxc.rootfs")[0], nil
+	return c.ConfigItem(ConfigKey("lxc.rootfs.path"))[0], nil
 }
 
-func toLmContainer(c *lxc.Container) (*LMTargetContainer, error) {
-	if !c.Defined() {
-		return nil, fmt.Errorf("Container %s does not exist", c.Name())
-	}
-
-	//read config file
-	conf, err := ioutil.ReadFile(c.ConfigFileName() + "-lm")
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read container config file: %s", err)
-	}
-
-	lmContainer := LMTargetContainer{
-		Container: nil,
+/*
+RootfsDirs returns the directories of a lxc.rootfs.path without the storage
+type prefix. An overlay rootfs like overlay:/lower:/upper has two of them, the
+upper directory with the changes of the snapshot comes first and hides the
+files of the lower one.
+*/
+func RootfsDirs(rootfs string) []string {
+	index := strings.Index(rootfs, ":")
+	if index < 0 {
+		return []string{rootfs}
 	}
 
-	err = json.Unmarshal(conf, &lmContainer)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to parse container config file: %s", err)
+	storage, dirs := rootfs[:index], rootfs[index+1:]
+	if storage == "overlay" || storage == "overlayfs" {
+		if index = strings.LastIndex(dirs, ":"); index >= 0 {
+			return []string{dirs[index+1:], dirs[:index]}
+		}
 	}
-
-	lmContainer.Name = c.Name()
-	lmContainer.Container = c
-	return &lmContainer, nil
+	return []string{dirs}
 }
 
 func LoadLMContainer(container string) (*LMTargetContainer, error) {
-	c, err := lxc.NewContainer(container, LMTargetPath())
+	c, err := NewContainer(container)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: %s", err.Error())
 	}
 	return toLmContainer(c)
 }
 
+// EnvironmentList returns the persistent environment of the target as sorted KEY=VALUE pairs
+func (c *LMTargetContainer) EnvironmentList() []string {
+	env := []string{}
+	for key, value := range c.Environment {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
 func FindLMTargets() ([]LMTargetContainer, error) {
 
-	all_containers := lxc.Containers(LMTargetPath())
+	all_containers := Containers()
 	lmTargets := []LMTargetContainer{}
 
 	for _, container := range all_containers {
 
 		lmContainer, err := toLmContainer(container)
-		if err != nil {
+		if IsLMConfigError(err) {
+			//one broken target should not break all others
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %v, run lmsdk-target autofix --only lmconfig\n", container.Name(), err)
+			continue
+		} else if err != nil {
 			return nil, err
 		}
 
@@ -436,23 +452,41 @@ func HasLxcUsernet() error {
 	return fmt.Errorf("User not found in usernet config")
 }
 
-func EditLxcUsernet() error {
-	if err := HasLxcUsernet(); err == nil {
-		return nil
+/*
+PlanLxcUsernet computes the content of the lxc-usernet file, which allows the
+container user to create network interfaces on the bridge. Returns the current
+and the new content, which are equal if nothing needs to be changed.
+*/
+func PlanLxcUsernet(bridge string) (string, string, error) {
+	data, err := ioutil.ReadFile(LxcUsernetFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
 	}
+	content := string(data)
 
 	user, err := LxcContainerUser()
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	f, err := os.OpenFile(LxcUsernetFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+	//the user might have a entry for a previously used bridge
+	for _, line := range SplitLines(content) {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && !strings.HasPrefix(line, "#") && fields[0] == user.Username && fields[2] == bridge {
+			return content, content, nil
+		}
 	}
-	defer f.Close()
 
-	if err = LxcBridgeConfigured(); err != nil {
+	newContent := content
+	if len(newContent) > 0 && !strings.HasSuffix(newContent, "\n") {
+		newContent += "\n"
+	}
+	newContent += fmt.Sprintf("%s veth %s 999\n", user.Username, bridge)
+	return content, newContent, nil
+}
+
+func EditLxcUsernet() error {
+	if err := LxcBridgeConfigured(); err != nil {
 		return fmt.Errorf("Setting up the LXC usernet requires a configured bridge: %v", err)
 	}
 
@@ -461,45 +495,132 @@ func EditLxcUsernet() error {
 		return err
 	}
 
-	fmt.Fprintf(f, "%s veth %s 999\n", user.Username, bridgeConf["LXC_BRIDGE"])
-	return nil
+	content, newContent, err := PlanLxcUsernet(bridgeConf["LXC_BRIDGE"])
+	if err != nil || content == newContent {
+		return err
+	}
+	return WriteFileAtomic(LxcUsernetFile, []byte(newContent), 0644)
 }
 
-func EnsureRequiredDirectoriesExist(doFix bool) error {
-	targetPath := LMTargetPath()
+// RemoveLxcUsernet removes the given entries from the lxc-usernet file,
+// returns the number of entries that are left
+func RemoveLxcUsernet(entries []string) (int, error) {
+	if _, err := RemoveAddedLines(LxcUsernetFile, entries); err != nil {
+		return 0, err
+	}
+
+	data, err := ioutil.ReadFile(LxcUsernetFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	others := 0
+	for _, line := range SplitLines(string(data)) {
+		if len(strings.Fields(line)) == 4 && !strings.HasPrefix(line, "#") {
+			others++
+		}
+	}
+	return others, nil
+}
+
+type requiredDirectory struct {
+	path     string
+	ownerUid int
+	ownerGid int
+	perm     os.FileMode
+}
+
+func requiredDirectories() ([]requiredDirectory, error) {
+	return requiredDirectoriesFor(LMTargetPath())
+}
+
+// requiredDirectoriesFor returns the directories needed to store targets in targetPath
+func requiredDirectoriesFor(targetPath string) ([]requiredDirectory, error) {
 	userPath := filepath.Dir(targetPath)
 	rootPath := filepath.Dir(userPath)
 
 	user, err := LxcContainerUser()
 	if err != nil {
-		return fmt.Errorf("Querying the user failed: %v", err)
+		return nil, fmt.Errorf("Querying the user failed: %v", err)
 	}
 
 	uid, err := strconv.Atoi(user.Uid)
 	if err != nil {
-		return fmt.Errorf("Invalid User ID: %v", err)
+		return nil, fmt.Errorf("Invalid User ID: %v", err)
 	}
 	gid, err := strconv.Atoi(user.Gid)
 	if err != nil {
-		return fmt.Errorf("Invalid Group ID: %v", err)
+		return nil, fmt.Errorf("Invalid Group ID: %v", err)
 	}
 
-	if err = EnsureDirExistsWithPermissions(rootPath, 0, 0, os.ModeDir|0755, doFix); err != nil {
-		return err
-	}
+	return []requiredDirectory{
+		{rootPath, 0, 0, os.ModeDir | 0755},
+		{userPath, uid, gid, os.ModeDir | 0750},
+		{targetPath, uid, gid, os.ModeDir | 0750},
+	}, nil
+}
+
+func EnsureRequiredDirectoriesExist(doFix bool) error {
+	return EnsureTargetDirectoriesExist(LMTargetPath(), doFix)
+}
 
-	if err = EnsureDirExistsWithPermissions(userPath, uid, gid, os.ModeDir|0750, doFix); err != nil {
+// EnsureTargetDirectoriesExist checks and creates the directories of a target path
+// that is not the current one, e.g. while the storage is moved
+func EnsureTargetDirectoriesExist(targetPath string, doFix bool) error {
+	dirs, err := requiredDirectoriesFor(targetPath)
+	if err != nil {
 		return err
 	}
 
-	if err = EnsureDirExistsWithPermissions(targetPath, uid, gid, os.ModeDir|0750, doFix); err != nil {
-		return err
+	for _, dir := range dirs {
+		if err = EnsureDirExistsWithPermissions(dir.path, dir.ownerUid, dir.ownerGid, dir.perm, doFix); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// PlanRequiredDirectories describes the changes EnsureRequiredDirectoriesExist would do
+func PlanRequiredDirectories() ([]string, error) {
+	dirs, err := requiredDirectories()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []string{}
+	for _, dir := range dirs {
+		fileInfo, err := os.Lstat(dir.path)
+		if os.IsNotExist(err) {
+			changes = append(changes, fmt.Sprintf("create %s owned by %d:%d with mode %v", dir.path, dir.ownerUid, dir.ownerGid, dir.perm))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !fileInfo.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory, symlinks are not allowed", dir.path)
+		}
+
+		stat := fileInfo.Sys().(*syscall.Stat_t)
+		if dir.ownerUid != int(stat.Uid) || dir.ownerGid != int(stat.Gid) {
+			changes = append(changes, fmt.Sprintf("change owner of %s from %d:%d to %d:%d", dir.path, stat.Uid, stat.Gid, dir.ownerUid, dir.ownerGid))
+		}
+		if fileInfo.Mode() != dir.perm {
+			changes = append(changes, fmt.Sprintf("change mode of %s from %v to %v", dir.path, fileInfo.Mode(), dir.perm))
+		}
+	}
+	return changes, nil
+}
+
+/*
+EnsureDirExistsWithPermissions checks and fixes the owner and mode of a directory.
+The directory is opened without following symlinks and changed through the file
+descriptor, a user replacing a directory it owns with a symlink can not make root
+change the owner or mode of another file.
+*/
 func EnsureDirExistsWithPermissions(dirName string, ownerUid, ownerGid int, perm os.FileMode, doFix bool) error {
-	if _, err := os.Stat(dirName); os.IsNotExist(err) {
+	if _, err := os.Lstat(dirName); os.IsNotExist(err) {
 		if !doFix {
 			return fmt.Errorf("Directory does not exist: %v", err)
 		}
@@ -508,9 +629,18 @@ func EnsureDirExistsWithPermissions(dirName string, ownerUid, ownerGid int, perm
 		}
 	}
 
-	fileInfo, err := os.Stat(dirName)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("The directory does not exist: %v", err)
+	fd, err := syscall.Open(dirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err == syscall.ELOOP || err == syscall.ENOTDIR {
+		return fmt.Errorf("%s is not a directory, symlinks are not allowed", dirName)
+	} else if err != nil {
+		return fmt.Errorf("Opening the directory %s failed: %v", dirName, err)
+	}
+	dir := os.NewFile(uintptr(fd), dirName)
+	defer dir.Close()
+
+	fileInfo, err := dir.Stat()
+	if err != nil {
+		return err
 	}
 
 	fileUid := fileInfo.Sys().(*syscall.Stat_t).Uid
@@ -520,7 +650,7 @@ func EnsureDirExistsWithPermissions(dirName string, ownerUid, ownerGid int, perm
 		if !doFix {
 			return fmt.Errorf("Wrong owner for directory: %s", dirName)
 		}
-		if err = os.Chown(dirName, ownerUid, ownerGid); err != nil {
+		if err = dir.Chown(ownerUid, ownerGid); err != nil {
 			return fmt.Errorf("Changing the directory ownership failed: %v", err)
 		}
 	}
@@ -529,7 +659,7 @@ func EnsureDirExistsWithPermissions(dirName string, ownerUid, ownerGid int, perm
 		if !doFix {
 			return fmt.Errorf("Wrong permissions for directory: %s", dirName)
 		}
-		if err = os.Chmod(dirName, perm); err != nil {
+		if err = dir.Chmod(perm); err != nil {
 			return fmt.Errorf("Changing the directory permissions failed: %v", err)
 		}
 	}
@@ -537,25 +667,11 @@ func EnsureDirExistsWithPermissions(dirName string, ownerUid, ownerGid int, perm
 	return nil
 }
 
-func DistroToUserIds(distro string) (uint32, uint32, string, error) {
-	return 20000, 1002, "system", nil
-	/*
-		if distro == "link-motion-autoos" {
-			return 20000, 1002, "org.c4c.ui_cluster", nil
-		} else if distro == "link-motion-ivios" {
-			return 20000, 1002, "system", nil
-		} else {
-			return 0, 0, "", fmt.Errorf("Unknown distro: %s", distro)
-		}
-	*/
-}
-
 func RunInContainer(c *LMTargetContainer, runAsRoot bool, env []string, program string, stdoutFd uintptr, stderrFd uintptr) (int, error) {
-	cid, cgid, _, err := DistroToUserIds(c.Distribution)
-
+	//the targets environment comes first, so the caller can override it
+	env, err := c.CommandEnvironment(env)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		return 1, nil
+		return 0, err
 	}
 
 	options := lxc.DefaultAttachOptions
@@ -565,8 +681,8 @@ func RunInContainer(c *LMTargetContainer, runAsRoot bool, env []string, program
 		options.GID = int(0)
 		env = append(env, "HOME=/root")
 	} else {
-		options.UID = int(cid)
-		options.GID = int(cgid)
+		options.UID = int(c.User.Uid)
+		options.GID = int(c.User.Gid)
 		currUser, err := user.Current()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to query current user")
@@ -594,14 +710,15 @@ func RunInContainer(c *LMTargetContainer, runAsRoot bool, env []string, program
 	if len(env) > 0 {
 		envList := ""
 		for _, envVar := range env {
-			envList += "\"" + envVar + "\" "
+			envList += QuoteString(envVar) + " "
 		}
 		fullcmd = fmt.Sprintf("env %s ", envList)
 	}
 
 	fullcmd = fullcmd + program
 
-	fmt.Printf("Running command: %s\n", fullcmd)
+	//the environment can contain credentials, e.g. of a proxy
+	fmt.Printf("Running command: %s\n", program)
 
 	return c.Container.RunCommandStatus(
 		[]string{"/bin/bash", "--login", "-c", fullcmd},
@@ -699,11 +816,62 @@ func RemoveZypperRepository(name string, container *LMTargetContainer) error {
 	lxc >= 2.1.0
 	Note:
 	lxc.VersionAtLeast and lxc.VersionNumber seem to return 2.1.0 on 2.0.8
-	and are not used because of that. Bug in lxc-go?
+	and are not used because of that. Bug in lxc-go? The version string is
+	parsed instead, see ParseLXCVersion.
 */
 func LXCNewVersion() bool {
-	lxcver := lxc.Version()
-	return !strings.HasPrefix(lxcver, "2.0")
+	return IsNewConfigFormat(backend.Version())
+}
+
+/*
+UserNamespaceMaps returns the lxc-usernsexec mappings of a namespace in which
+root is the current user and the ids from 1 on are the sub id ranges of the user.
+*/
+func UserNamespaceMaps() ([]string, error) {
+	currUser, err := LxcContainerUser()
+	if err != nil {
+		return nil, err
+	}
+
+	maps := []string{"u:0:" + currUser.Uid + ":1", "g:0:" + currUser.Gid + ":1"}
+	for _, kind := range []string{"u", "g"} {
+		fileName := SubUidFile
+		if kind == "g" {
+			fileName = SubGidFile
+		}
+
+		ranges, err := ReadSubIdRanges(fileName, currUser)
+		if err != nil {
+			return nil, err
+		}
+		if len(ranges) == 0 {
+			return nil, fmt.Errorf("%s has no ranges for %s. Please run lmsdk-target autosetup.", fileName, currUser.Username)
+		}
+
+		next := uint64(1)
+		for _, r := range ranges {
+			maps = append(maps, fmt.Sprintf("%s:%d:%d:%d", kind, next, r.Start, r.Count))
+			next += uint64(r.Count)
+		}
+	}
+	return maps, nil
+}
+
+// RunInUserNamespace runs a command as root of the namespace of UserNamespaceMaps
+func RunInUserNamespace(command ...string) error {
+	maps, err := UserNamespaceMaps()
+	if err != nil {
+		return err
+	}
+
+	args := []string{}
+	for _, m := range maps {
+		args = append(args, "-m", m)
+	}
+	cmd := exec.Command("lxc-usernsexec", append(append(args, "--"), command...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
 }
 
 /*
@@ -715,12 +883,7 @@ func LXCNewVersion() bool {
 */
 func CheckContainerPermissions(container *LMTargetContainer) {
 	if container != nil && LXCNewVersion() {
-		uid := os.Getuid()
-		cmd := exec.Command("lxc-usernsexec", "-m", "b:0:"+strconv.Itoa(uid)+":1", "-m", "b:1:100000:65535", "--",
-			"chown", "-R", "0:0", LMTargetPath()+"/"+container.Name)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
+		err := RunInUserNamespace("chown", "-R", "0:0", LMTargetPath()+"/"+container.Name)
 		if err != nil {
 			fmt.Printf("CheckContainerPermissions failed to fix permissions with usernsexec:\n%v\n", err)
 		}
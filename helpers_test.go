@@ -0,0 +1,258 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// setenv sets a environment variable, the returned function restores the old value
+func setenv(key string, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// useFakeBackend runs the test with a FakeBackend in a temporary storage root,
+// the returned function restores the old backend and removes the storage root
+func useFakeBackend(t *testing.T, lxcVersion string) (*FakeBackend, func()) {
+	root, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := []func(){setenv(LmStorageEnvVar, root)}
+	//as root the container user is the one calling sudo
+	if _, ok := os.LookupEnv("SUDO_UID"); os.Getuid() == 0 && !ok {
+		restore = append(restore, setenv("SUDO_UID", "0"))
+	}
+
+	fake := NewFakeBackend()
+	fake.LxcVersion = lxcVersion
+	oldBackend := SetBackend(fake)
+
+	return fake, func() {
+		SetBackend(oldBackend)
+		for _, fn := range restore {
+			fn()
+		}
+		os.RemoveAll(root)
+	}
+}
+
+// createFakeContainer creates a defined container in LMTargetPath()
+func createFakeContainer(t *testing.T, name string) ContainerBackend {
+	c, err := NewContainer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Create(lxc.TemplateOptions{Arch: "amd64"}); err != nil {
+		t.Fatalf("Create(%s) failed: %v", name, err)
+	}
+	return c
+}
+
+func TestFakeCreate(t *testing.T) {
+	tests := []struct {
+		lxcVersion string
+		rootfsKey  string
+		utsKey     string
+	}{
+		{"2.0.8", "lxc.rootfs", "lxc.utsname"},
+		{"2.1.1", "lxc.rootfs.path", "lxc.uts.name"},
+	}
+
+	for _, test := range tests {
+		_, restore := useFakeBackend(t, test.lxcVersion)
+
+		c := createFakeContainer(t, "target")
+		rootfs := filepath.Join(LMTargetPath(), "target", "rootfs")
+
+		if !c.Defined() || c.State() != lxc.STOPPED {
+			t.Errorf("lxc %s: the created container is not defined and stopped", test.lxcVersion)
+		}
+		if value := c.ConfigItem(test.rootfsKey)[0]; value != rootfs {
+			t.Errorf("lxc %s: %s = %q, expected %q", test.lxcVersion, test.rootfsKey, value, rootfs)
+		}
+		if value := c.ConfigItem(test.utsKey)[0]; value != "target" {
+			t.Errorf("lxc %s: %s = %q, expected target", test.lxcVersion, test.utsKey, value)
+		}
+		if value, err := ContainerRootfs("target"); err != nil || value != rootfs {
+			t.Errorf("lxc %s: ContainerRootfs() = %q, %v, expected %q", test.lxcVersion, value, err, rootfs)
+		}
+		if info, err := os.Stat(rootfs); err != nil || !info.IsDir() {
+			t.Errorf("lxc %s: the rootfs %s was not created", test.lxcVersion, rootfs)
+		}
+
+		data, err := ioutil.ReadFile(c.ConfigFileName())
+		if err != nil || !strings.Contains(string(data), test.rootfsKey+" = "+rootfs+"\n") {
+			t.Errorf("lxc %s: the config file does not contain the rootfs:\n%s", test.lxcVersion, data)
+		}
+
+		if err = c.Create(lxc.TemplateOptions{Arch: "amd64"}); err == nil {
+			t.Errorf("lxc %s: creating a existing container succeeded", test.lxcVersion)
+		}
+		restore()
+	}
+}
+
+func TestFakeSnapshots(t *testing.T) {
+	_, restore := useFakeBackend(t, "2.1.1")
+	defer restore()
+
+	c := createFakeContainer(t, "target")
+	snapshotDir := filepath.Join(LMTargetPath(), "target", "snaps")
+
+	steps := []struct {
+		action   string
+		snapshot string
+		existing []string
+	}{
+		{"create", "snap0", []string{"snap0"}},
+		{"create", "snap1", []string{"snap0", "snap1"}},
+		{"destroy", "snap0", []string{"snap1"}},
+		//the names are not reused while a later snapshot exists
+		{"create", "snap2", []string{"snap1", "snap2"}},
+		{"destroy", "snap2", []string{"snap1"}},
+		{"create", "snap2", []string{"snap1", "snap2"}},
+	}
+
+	for i, step := range steps {
+		switch step.action {
+		case "create":
+			snapshot, err := c.CreateSnapshot()
+			if err != nil {
+				t.Fatalf("Step %d: CreateSnapshot() failed: %v", i, err)
+			}
+			if snapshot.Name != step.snapshot || snapshot.Path != filepath.Join(snapshotDir, step.snapshot) {
+				t.Errorf("Step %d: created %s in %s, expected %s", i, snapshot.Name, snapshot.Path, step.snapshot)
+			}
+		case "destroy":
+			if err := c.DestroySnapshot(lxc.Snapshot{Name: step.snapshot}); err != nil {
+				t.Fatalf("Step %d: DestroySnapshot(%s) failed: %v", i, step.snapshot, err)
+			}
+		}
+
+		snapshots, _ := c.Snapshots()
+		names := []string{}
+		for _, snapshot := range snapshots {
+			names = append(names, snapshot.Name)
+			if _, err := os.Stat(snapshot.Path); err != nil {
+				t.Errorf("Step %d: the directory of %s is missing", i, snapshot.Name)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(step.existing, ",") {
+			t.Errorf("Step %d: snapshots are %v, expected %v", i, names, step.existing)
+		}
+	}
+
+	//a restore into a new name defines a container with the config of the snapshot
+	c.SetConfigItem("lxc.environment", "CHANGED=1")
+	if err := c.RestoreSnapshot(lxc.Snapshot{Name: "snap1"}, "restored"); err != nil {
+		t.Fatalf("RestoreSnapshot() failed: %v", err)
+	}
+	restored, _ := NewContainer("restored")
+	if !restored.Defined() || restored.ConfigItem("lxc.environment")[0] != "" {
+		t.Errorf("The restored container is not defined or has the config of the original")
+	}
+
+	if err := c.Destroy(); err == nil {
+		t.Errorf("Destroying a container with snapshots succeeded")
+	}
+	if err := RemoveContainerSync("target"); err != nil {
+		t.Fatalf("RemoveContainerSync() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(LMTargetPath(), "target")); !os.IsNotExist(err) {
+		t.Errorf("The container directory was not removed")
+	}
+	if c.Defined() {
+		t.Errorf("The removed container is still defined")
+	}
+}
+
+func TestStopContainerSync(t *testing.T) {
+	tests := []struct {
+		running        bool
+		ignoreShutdown bool
+		timeout        time.Duration
+	}{
+		{false, false, DefaultStopTimeout},
+		{true, false, DefaultStopTimeout},
+		//without timeout the container is killed right away
+		{true, true, 0},
+		//a container that does not shut down is killed
+		{true, true, time.Second},
+	}
+
+	_, restore := useFakeBackend(t, "2.1.1")
+	defer restore()
+
+	for _, test := range tests {
+		c := createFakeContainer(t, "target")
+		if test.running {
+			c.Start()
+		}
+		c.(*FakeContainer).IgnoreShutdown = test.ignoreShutdown
+
+		err := StopContainerSync(&LMTargetContainer{Name: "target", Container: c}, test.timeout)
+		if err != nil {
+			t.Errorf("%+v: StopContainerSync() failed: %v", test, err)
+		}
+		if c.State() != lxc.STOPPED {
+			t.Errorf("%+v: the container is %s after StopContainerSync()", test, c.State())
+		}
+
+		if err = RemoveContainerSync("target"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRootfsDirs(t *testing.T) {
+	tests := []struct {
+		rootfs string
+		dirs   []string
+	}{
+		{"/var/lib/lxc/target/rootfs", []string{"/var/lib/lxc/target/rootfs"}},
+		{"dir:/var/lib/lxc/target/rootfs", []string{"/var/lib/lxc/target/rootfs"}},
+		{"btrfs:/var/lib/lxc/target/rootfs", []string{"/var/lib/lxc/target/rootfs"}},
+		//the upper directory of a overlay comes first
+		{"overlay:/var/lib/lxc/base/rootfs:/var/lib/lxc/target/delta0", []string{"/var/lib/lxc/target/delta0", "/var/lib/lxc/base/rootfs"}},
+		{"overlayfs:/var/lib/lxc/base/rootfs:/var/lib/lxc/target/delta0", []string{"/var/lib/lxc/target/delta0", "/var/lib/lxc/base/rootfs"}},
+	}
+
+	for _, test := range tests {
+		if dirs := RootfsDirs(test.rootfs); !reflect.DeepEqual(dirs, test.dirs) {
+			t.Errorf("RootfsDirs(%s) = %v, expected %v", test.rootfs, dirs, test.dirs)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LMConfigVersion is the version of the config-lm schema written by this version of the tools
+const LMConfigVersion = 2
+
+// ImageInfoFile is the file in the container directory the template records the image source in
+const ImageInfoFile = "image-info"
+
+// lmConfigMigrations upgrade a config-lm from the version of the index to the next one
+var lmConfigMigrations = []func(container *LMTargetContainer) error{
+	migrateLMConfigV0,
+	migrateLMConfigV1,
+}
+
+/*
+ReadKeyValueFile parses a file of key=value lines, empty lines and
+lines starting with # are ignored. Returns a empty map if the file does not exist.
+*/
+func ReadKeyValueFile(fileName string) (map[string]string, error) {
+	values := map[string]string{}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, line := range SplitLines(string(data)) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("Invalid line in %s: %s", fileName, line)
+		}
+		values[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	return values, nil
+}
+
+// migrateLMConfigV0 handles files written before config-lm was versioned
+func migrateLMConfigV0(container *LMTargetContainer) error {
+	//those targets always used the default user
+	if len(container.User.Name) == 0 {
+		container.User = DefaultContainerUser
+	}
+
+	containerDir := path.Dir(container.Container.ConfigFileName())
+
+	imageInfo, err := ReadKeyValueFile(path.Join(containerDir, ImageInfoFile))
+	if err != nil {
+		return err
+	}
+	container.ImageBuildId = imageInfo["build"]
+	container.ImageServer = imageInfo["server"]
+
+	//the tools are the links to the wrapper in the container directory
+	files, err := ioutil.ReadDir(containerDir)
+	if err != nil {
+		return err
+	}
+	container.Tools = []string{}
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(path.Join(containerDir, file.Name()))
+		if err == nil && path.Base(target) == "lmsdk-wrapper" {
+			container.Tools = append(container.Tools, file.Name())
+		}
+	}
+	sort.Strings(container.Tools)
+	return nil
+}
+
+/*
+migrateLMConfigV1 records the home mount, which is the rbind of a directory to the
+same path in the target that is not one of the other standard mounts. Targets
+without one get the current home mount on the next reconfigure.
+*/
+func migrateLMConfigV1(container *LMTargetContainer) error {
+	for _, entry := range container.Container.ConfigItem("lxc.mount.entry") {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 || len(fields[0]) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+
+		if entry = strings.Join(fields, " "); entry != HomeMountEntry(fields[0]) {
+			continue
+		}
+		shared := false
+		for _, sharedEntry := range sharedMountEntries {
+			shared = shared || entry == sharedEntry
+		}
+		if !shared {
+			container.HomeMount = entry
+			return nil
+		}
+	}
+	return nil
+}
+
+// migrateLMConfig upgrades the container settings to the current schema, returns true
+// if anything was changed
+func migrateLMConfig(container *LMTargetContainer) (bool, error) {
+	if container.ConfigVersion > LMConfigVersion {
+		return false, fmt.Errorf("The config-lm file of %s was written by a newer version of the SDK tools (version %d, supported %d)",
+			container.Name, container.ConfigVersion, LMConfigVersion)
+	}
+
+	migrated := false
+	for container.ConfigVersion < LMConfigVersion {
+		if err := lmConfigMigrations[container.ConfigVersion](container); err != nil {
+			return false, fmt.Errorf("Unable to migrate the config-lm file of %s: %v", container.Name, err)
+		}
+		container.ConfigVersion++
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// LMConfigError is returned if the config-lm file of a container is missing or can not be parsed
+type LMConfigError struct {
+	Container string
+	Err       error
+	//the file was written by a newer version of the tools and must not be replaced
+	Newer bool
+}
+
+func (e *LMConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// IsLMConfigError returns true if err is a LMConfigError
+func IsLMConfigError(err error) bool {
+	_, ok := err.(*LMConfigError)
+	return ok
+}
+
+func toLmContainer(c ContainerBackend) (*LMTargetContainer, error) {
+	if !c.Defined() {
+		return nil, fmt.Errorf("Container %s does not exist", c.Name())
+	}
+
+	//read config file
+	conf, err := ioutil.ReadFile(c.ConfigFileName() + "-lm")
+	if err != nil {
+		return nil, &LMConfigError{Container: c.Name(), Err: fmt.Errorf("Unable to read container config file: %s", err)}
+	}
+
+	lmContainer := LMTargetContainer{
+		Container: nil,
+	}
+
+	err = json.Unmarshal(conf, &lmContainer)
+	if err != nil {
+		return nil, &LMConfigError{Container: c.Name(), Err: fmt.Errorf("Unable to parse container config file: %s", err)}
+	}
+
+	lmContainer.Name = c.Name()
+	lmContainer.Container = c
+	lmContainer.storedVersion = lmContainer.ConfigVersion
+
+	//the migration happens in memory only, loading a target never writes to it,
+	//the file is upgraded by the next command changing the target or by autofix
+	if _, err = migrateLMConfig(&lmContainer); err != nil {
+		return nil, &LMConfigError{Container: c.Name(), Err: err, Newer: lmContainer.ConfigVersion > LMConfigVersion}
+	}
+	return &lmContainer, nil
+}
+
+// StoredConfigVersion returns the schema version of the config-lm file on disk, ConfigVersion
+// is the version of the loaded settings
+func (c *LMTargetContainer) StoredConfigVersion() int {
+	return c.storedVersion
+}
+
+// ConfigOutdated returns true if the config-lm file still uses an older schema than the loaded settings
+func (c *LMTargetContainer) ConfigOutdated() bool {
+	return c.storedVersion < LMConfigVersion
+}
+
+// WriteLMContainerConfig stores the target settings in the config-lm file next to the lxc config
+func WriteLMContainerConfig(container *LMTargetContainer) error {
+	container.ConfigVersion = LMConfigVersion
+
+	lmConfig, err := json.MarshalIndent(container, "  ", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshall config-lm file: %v", err.Error())
+	}
+
+	err = WriteFileAtomic(container.Container.ConfigFileName()+"-lm", lmConfig, 0664)
+	if err != nil {
+		return fmt.Errorf("Unable to write config-lm file: %v", err.Error())
+	}
+	container.storedVersion = container.ConfigVersion
+	return nil
+}
+
+// detectNetworkMode reads the network mode from the lines written by SetNetworkMode
+func detectNetworkMode(c ContainerBackend) string {
+	for _, key := range []string{"lxc.net.0.type", "lxc.network.type"} {
+		for _, value := range c.ConfigItem(key) {
+			switch value {
+			case "empty":
+				return NetworkModeNone
+			case "none":
+				return NetworkModeHostShared
+			}
+		}
+	}
+	return ""
+}
+
+// readOsRelease returns the ID and VERSION_ID of the os-release file in the rootfs
+func readOsRelease(c ContainerBackend) (string, string) {
+	for _, fileName := range []string{"etc/os-release", "usr/lib/os-release"} {
+		values, err := ReadKeyValueFile(rootfsFile(c, fileName))
+		if err == nil && len(values) > 0 {
+			return strings.Trim(values["ID"], "\"'"), strings.Trim(values["VERSION_ID"], "\"'")
+		}
+	}
+	return "", ""
+}
+
+/*
+RecoverLMContainer rebuilds the settings of a container whose config-lm file
+is missing or broken from the container directory. The user comes from the
+image metadata, the host architecture and network mode from the lxc config
+and the remaining settings are restored like for unversioned config-lm files.
+Distribution, version and build architecture are taken from the image-info
+file, targets created before the template recorded them fall back to the
+os-release file of the rootfs and have no build architecture, lxc.arch only
+holds the host architecture. Nothing is written.
+*/
+func RecoverLMContainer(c ContainerBackend) (*LMTargetContainer, error) {
+	if !c.Defined() {
+		return nil, fmt.Errorf("Container %s does not exist", c.Name())
+	}
+
+	container := LMTargetContainer{
+		Name:             c.Name(),
+		HostArchitecture: c.ConfigItem("lxc.arch")[0],
+		Network:          detectNetworkMode(c),
+		Container:        c,
+	}
+
+	containerDir := path.Dir(c.ConfigFileName())
+	imageUser, err := ReadImageUser(path.Join(containerDir, ImageUserFile))
+	if err != nil {
+		return nil, err
+	}
+	if imageUser != nil {
+		container.User = *imageUser
+	}
+
+	if info, err := os.Stat(c.ConfigFileName()); err == nil {
+		container.Created = info.ModTime()
+	}
+
+	if _, err = migrateLMConfig(&container); err != nil {
+		return nil, err
+	}
+
+	imageInfo, err := ReadKeyValueFile(path.Join(containerDir, ImageInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	container.Distribution = imageInfo["distribution"]
+	container.Version = imageInfo["version"]
+	container.Architecture = imageInfo["variant"]
+	if len(container.Distribution) == 0 || len(container.Version) == 0 {
+		container.Distribution, container.Version = readOsRelease(c)
+	}
+
+	//without any links the default tools are used
+	if len(container.Tools) == 0 {
+		container.Tools = nil
+	}
+	return &container, nil
+}
@@ -0,0 +1,542 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"gopkg.in/yaml.v2"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type manifestRepository struct {
+	Name       string `json:"name" yaml:"name"`
+	URL        string `json:"url,omitempty" yaml:"url,omitempty"`
+	Path       string `json:"path,omitempty" yaml:"path,omitempty"`
+	Priority   int    `json:"priority,omitempty" yaml:"priority,omitempty"`
+	NoGpgCheck bool   `json:"noGpgCheck,omitempty" yaml:"noGpgCheck,omitempty"`
+}
+
+type manifestMount struct {
+	Source   string `json:"source" yaml:"source"`
+	Target   string `json:"target,omitempty" yaml:"target,omitempty"`
+	ReadOnly bool   `json:"readOnly,omitempty" yaml:"readOnly,omitempty"`
+}
+
+type targetManifest struct {
+	Name              string               `json:"name" yaml:"name"`
+	Distribution      string               `json:"distribution" yaml:"distribution"`
+	Version           string               `json:"version" yaml:"version"`
+	HostArchitecture  string               `json:"hostArchitecture" yaml:"hostArchitecture"`
+	BuildArchitecture string               `json:"buildArchitecture" yaml:"buildArchitecture"`
+	Repositories      []manifestRepository `json:"repositories,omitempty" yaml:"repositories,omitempty"`
+	Packages          []string             `json:"packages,omitempty" yaml:"packages,omitempty"`
+	Mounts            []manifestMount      `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	Environment       map[string]string    `json:"environment,omitempty" yaml:"environment,omitempty"`
+	EnvPassthrough    []string             `json:"envPassthrough,omitempty" yaml:"envPassthrough,omitempty"`
+	Network           string               `json:"network,omitempty" yaml:"network,omitempty"`
+}
+
+var repoNameRegex = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+var packageNameRegex = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_.+-]*$")
+
+// loadManifest reads a manifest, files ending in .json are parsed as JSON, everything else as YAML
+func loadManifest(fileName string) (*targetManifest, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read manifest: %v", err)
+	}
+
+	manifest := targetManifest{}
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		err = json.Unmarshal(data, &manifest)
+	} else {
+		err = yaml.Unmarshal(data, &manifest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest %s: %v", fileName, err)
+	}
+
+	if err = manifest.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s: %v", fileName, err)
+	}
+	return &manifest, nil
+}
+
+func (m *targetManifest) validate() error {
+	required := map[string]string{
+		"name":              m.Name,
+		"distribution":      m.Distribution,
+		"version":           m.Version,
+		"hostArchitecture":  m.HostArchitecture,
+		"buildArchitecture": m.BuildArchitecture,
+	}
+	for key, value := range required {
+		if len(value) == 0 {
+			return fmt.Errorf("%s is required", key)
+		}
+	}
+
+	for _, repo := range m.Repositories {
+		if !repoNameRegex.MatchString(repo.Name) {
+			return fmt.Errorf("Invalid repository name: '%s'", repo.Name)
+		}
+		if (len(repo.URL) == 0) == (len(repo.Path) == 0) {
+			return fmt.Errorf("Repository %s needs either a url or a path", repo.Name)
+		}
+	}
+
+	for _, pkg := range m.Packages {
+		if !packageNameRegex.MatchString(pkg) {
+			return fmt.Errorf("Invalid package name: '%s'", pkg)
+		}
+	}
+
+	for _, mount := range m.Mounts {
+		if len(mount.Source) == 0 {
+			return fmt.Errorf("Mount source is required")
+		}
+	}
+
+	for key := range m.Environment {
+		if !lm_sdk_tools.IsValidEnvName(key) {
+			return fmt.Errorf("Invalid environment variable name: '%s'", key)
+		}
+	}
+
+	for _, pattern := range m.EnvPassthrough {
+		if err := lm_sdk_tools.CheckEnvPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	if len(m.Network) > 0 {
+		if err := lm_sdk_tools.CheckNetworkMode(m.Network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountEntries converts the manifest mounts into lxc.mount.entry values
+func (m *targetManifest) mountEntries() ([]string, error) {
+	currUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, mount := range m.Mounts {
+		source := mount.Source
+		if strings.HasPrefix(source, "~/") {
+			source = path.Join(currUser.HomeDir, source[2:])
+		}
+		if !path.IsAbs(source) {
+			return nil, fmt.Errorf("Mount source %s is not a absolute path", mount.Source)
+		}
+		source = path.Clean(source)
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, fmt.Errorf("Mount source %s does not exist", source)
+		}
+
+		target := source
+		if len(mount.Target) > 0 {
+			target = mount.Target
+		}
+		if !path.IsAbs(target) {
+			return nil, fmt.Errorf("Mount target %s is not a absolute path", target)
+		}
+
+		options := "rbind,create=dir"
+		if !info.IsDir() {
+			options = "bind,create=file"
+		}
+		if mount.ReadOnly {
+			options += ",ro"
+		}
+
+		entries = append(entries, fmt.Sprintf("%s %s none %s 0 0", source, path.Clean(target)[1:], options))
+	}
+	return entries, nil
+}
+
+type applyCmd struct {
+}
+
+func (c *applyCmd) usage() string {
+	return `Creates or updates a target as described in a manifest.
+
+If the target does not exist it is created, otherwise it is changed to
+match the manifest. Repositories, packages and mounts are only added,
+the environment and the list of host variables passed through to the
+target are replaced by the ones of the manifest.
+
+Manifests are YAML files, or JSON files if the name ends with .json:
+
+  name: autoos-team
+  distribution: link-motion-autoos
+  version: "0.30"
+  hostArchitecture: i686
+  buildArchitecture: i686
+  repositories:
+    - name: team
+      url: http://repo.example.com/team
+      priority: 50
+    - name: local
+      path: ~/rpms
+  packages: [cmake, gdb]
+  mounts:
+    - source: ~/src
+      target: /src
+      readOnly: false
+  environment:
+    QT_SELECT: qt5
+  envPassthrough: [http_proxy, https_proxy, "CCACHE_*"]
+  network: bridged
+
+Repositories with a path are only used while installing the packages.
+The network mode is only changed if the manifest has one.
+
+lmsdk-target apply manifest`
+}
+
+func (c *applyCmd) flags() {
+}
+
+func (c *applyCmd) run(args []string) error {
+	if len(args) < 1 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	manifest, err := loadManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	//check the mounts before anything is created
+	mounts, err := manifest.mountEntries()
+	if err != nil {
+		return err
+	}
+
+	lxcContainer, err := lm_sdk_tools.NewContainer(manifest.Name)
+	if err != nil {
+		return fmt.Errorf("ERROR: %s", err.Error())
+	}
+
+	if !lxcContainer.Defined() {
+		fmt.Printf("Creating target %s...\n", manifest.Name)
+		create := createCmd{
+			name:              manifest.Name,
+			distro:            manifest.Distribution,
+			version:           manifest.Version,
+			hostArchitecture:  manifest.HostArchitecture,
+			buildArchitecture: manifest.BuildArchitecture,
+			networkMode:       manifest.Network,
+		}
+		if len(create.networkMode) == 0 {
+			create.networkMode = lm_sdk_tools.NetworkModeBridged
+		}
+		if err = create.run([]string{}); err != nil {
+			return err
+		}
+	}
+
+	container, err := lm_sdk_tools.LoadLMContainer(manifest.Name)
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	if container.Distribution != manifest.Distribution || container.Version != manifest.Version ||
+		container.Architecture != manifest.BuildArchitecture {
+		return fmt.Errorf("Target %s was created from %s %s (%s), the manifest requires %s %s (%s). Please destroy the target first.",
+			container.Name, container.Distribution, container.Version, container.Architecture,
+			manifest.Distribution, manifest.Version, manifest.BuildArchitecture)
+	}
+
+	if err = c.applyMounts(container, mounts); err != nil {
+		return err
+	}
+
+	if err = c.applyEnvironment(container, manifest.Environment, manifest.EnvPassthrough); err != nil {
+		return err
+	}
+
+	if err = c.applyNetworkMode(container, manifest.Network); err != nil {
+		return err
+	}
+
+	//zypper needs a running container
+	if err = lm_sdk_tools.BootContainerSync(container); err != nil {
+		return fmt.Errorf("Could not start the Container: %v", err)
+	}
+
+	if err = c.applyRepositories(container, manifest.Repositories); err != nil {
+		return err
+	}
+
+	if err = c.applyPackages(container, manifest); err != nil {
+		return err
+	}
+
+	fmt.Printf("Target %s is up to date.\n", container.Name)
+	return nil
+}
+
+// applyMounts adds the missing mounts, entries with the same target but other options are replaced
+func (c *applyCmd) applyMounts(container *lm_sdk_tools.LMTargetContainer, mounts []string) error {
+	mountTarget := func(entry string) string {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			return ""
+		}
+		return fields[1]
+	}
+
+	wanted := map[string]string{}
+	for _, entry := range mounts {
+		wanted[mountTarget(entry)] = entry
+	}
+
+	current := []string{}
+	for _, entry := range container.Container.ConfigItem("lxc.mount.entry") {
+		if len(entry) > 0 {
+			current = append(current, entry)
+		}
+	}
+
+	updated := []string{}
+	for _, entry := range current {
+		if wantedEntry, ok := wanted[mountTarget(entry)]; ok && wantedEntry != entry {
+			continue
+		}
+		updated = append(updated, entry)
+	}
+	for _, entry := range mounts {
+		found := false
+		for _, existing := range updated {
+			if existing == entry {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Printf("Adding mount %s\n", entry)
+			updated = append(updated, entry)
+		}
+	}
+
+	if reflect.DeepEqual(current, updated) {
+		return nil
+	}
+
+	//mounts are only applied on the next start
+	if container.Container.State() != lxc.STOPPED {
+		fmt.Printf("Stopping container...\n")
+		if err := lm_sdk_tools.StopContainerSync(container, lm_sdk_tools.DefaultStopTimeout); err != nil {
+			return fmt.Errorf("Failed to stop the container: %v", err)
+		}
+	}
+
+	edit, err := lm_sdk_tools.LoadConfigEdit(container.Container.ConfigFileName())
+	if err != nil {
+		return err
+	}
+	edit.Set("lxc.mount.entry", updated...)
+	if _, err := edit.Apply(container.Container); err != nil {
+		return fmt.Errorf("Unable to update the mounts: %v", err)
+	}
+	return nil
+}
+
+func (c *applyCmd) applyEnvironment(container *lm_sdk_tools.LMTargetContainer, environment map[string]string, passthrough []string) error {
+	if len(environment) == 0 {
+		environment = nil
+	}
+	if len(passthrough) == 0 {
+		passthrough = nil
+	}
+	if reflect.DeepEqual(container.Environment, environment) && reflect.DeepEqual(container.EnvPassthrough, passthrough) {
+		return nil
+	}
+
+	fmt.Printf("Updating the target environment\n")
+	container.Environment = environment
+	container.EnvPassthrough = passthrough
+	return lm_sdk_tools.WriteLMContainerConfig(container)
+}
+
+// applyNetworkMode switches the network mode, if the manifest has one
+func (c *applyCmd) applyNetworkMode(container *lm_sdk_tools.LMTargetContainer, mode string) error {
+	if len(mode) == 0 || container.NetworkMode() == mode {
+		return nil
+	}
+
+	if container.Container.State() != lxc.STOPPED {
+		fmt.Printf("Stopping container...\n")
+		if err := lm_sdk_tools.StopContainerSync(container, lm_sdk_tools.DefaultStopTimeout); err != nil {
+			return fmt.Errorf("Failed to stop the container: %v", err)
+		}
+	}
+
+	fmt.Printf("Changing the network mode to %s\n", mode)
+	if err := lm_sdk_tools.SetNetworkMode(container, mode); err != nil {
+		return err
+	}
+	return lm_sdk_tools.WriteLMContainerConfig(container)
+}
+
+type zypperRepoList struct {
+	Repos []struct {
+		Alias    string `xml:"alias,attr"`
+		Priority int    `xml:"priority,attr"`
+		URL      string `xml:"url"`
+	} `xml:"repo-list>repo"`
+}
+
+// applyRepositories adds the url repositories, existing ones are only replaced if they differ
+func (c *applyCmd) applyRepositories(container *lm_sdk_tools.LMTargetContainer, repositories []manifestRepository) error {
+	output, exitCode, err := lm_sdk_tools.RunInContainerOuput(container, true, []string{}, "zypper --non-interactive -x lr")
+	if err != nil || exitCode != 0 {
+		return fmt.Errorf("Failed to query the zypper repositories: %v %s", err, output[1])
+	}
+
+	repoList := zypperRepoList{}
+	if err = xml.Unmarshal([]byte(output[0]), &repoList); err != nil {
+		return fmt.Errorf("Unable to parse the zypper repositories: %v", err)
+	}
+
+	for _, repo := range repositories {
+		if len(repo.URL) == 0 {
+			continue
+		}
+
+		priority := repo.Priority
+		if priority == 0 {
+			priority = 99
+		}
+
+		exists := false
+		upToDate := false
+		for _, existing := range repoList.Repos {
+			if existing.Alias == repo.Name {
+				exists = true
+				upToDate = strings.TrimSuffix(existing.URL, "/") == strings.TrimSuffix(repo.URL, "/") &&
+					existing.Priority == priority
+				break
+			}
+		}
+		if upToDate {
+			continue
+		}
+
+		if exists {
+			if err = lm_sdk_tools.RemoveZypperRepository(repo.Name, container); err != nil {
+				return err
+			}
+		}
+
+		command := "zypper --non-interactive ar -f -p " + strconv.Itoa(priority)
+		if repo.NoGpgCheck {
+			command += " -G"
+		}
+		command += " " + lm_sdk_tools.QuoteString(repo.URL) + " " + repo.Name
+
+		exitCode, err = lm_sdk_tools.RunInContainer(container, true, []string{}, command, os.Stdout.Fd(), os.Stderr.Fd())
+		if err != nil || exitCode != 0 {
+			return fmt.Errorf("Failed to add repository %s", repo.Name)
+		}
+	}
+	return nil
+}
+
+// applyPackages installs the packages that are not installed yet
+func (c *applyCmd) applyPackages(container *lm_sdk_tools.LMTargetContainer, manifest *targetManifest) error {
+	if len(manifest.Packages) == 0 {
+		return nil
+	}
+
+	command := "rpm -q"
+	for _, pkg := range manifest.Packages {
+		command += " " + lm_sdk_tools.QuoteString(pkg)
+	}
+
+	output, _, err := lm_sdk_tools.RunInContainerOuput(container, true, []string{}, command)
+	if err != nil {
+		return fmt.Errorf("Failed to query the installed packages: %v", err)
+	}
+
+	missing := []string{}
+	for _, line := range lm_sdk_tools.SplitLines(output[0]) {
+		var pkg string
+		if n, _ := fmt.Sscanf(line, "package %s is not installed", &pkg); n == 1 {
+			missing = append(missing, pkg)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	//local repositories are only available while installing
+	for _, repo := range manifest.Repositories {
+		if len(repo.Path) == 0 {
+			continue
+		}
+
+		priority := repo.Priority
+		if priority == 0 {
+			priority = 20
+		}
+
+		sourceDir := repo.Path
+		if strings.HasPrefix(sourceDir, "~/") {
+			if currUser, err := user.Current(); err == nil {
+				sourceDir = path.Join(currUser.HomeDir, sourceDir[2:])
+			}
+		}
+
+		err, repoDir := lm_sdk_tools.AddZypperRepository(sourceDir, repo.Name, priority, false, container)
+		defer func(name string) {
+			lm_sdk_tools.RemoveZypperRepository(name, container)
+			os.RemoveAll(repoDir)
+		}(repo.Name)
+		if err != nil {
+			fmt.Printf("Adding repository failed: %v\n", err)
+			return err
+		}
+	}
+
+	install := rpmInstall{noninteractive: true}
+	return install.run(append([]string{container.Name}, missing...))
+}
@@ -18,35 +18,402 @@
  */
 package main
 
-import "link-motion.com/lm-toolchain-sdk-tools/fixables"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 
-var fixable_set = []fixables.Fixable{
-	&fixables.DevicesFixable{},
-	fixables.NewToolsFixable(),
-	/*
-	   &fixables.ContainerAccess{},
-	   &fixables.DRIFixable{},
-	   &fixables.NvidiaFixable{},
-	*/
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+	"link-motion.com/lm-toolchain-sdk-tools/fixables"
+)
+
+var fixable_set = fixables.All()
+
+type fixableResult struct {
+	fixable fixables.Fixable
+	err     error
 }
 
 type autofixCmd struct {
+	list bool
+	only string
+	yes  bool
+	//set by the elevated helper run, the results are written there instead of printed
+	resultsFile string
 }
 
+// elevatedEnvVars are passed to the elevated helper, sudo and pkexec drop them
+var elevatedEnvVars = []string{lm_sdk_tools.LmStorageEnvVar, lm_sdk_tools.LmImageServerEnvVar, "LXC_CACHE_PATH"}
+
 func (c *autofixCmd) usage() string {
-	return `Automatically fixes problems in the container backends.`
+	return `Automatically fixes problems in the container backends.
+
+All fixables are run, even if one of them fails. If a container is given
+only the per-container fixes are run for it.
+
+From the first fixable that needs root on, the fixables are run in order in
+a single call of lmsdk-target with sudo, or pkexec if there is no terminal.
+The fixables in there that do not need root run as the user again. The
+fixables run as root are listed and need to be confirmed first, unless -y
+is given.
+
+lmsdk-target autofix [-y] [--list] [--only NAME,...] [container]`
 }
 
 func (c *autofixCmd) flags() {
+	gnuflag.BoolVar(&c.list, "list", false, "List the available fixables")
+	gnuflag.StringVar(&c.only, "only", "", "Comma separated list of the fixables to run")
+	gnuflag.BoolVar(&c.yes, "y", false, "Run the fixables that need root without asking")
+	gnuflag.StringVar(&c.resultsFile, "results", "", "Internal: write the results of the elevated run to this file")
 }
 
-func (c *autofixCmd) run(args []string) error {
+// selectedFixables returns the fixables given with --only, or all of them
+func (c *autofixCmd) selectedFixables() ([]fixables.Fixable, error) {
+	if len(c.only) == 0 {
+		return fixable_set, nil
+	}
+	return fixables.Lookup(strings.Split(c.only, ","))
+}
 
+func (c *autofixCmd) printList() error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "NAME\tROOT\tDESCRIPTION\n")
 	for _, fixable := range fixable_set {
-		err := fixable.Fix()
-		if err != nil {
-			return err
+		needsRoot := "no"
+		if fixable.NeedsRoot() {
+			needsRoot = "yes"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", fixable.Name(), needsRoot, fixable.Description())
+	}
+	return writer.Flush()
+}
+
+// printResults shows the outcome of every fixable, returns a error if any failed
+func printResults(results []fixableResult) error {
+	failed := 0
+	fmt.Println("\nResults:")
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			fmt.Fprintf(writer, "  %s\tFAILED\t%v\n", result.fixable.Name(), result.err)
+		} else {
+			fmt.Fprintf(writer, "  %s\tOK\t\n", result.fixable.Name())
+		}
+	}
+	writer.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d fixables failed", failed, len(results))
+	}
+	return nil
+}
+
+// runFixables runs the fixables in order, on the given container or on all targets
+func runFixables(selected []fixables.Fixable, args []string) []fixableResult {
+	results := []fixableResult{}
+	for _, fixable := range selected {
+		var err error
+		if len(args) > 0 {
+			err = fixable.FixContainer(args[0])
+		} else {
+			err = fixable.Fix()
+		}
+		results = append(results, fixableResult{fixable: fixable, err: err})
+	}
+	return results
+}
+
+// writeResults stores the results of the elevated run for the calling autofix
+func writeResults(fileName string, results []fixableResult) error {
+	errors := map[string]string{}
+	for _, result := range results {
+		errors[result.fixable.Name()] = ""
+		if result.err != nil {
+			errors[result.fixable.Name()] = result.err.Error()
+		}
+	}
+
+	data, err := json.Marshal(errors)
+	if err != nil {
+		return err
+	}
+
+	//the file must not exist yet, root never follows a symlink placed there
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to create the results file: %v", err)
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// elevationCommand returns the command to run a program as root, sudo needs a terminal to ask for the password
+func elevationCommand() ([]string, error) {
+	sudo, sudoErr := exec.LookPath("sudo")
+	pkexec, pkexecErr := exec.LookPath("pkexec")
+
+	info, err := os.Stdin.Stat()
+	hasTerminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	if sudoErr == nil && (hasTerminal || pkexecErr != nil) {
+		return []string{sudo}, nil
+	}
+	if pkexecErr == nil {
+		return []string{pkexec}, nil
+	}
+	return nil, fmt.Errorf("Neither sudo nor pkexec was found, please run lmsdk-target autofix with sudo")
+}
+
+/*
+runElevated runs the fixables in one call of lmsdk-target autofix as root,
+the ones that do not need root are passed back to the user from there. The
+user confirms the list of fixables once, the elevated call creates a file
+with the result of every fixable in a private temporary directory.
+*/
+func (c *autofixCmd) runElevated(selected []fixables.Fixable, args []string) []fixableResult {
+	failAll := func(err error) []fixableResult {
+		results := []fixableResult{}
+		for _, fixable := range selected {
+			results = append(results, fixableResult{fixable: fixable, err: err})
 		}
+		return results
+	}
+
+	elevation, err := elevationCommand()
+	if err != nil {
+		return failAll(err)
+	}
+
+	names := []string{}
+	userNames := []string{}
+	fmt.Printf("\nThe following fixables need root and are run with %s:\n", elevation[0])
+	for _, fixable := range selected {
+		names = append(names, fixable.Name())
+		if fixable.NeedsRoot() {
+			fmt.Printf("  %s: %s\n", fixable.Name(), fixable.Description())
+		} else {
+			userNames = append(userNames, fixable.Name())
+		}
+	}
+	if len(userNames) > 0 {
+		fmt.Printf("In between %s are run as the user.\n", strings.Join(userNames, ", "))
+	}
+	if !c.yes && !lm_sdk_tools.GetUserConfirmation("Run them as root?") {
+		return failAll(fmt.Errorf("Skipped, needs root"))
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return failAll(fmt.Errorf("Could not resolve the absolute pathname of the tool"))
+	}
+
+	//only the user can create files in the directory, the elevated call creates the results file
+	resultsDir, err := ioutil.TempDir("", "lmsdk-autofix")
+	if err != nil {
+		return failAll(err)
+	}
+	defer os.RemoveAll(resultsDir)
+	resultsFile := path.Join(resultsDir, "results")
+
+	cmdArgs := append(elevation[1:], "/usr/bin/env")
+	for _, envVar := range elevatedEnvVars {
+		if value := os.Getenv(envVar); len(value) > 0 {
+			cmdArgs = append(cmdArgs, envVar+"="+value)
+		}
+	}
+	cmdArgs = append(cmdArgs, self, "autofix", "--only", strings.Join(names, ","), "--results", resultsFile)
+	cmdArgs = append(cmdArgs, args...)
+
+	cmd := exec.Command(elevation[0], cmdArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	return readResults(resultsFile, selected, runErr, "root")
+}
+
+// readResults returns the results another call of autofix wrote, runAs is the user it ran as
+func readResults(fileName string, selected []fixables.Fixable, runErr error, runAs string) []fixableResult {
+	errors := map[string]string{}
+	if data, err := ioutil.ReadFile(fileName); err == nil {
+		json.Unmarshal(data, &errors)
+	}
+
+	results := []fixableResult{}
+	for _, fixable := range selected {
+		var err error
+		message, ok := errors[fixable.Name()]
+		switch {
+		case !ok && runErr != nil:
+			err = fmt.Errorf("Running as %s failed: %v", runAs, runErr)
+		case !ok:
+			err = fmt.Errorf("No result from the run as %s", runAs)
+		case len(message) > 0:
+			err = fmt.Errorf("%s", message)
+		}
+		results = append(results, fixableResult{fixable: fixable, err: err})
+	}
+	return results
+}
+
+// userCredential returns the ids and groups of the user
+func userCredential(lxcUser *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(lxcUser.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(lxcUser.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIds, err := lxcUser.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, groupId := range groupIds {
+		if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+/*
+runAsUser runs the fixables from a elevated autofix in a call of lmsdk-target
+autofix as the user sudo or pkexec was called by, so the files they write
+belong to the user.
+*/
+func runAsUser(selected []fixables.Fixable, args []string) []fixableResult {
+	failAll := func(err error) []fixableResult {
+		results := []fixableResult{}
+		for _, fixable := range selected {
+			results = append(results, fixableResult{fixable: fixable, err: err})
+		}
+		return results
+	}
+
+	lxcUser, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		return failAll(err)
+	}
+	credential, err := userCredential(lxcUser)
+	if err != nil {
+		return failAll(fmt.Errorf("Invalid ids of the user %s: %v", lxcUser.Username, err))
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return failAll(fmt.Errorf("Could not resolve the absolute pathname of the tool"))
+	}
+
+	resultsDir, err := ioutil.TempDir("", "lmsdk-autofix")
+	if err != nil {
+		return failAll(err)
+	}
+	defer os.RemoveAll(resultsDir)
+	if err = os.Lchown(resultsDir, int(credential.Uid), int(credential.Gid)); err != nil {
+		return failAll(err)
+	}
+	resultsFile := path.Join(resultsDir, "results")
+
+	names := []string{}
+	for _, fixable := range selected {
+		names = append(names, fixable.Name())
+	}
+	cmdArgs := append([]string{"autofix", "--only", strings.Join(names, ","), "--results", resultsFile}, args...)
+
+	cmd := exec.Command(self, cmdArgs...)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + lxcUser.HomeDir, "USER=" + lxcUser.Username, "LOGNAME=" + lxcUser.Username}
+	for _, envVar := range elevatedEnvVars {
+		if value := os.Getenv(envVar); len(value) > 0 {
+			cmd.Env = append(cmd.Env, envVar+"="+value)
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	return readResults(resultsFile, selected, runErr, lxcUser.Username)
+}
+
+// runAsRoot runs the fixables in order, the ones that do not need root run as the user
+func runAsRoot(selected []fixables.Fixable, args []string) []fixableResult {
+	results := []fixableResult{}
+	for len(selected) > 0 {
+		needsRoot := selected[0].NeedsRoot()
+		count := 1
+		for count < len(selected) && selected[count].NeedsRoot() == needsRoot {
+			count++
+		}
+
+		if needsRoot {
+			results = append(results, runFixables(selected[:count], args)...)
+		} else {
+			results = append(results, runAsUser(selected[:count], args)...)
+		}
+		selected = selected[count:]
+	}
+	return results
+}
+
+func (c *autofixCmd) run(args []string) error {
+	if c.list {
+		return c.printList()
+	}
+
+	selected, err := c.selectedFixables()
+	if err != nil {
+		return err
+	}
+
+	if len(c.resultsFile) > 0 {
+		if os.Getuid() == 0 {
+			return writeResults(c.resultsFile, runAsRoot(selected, args))
+		}
+		//the fixables the elevated run passes back to the user
+		for _, fixable := range selected {
+			if fixable.NeedsRoot() {
+				return fmt.Errorf("The fixable %s needs root", fixable.Name())
+			}
+		}
+		return writeResults(c.resultsFile, runFixables(selected, args))
+	}
+
+	if os.Getuid() == 0 {
+		return printResults(runAsRoot(selected, args))
+	}
+
+	//the fixables depend on the ones before them, e.g. idmap on subids and ownership
+	//on idmap, so everything from the first fixable that needs root on runs elevated
+	elevated := len(selected)
+	for i, fixable := range selected {
+		if fixable.NeedsRoot() {
+			elevated = i
+			break
+		}
+	}
+
+	results := runFixables(selected[:elevated], args)
+	if elevated < len(selected) {
+		results = append(results, c.runElevated(selected[elevated:], args)...)
 	}
 
 	/*
@@ -62,5 +429,5 @@ func (c *autofixCmd) run(args []string) error {
 	       }
 	   }
 	*/
-	return nil
+	return printResults(results)
 }
@@ -22,13 +22,9 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
 
 	"launchpad.net/gnuflag"
 
@@ -39,20 +35,40 @@ import (
 type autosetupCmd struct {
 	yes          bool
 	ignoreBridge bool
+	dryRun       bool
+	bridge       string
+	network      string
+	ipv6         string
 }
 
 func (c *autosetupCmd) usage() string {
 	return `Creates a default config for the container backend.
 
-lmsdk-target autosetup [-y] [-b]`
+With --dry-run the changes to all files, directories, services and
+containers are only shown. All changes are recorded, so they can be
+reverted with lmsdk-target teardown.
+
+Unless --network is given the first 10.0.x.0/24 network that does not
+conflict with the addresses and routes of the host is used. The bridge is
+reconfigured if any of --bridge, --network or --ipv6 is given.
+
+lmsdk-target autosetup [-y] [-b] [--dry-run] [--bridge NAME] [--network CIDR] [--ipv6 CIDR]`
 }
 
 func (c *autosetupCmd) flags() {
 	gnuflag.BoolVar(&c.yes, "y", false, "Assume yes to all questions.")
 	gnuflag.BoolVar(&c.ignoreBridge, "b", false, "Do not setup lxc bridge")
+	gnuflag.BoolVar(&c.dryRun, "dry-run", false, "Only show what would be changed")
+	gnuflag.StringVar(&c.bridge, "bridge", "", "Name of the lxc bridge, defaults to "+lm_sdk_tools.DefaultLxcBridge)
+	gnuflag.StringVar(&c.network, "network", "", "IPv4 network of the lxc bridge, e.g. 10.0.3.0/24")
+	gnuflag.StringVar(&c.ipv6, "ipv6", "", "Also enable IPv6 on the lxc bridge with the given network, e.g. fd42:1::/64")
 }
 
 func (c *autosetupCmd) run(args []string) error {
+	if c.dryRun {
+		return c.showChanges()
+	}
+
 	if os.Getuid() != 0 {
 		return fmt.Errorf("This command needs to run as root")
 	}
@@ -67,9 +83,15 @@ func (c *autosetupCmd) run(args []string) error {
 		return err
 	}
 
-	containers := lxc.Containers(lm_sdk_tools.LMTargetPath())
+	//every change is recorded, so lmsdk-target teardown can undo it
+	state, err := lm_sdk_tools.LoadHostSetupState()
+	if err != nil {
+		return err
+	}
+
+	containers := lm_sdk_tools.Containers()
 
-	stoppedContainers := []*lxc.Container{}
+	stoppedContainers := []lm_sdk_tools.ContainerBackend{}
 	//first let stop the containers
 	fmt.Println("Stopping containers:")
 	for _, container := range containers {
@@ -77,7 +99,7 @@ func (c *autosetupCmd) run(args []string) error {
 			fmt.Printf("Stopping %s .....", container.Name())
 			err := container.Stop()
 			if err != nil {
-				return fmt.Errorf("Could not stop container %s. error: %v.", container.Name, err)
+				return fmt.Errorf("Could not stop container %s. error: %v.", container.Name(), err)
 			}
 			stoppedContainers = append(stoppedContainers, container)
 			fmt.Print(" DONE\n")
@@ -87,26 +109,21 @@ func (c *autosetupCmd) run(args []string) error {
 
 	fmt.Printf("\nCreating default network bridge .....\n")
 
-	err = lm_sdk_tools.LxcBridgeConfigured()
-	if err != nil && !c.ignoreBridge {
-		subnet, err := c.detectSubnet()
-		if err != nil {
-			return err
-		}
-
-		err = c.editLXCBridgeFile(subnet)
-		if err != nil {
-			return err
+	settings, err := c.bridgeSettings()
+	if err != nil {
+		return err
+	}
+	if settings != nil {
+		fmt.Printf("Using bridge %s with network %s", settings.Name, settings.Network)
+		if settings.IPv6 != nil {
+			fmt.Printf(" and %s", settings.IPv6)
 		}
+		fmt.Println()
 
 		fmt.Println("\nRestarting services:")
-		cmd := exec.Command("bash", "-c", "systemctl enable lxc-net && systemctl restart lxc-net")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err != nil {
+		if err = lm_sdk_tools.ConfigureLxcBridge(state, settings); err != nil {
 			fmt.Println(" FAILED")
-			return fmt.Errorf("Restarting the LXC network service failed. error: %v", err)
+			return err
 		}
 
 		fmt.Println(" DONE")
@@ -115,25 +132,40 @@ func (c *autosetupCmd) run(args []string) error {
 	}
 
 	fmt.Printf("\nGenerating default ID mappings .....\n")
-	if _, _, err := lm_sdk_tools.GetOrCreateUidRange(true); err != nil {
+	err = state.RecordFileChange(lm_sdk_tools.SubUidFile, func() error {
+		_, err := lm_sdk_tools.GetOrCreateUidRange(true)
+		return err
+	})
+	if err != nil {
 		fmt.Println(" FAILED")
 		return fmt.Errorf("subUID setup failed with error: %v", err)
 	}
 
-	if _, _, err := lm_sdk_tools.GetOrCreateGuidRange(true); err != nil {
+	err = state.RecordFileChange(lm_sdk_tools.SubGidFile, func() error {
+		_, err := lm_sdk_tools.GetOrCreateGuidRange(true)
+		return err
+	})
+	if err != nil {
 		fmt.Println(" FAILED")
 		return fmt.Errorf("subGID setup failed with error: %v", err)
 	}
 	fmt.Println(" DONE")
 
 	fmt.Printf("\nGenerating lxc-usernet settings .....\n")
-	if err := lm_sdk_tools.EditLxcUsernet(); err != nil {
+	err = state.RecordFileChange(lm_sdk_tools.LxcUsernetFile, lm_sdk_tools.EditLxcUsernet)
+	if err != nil {
 		fmt.Println(" FAILED")
 		return fmt.Errorf("lxc-usernet setup failed with error: %v", err)
 	}
 	fmt.Println(" DONE")
 
 	fmt.Printf("Setting up directories .....\n")
+	if err := state.RecordDirectories(); err != nil {
+		return err
+	}
+	if err := state.Save(); err != nil {
+		return err
+	}
 	if err := lm_sdk_tools.EnsureRequiredDirectoriesExist(true); err != nil {
 		fmt.Println(" FAILED")
 		return fmt.Errorf("Directory setup failed with error: %v", err)
@@ -161,137 +193,121 @@ func (c *autosetupCmd) run(args []string) error {
 	return nil
 }
 
-func (c *autosetupCmd) detectSubnet() (string, error) {
-	used := make([]int, 0)
-
-	ipAddrOutput, err := exec.Command("ip", "addr", "show").CombinedOutput()
-	if err != nil {
-		return "", err
+/*
+bridgeSettings decides how the lxc bridge is configured. Returns nil if the
+bridge is already configured and no bridge option was given, or if the bridge
+setup is disabled.
+*/
+func (c *autosetupCmd) bridgeSettings() (*lm_sdk_tools.BridgeSettings, error) {
+	if c.ignoreBridge {
+		return nil, nil
 	}
 
-	for _, line := range strings.Split(string(ipAddrOutput), "\n") {
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" {
-			continue
-		}
-
-		columns := strings.Split(trimmed, " ")
-
-		if len(columns) < 2 {
-			return "", fmt.Errorf("invalid ip addr output line %s", line)
-		}
-
-		if columns[0] != "inet" {
-			continue
-		}
-
-		addr := columns[1]
-		if !strings.HasPrefix(addr, "10.0.") {
-			continue
-		}
-
-		tuples := strings.Split(addr, ".")
-		if len(tuples) < 4 {
-			return "", fmt.Errorf("invalid ip addr %s", addr)
-		}
-
-		subnet, err := strconv.Atoi(tuples[2])
-		if err != nil {
-			return "", err
-		}
-
-		used = append(used, subnet)
+	configured := lm_sdk_tools.LxcBridgeConfigured() == nil
+	if configured && len(c.bridge) == 0 && len(c.network) == 0 && len(c.ipv6) == 0 {
+		return nil, nil
 	}
+	return lm_sdk_tools.NewBridgeSettings(c.bridge, c.network, c.ipv6)
+}
 
-	curr := 1
-	for {
-		isUsed := false
-		for _, subnet := range used {
-			if subnet == curr {
-				isUsed = true
-				break
-			}
-		}
-		if !isUsed {
-			break
-		}
-
-		curr++
-		if curr > 254 {
-			return "", fmt.Errorf("No valid subnet available")
-		}
+// printFileDiff shows the changes to a file, returns true if there are any
+func printFileDiff(fileName string, content string, newContent string) bool {
+	diff := lm_sdk_tools.UnifiedDiff(fileName, fileName,
+		lm_sdk_tools.SplitLines(content), lm_sdk_tools.SplitLines(newContent))
+	if len(diff) == 0 {
+		return false
 	}
-
-	return fmt.Sprintf("%d", curr), nil
+	fmt.Print(diff)
+	return true
 }
 
-func (c *autosetupCmd) editLXCBridgeFile(subnet string) error {
-	buffer := bytes.Buffer{}
-
-	f, err := os.OpenFile(lm_sdk_tools.LxcBridgeFile, os.O_RDWR, 0644)
+// showChanges prints everything run would change, without changing anything
+func (c *autosetupCmd) showChanges() error {
+	lxcUser, err := lm_sdk_tools.LxcContainerUser()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	data, err := ioutil.ReadAll(f)
-	if err != nil {
-		return err
+	fmt.Println("Containers that would be stopped and started again:")
+	running := 0
+	for _, container := range lm_sdk_tools.Containers() {
+		if container.State() != lxc.STOPPED {
+			fmt.Printf("  %s\n", container.Name())
+			running++
+		}
 	}
-
-	input := string(data)
-	newValues := map[string]string{
-		"USE_LXC_BRIDGE": "true",
-		"LXC_BRIDGE":     "lxcbr0",
-		"LXC_ADDR":       fmt.Sprintf("10.0.%s.1", subnet),
-		"LXC_NETMASK":    "255.255.255.0",
-		"LXC_NETWORK":    fmt.Sprintf("10.0.%s.1/24", subnet),
-		"LXC_DHCP_RANGE": fmt.Sprintf("10.0.%s.2,10.0.%s.254", subnet, subnet),
-		"LXC_DHCP_MAX":   "253",
+	if running == 0 {
+		fmt.Println("  none")
 	}
 
-	found := map[string]bool{}
+	fmt.Println("\nFile changes:")
+	changed := false
 
-	for _, line := range strings.Split(input, "\n") {
-		out := line
+	services := []string{}
+	bridge := ""
+	settings, err := c.bridgeSettings()
+	if err != nil {
+		return err
+	}
+	if settings != nil {
+		content, newContent, err := lm_sdk_tools.PlanLxcBridgeFile(settings)
+		if err != nil {
+			return err
+		}
+		changed = printFileDiff(lm_sdk_tools.LxcBridgeFile, content, newContent) || changed
 
-		if !strings.HasPrefix(line, "#") {
-			for prefix, value := range newValues {
-				if strings.HasPrefix(line, prefix+"=") {
-					out = fmt.Sprintf(`%s="%s"`, prefix, value)
-					found[prefix] = true
-					break
-				}
-			}
+		content, newContent, err = lm_sdk_tools.PlanLxcDefaultConfig(settings)
+		if err != nil {
+			return err
 		}
+		changed = printFileDiff(lm_sdk_tools.LxcDefaultInclude, content, newContent) || changed
 
-		buffer.WriteString(out)
-		buffer.WriteString("\n")
+		services = append(services, "lxc-net (enable and restart)")
+		bridge = settings.Name
+	} else if bridgeConf, err := lm_sdk_tools.ReadLxcBridgeConfig(); err == nil {
+		bridge = bridgeConf["LXC_BRIDGE"]
 	}
 
-	for prefix, value := range newValues {
-		if !found[prefix] {
-			buffer.WriteString(prefix)
-			buffer.WriteString("=")
-			buffer.WriteString(value)
-			buffer.WriteString("\n")
-			found[prefix] = true // not necessary but keeps "found" logically consistent
+	for _, fileName := range []string{lm_sdk_tools.SubUidFile, lm_sdk_tools.SubGidFile} {
+		content, newContent, _, err := lm_sdk_tools.PlanSubIdRange(fileName, lxcUser, lm_sdk_tools.SubIdCount)
+		if err != nil {
+			return err
 		}
+		changed = printFileDiff(fileName, content, newContent) || changed
 	}
 
-	_, err = f.Seek(0, 0)
-	if err != nil {
-		return err
+	if len(bridge) > 0 {
+		content, newContent, err := lm_sdk_tools.PlanLxcUsernet(bridge)
+		if err != nil {
+			return err
+		}
+		changed = printFileDiff(lm_sdk_tools.LxcUsernetFile, content, newContent) || changed
+	} else {
+		fmt.Printf("%s can not be set up without a lxc bridge\n", lm_sdk_tools.LxcUsernetFile)
 	}
 
-	err = f.Truncate(0)
-	if err != nil {
-		return err
+	if !changed {
+		fmt.Println("  none")
 	}
 
-	_, err = f.WriteString(buffer.String())
+	fmt.Println("\nDirectory changes:")
+	dirChanges, err := lm_sdk_tools.PlanRequiredDirectories()
 	if err != nil {
 		return err
 	}
+	for _, change := range dirChanges {
+		fmt.Printf("  %s\n", change)
+	}
+	if len(dirChanges) == 0 {
+		fmt.Println("  none")
+	}
+
+	fmt.Println("\nServices that would be restarted:")
+	for _, service := range services {
+		fmt.Printf("  %s\n", service)
+	}
+	if len(services) == 0 {
+		fmt.Println("  none")
+	}
 	return nil
 }
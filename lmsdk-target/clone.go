@@ -0,0 +1,290 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+const btrfsSuperMagic = 0x9123683E
+
+type cloneCmd struct {
+	snapshot bool
+}
+
+func (c *cloneCmd) usage() string {
+	return `Creates a copy of a container.
+
+The clone is independent of the source. Where the storage supports it, it is
+a btrfs snapshot or a copy sharing the file data with the source until it is
+changed (reflink), otherwise a full copy.
+
+With --snapshot a overlayfs snapshot is tried first, which only stores the
+changes of the clone. It uses the rootfs of the source as lower layer,
+changes to the source, e.g. upgrades, break it.
+
+lmsdk-target clone [--snapshot] source destination`
+}
+
+func (c *cloneCmd) flags() {
+	gnuflag.BoolVar(&c.snapshot, "snapshot", false, "Create a overlayfs snapshot that depends on the source")
+}
+
+// cloneStrategy is one way of cloning a container
+type cloneStrategy struct {
+	name string
+	//overlayfs snapshots use the rootfs of the source as lower layer
+	usesSource bool
+	clone      func(source *lm_sdk_tools.LMTargetContainer, name string) error
+}
+
+// lxcClone returns a clone function using the lxc clone support
+func lxcClone(options lxc.CloneOptions) func(source *lm_sdk_tools.LMTargetContainer, name string) error {
+	return func(source *lm_sdk_tools.LMTargetContainer, name string) error {
+		return source.Container.Clone(name, options)
+	}
+}
+
+// cloneStrategies returns the ways to clone the source, in order of preference
+func (c *cloneCmd) cloneStrategies(source *lm_sdk_tools.LMTargetContainer) []cloneStrategy {
+	strategies := []cloneStrategy{}
+	if c.snapshot {
+		strategies = append(strategies, cloneStrategy{"overlayfs snapshot", true, lxcClone(lxc.CloneOptions{Backend: lxc.Overlayfs, Snapshot: true})})
+	}
+
+	rootfs := source.Container.ConfigItem(lm_sdk_tools.ConfigKey("lxc.rootfs.path"))[0]
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(lm_sdk_tools.LMTargetPath(), &stat); err == nil && stat.Type == btrfsSuperMagic && strings.HasPrefix(rootfs, "btrfs:") {
+		strategies = append(strategies, cloneStrategy{"btrfs snapshot", false, lxcClone(lxc.CloneOptions{Backend: lxc.Btrfs, Snapshot: true})})
+	}
+	if len(lm_sdk_tools.RootfsDirs(rootfs)) == 1 && reflinkSupported(lm_sdk_tools.LMTargetPath()) {
+		strategies = append(strategies, cloneStrategy{"reflink copy", false, reflinkClone})
+	}
+	return append(strategies, cloneStrategy{"full copy", false, lxcClone(lxc.CloneOptions{Backend: lxc.Directory})})
+}
+
+// reflinkSupported tries to reflink a file in dir, which works e.g. on btrfs and xfs
+func reflinkSupported(dir string) bool {
+	file, err := ioutil.TempFile(dir, ".reflink-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte{0})
+	file.Close()
+	if err != nil {
+		return false
+	}
+
+	copyName := file.Name() + ".copy"
+	defer os.Remove(copyName)
+	return exec.Command("cp", "--reflink=always", file.Name(), copyName).Run() == nil
+}
+
+// randomHwaddr returns a MAC address in the range lxc uses for containers
+func randomHwaddr() (string, error) {
+	bytes := make([]byte, 3)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("00:16:3e:%02x:%02x:%02x", bytes[0], bytes[1], bytes[2]), nil
+}
+
+/*
+reflinkClone copies the container directory, the rootfs with cp --reflink so
+the clone shares the file data with the source until one of them changes it.
+The rootfs is copied in a user namespace with the id mapping of the user, so
+the owners are kept. Paths to the source directory in the config are changed
+to the clone and the network interfaces get new MAC addresses, like lxc-copy does.
+*/
+func reflinkClone(source *lm_sdk_tools.LMTargetContainer, name string) error {
+	sourceDir := path.Dir(source.Container.ConfigFileName())
+	dir := path.Join(lm_sdk_tools.LMTargetPath(), name)
+	rootfs := lm_sdk_tools.RootfsDirs(source.Container.ConfigItem(lm_sdk_tools.ConfigKey("lxc.rootfs.path"))[0])[0]
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	//the user can not remove the files of the copied rootfs outside of the namespace
+	done := false
+	defer func() {
+		if !done {
+			lm_sdk_tools.RunInUserNamespace("rm", "-rf", dir)
+		}
+	}()
+
+	if err := lm_sdk_tools.RunInUserNamespace("cp", "-a", "--reflink=always", rootfs, path.Join(dir, "rootfs")); err != nil {
+		return fmt.Errorf("Copying the rootfs failed: %v", err)
+	}
+
+	//the files next to the rootfs belong to the user, the config-lm file and the tools are written by FinalizeContainer
+	files, err := ioutil.ReadDir(sourceDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), "config") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(sourceDir, file.Name()))
+		if err == nil {
+			err = ioutil.WriteFile(path.Join(dir, file.Name()), data, file.Mode().Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sourceConfig, err := lm_sdk_tools.LoadConfigEdit(source.Container.ConfigFileName())
+	if err != nil {
+		return err
+	}
+	edit, err := lm_sdk_tools.NewConfigEdit(path.Join(dir, "config"))
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	hwaddrKeys := []string{}
+	for _, line := range sourceConfig.Lines() {
+		keyValue := strings.SplitN(line, "=", 2)
+		if key := strings.TrimSpace(keyValue[0]); len(keyValue) == 2 && strings.HasPrefix(key, "lxc.net") && strings.HasSuffix(key, ".hwaddr") {
+			hwaddrKeys = append(hwaddrKeys, key)
+		}
+		lines = append(lines, strings.Replace(line, sourceDir+"/", dir+"/", -1))
+	}
+	edit.ReplaceLines(lines)
+	edit.Set(lm_sdk_tools.ConfigKey("lxc.rootfs.path"), path.Join(dir, "rootfs"))
+	edit.Set(lm_sdk_tools.ConfigKey("lxc.uts.name"), name)
+	for _, key := range hwaddrKeys {
+		hwaddr, err := randomHwaddr()
+		if err != nil {
+			return err
+		}
+		edit.Set(key, hwaddr)
+	}
+	if _, err = edit.Commit(); err != nil {
+		return err
+	}
+	done = true
+	return nil
+}
+
+func (c *cloneCmd) run(args []string) error {
+	if len(args) < 2 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	source, err := lm_sdk_tools.LoadLMContainer(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	destination, err := lm_sdk_tools.NewContainer(args[1])
+	if err != nil {
+		return fmt.Errorf("ERROR: %s", err.Error())
+	}
+	//a failed attempt removes the directory, so it must not belong to something else
+	destinationDir := path.Join(lm_sdk_tools.LMTargetPath(), args[1])
+	if _, err := os.Stat(destinationDir); destination.Defined() || err == nil {
+		return fmt.Errorf("Container with requested name exists already")
+	}
+
+	if source.Container.State() != lxc.STOPPED {
+		fmt.Printf("Stopping container...\n")
+		if err := lm_sdk_tools.StopContainerSync(source, lm_sdk_tools.DefaultStopTimeout); err != nil {
+			return fmt.Errorf("Failed to stop the container: %v", err)
+		}
+
+		defer func() {
+			fmt.Printf("Starting container...\n")
+			if err := lm_sdk_tools.BootContainerSync(source); err != nil {
+				fmt.Printf("Failed to restart container: %v\n", err)
+			}
+		}()
+	}
+
+	var used cloneStrategy
+	for _, strategy := range c.cloneStrategies(source) {
+		used = strategy
+		fmt.Printf("Cloning %s to %s using a %s...\n", source.Name, args[1], strategy.name)
+		err = strategy.clone(source, args[1])
+		if err == nil {
+			break
+		}
+		fmt.Printf("Cloning failed: %v\n", err)
+
+		//the next attempt fails if parts of this one are left
+		if failed, newErr := lm_sdk_tools.NewContainer(args[1]); newErr == nil && failed.Defined() {
+			lm_sdk_tools.RemoveContainerSync(args[1])
+		}
+		os.RemoveAll(destinationDir)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not clone the container: %v", err)
+	}
+	if used.usesSource {
+		fmt.Printf("The clone uses the rootfs of %s, do not upgrade or change %s while the clone exists.\n", source.Name, source.Name)
+	}
+
+	clone, err := lm_sdk_tools.NewContainer(args[1])
+	if err != nil {
+		return fmt.Errorf("ERROR: %s", err.Error())
+	}
+
+	//lxc changes the hostname, make sure the config follows
+	utsKey := lm_sdk_tools.ConfigKey("lxc.uts.name")
+	if clone.ConfigItem(utsKey)[0] != clone.Name() {
+		edit, err := lm_sdk_tools.LoadConfigEdit(clone.ConfigFileName())
+		if err == nil {
+			edit.Set(utsKey, clone.Name())
+			_, err = edit.Apply(clone)
+		}
+		if err != nil {
+			lm_sdk_tools.RemoveContainerSync(clone.Name())
+			return fmt.Errorf("Could not set the hostname of the clone: %v", err)
+		}
+	}
+
+	lmContainer := *source
+	lmContainer.Name = clone.Name()
+	lmContainer.Container = clone
+	lmContainer.Created = time.Now()
+
+	if err = FinalizeContainer(&lmContainer); err != nil {
+		lm_sdk_tools.RemoveContainerSync(clone.Name())
+		return err
+	}
+	lm_sdk_tools.CheckContainerPermissions(&lmContainer)
+
+	fmt.Printf("Created container %s\n", clone.Name())
+	return nil
+}
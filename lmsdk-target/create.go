@@ -22,19 +22,16 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"regexp"
-	"strconv"
+	"strings"
 
 	"path"
-
-	"encoding/json"
-
-	"io/ioutil"
+	"path/filepath"
 
 	"time"
 
@@ -53,12 +50,28 @@ type createCmd struct {
 	createSupGroups   bool
 	enableUpdates     bool
 	keepOnError       bool
+	rootfsTarball     string
+	metaTarball       string
+	imageDir          string
+	networkMode       string
 }
 
 func (c *createCmd) usage() string {
 	return `Creates a new Link Motion SDK build target.
 
 lmsdk-target create -n NAME -d DISTRO -v VERSION -a ARCH -b TARGETARCH
+
+Instead of downloading the image from the image server, local image files
+can be used with either --rootfs FILE --meta FILE or --image-dir DIR, where
+DIR contains rootfs.tar.xz and meta.tar.xz.
+
+The default user of the container is read from the image metadata, it can
+be overridden per distribution in ~/.config/lm-sdk/container-users.json.
+
+The network mode is one of:
+  bridged      the network config of the image on the lxc bridge (default)
+  none         only a loopback device, for hermetic builds
+  host-shared  the network of the host, e.g. to reach hosts behind a VPN
 `
 }
 
@@ -74,6 +87,43 @@ func (c *createCmd) flags() {
 	gnuflag.StringVar(&c.name, "n", requiredString, "name of the container")
 	gnuflag.BoolVar(&c.createSupGroups, "g", false, "Also try to create the users supplementary groups")
 	gnuflag.BoolVar(&c.keepOnError, "keep-on-error", false, "Do not remove then container when creation fails")
+	gnuflag.StringVar(&c.rootfsTarball, "rootfs", "", "Local rootfs tarball to create the target from")
+	gnuflag.StringVar(&c.metaTarball, "meta", "", "Local meta tarball to create the target from")
+	gnuflag.StringVar(&c.imageDir, "image-dir", "", "Directory containing rootfs.tar.xz and meta.tar.xz")
+	gnuflag.StringVar(&c.networkMode, "network", lm_sdk_tools.NetworkModeBridged, "Network mode of the target: bridged, none or host-shared")
+}
+
+// localImage returns the absolute paths of the local image files, or empty strings
+// if the image should be downloaded
+func (c *createCmd) localImage() (string, string, error) {
+	if len(c.imageDir) > 0 {
+		if len(c.rootfsTarball) > 0 || len(c.metaTarball) > 0 {
+			return "", "", fmt.Errorf("--image-dir can not be combined with --rootfs or --meta")
+		}
+		c.rootfsTarball = path.Join(c.imageDir, "rootfs.tar.xz")
+		c.metaTarball = path.Join(c.imageDir, "meta.tar.xz")
+	}
+
+	if len(c.rootfsTarball) == 0 && len(c.metaTarball) == 0 {
+		return "", "", nil
+	}
+
+	if len(c.rootfsTarball) == 0 || len(c.metaTarball) == 0 {
+		return "", "", fmt.Errorf("Local images need both --rootfs and --meta")
+	}
+
+	files := []string{c.rootfsTarball, c.metaTarball}
+	for i, file := range files {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return "", "", err
+		}
+		if info, err := os.Stat(absPath); err != nil || !info.Mode().IsRegular() {
+			return "", "", fmt.Errorf("Image file %s does not exist", file)
+		}
+		files[i] = absPath
+	}
+	return files[0], files[1], nil
 }
 
 func (c *createCmd) run(args []string) error {
@@ -84,6 +134,15 @@ func (c *createCmd) run(args []string) error {
 		return fmt.Errorf("Missing arguments")
 	}
 
+	localRootfs, localMeta, err := c.localImage()
+	if err != nil {
+		return err
+	}
+
+	if err := lm_sdk_tools.CheckNetworkMode(c.networkMode); err != nil {
+		return err
+	}
+
 	if os.Getuid() != 0 {
 		//return fmt.Errorf("This command needs to run as root")
 	}
@@ -113,23 +172,21 @@ func (c *createCmd) run(args []string) error {
 	// lxc >= 2.1.0 has changed config file format in some cases
 	newFormat := lm_sdk_tools.LXCNewVersion()
 
-	container, err := lxc.NewContainer(c.name, lm_sdk_tools.LMTargetPath())
+	container, err := lm_sdk_tools.NewContainer(c.name)
 	if err != nil {
 		return fmt.Errorf("ERROR: %s", err.Error())
 	}
 
-	mapfile, err := c.GenerateDefaultConfigFile(c.distro, newFormat)
+	//the id mapping is written before the rootfs is unpacked, so the user of the image is needed first
+	containerUser, err := c.resolveImageUser(localMeta)
 	if err != nil {
-		return fmt.Errorf("ERROR: %s", err.Error())
+		fmt.Printf("Could not read the container user from the image metadata, it is checked again after the download: %v\n", err)
+		containerUser, err = lm_sdk_tools.ResolveContainerUser(c.distro, "")
 	}
-
-	err = container.LoadConfigFile(mapfile)
 	if err != nil {
 		return fmt.Errorf("ERROR: %s", err.Error())
 	}
 
-	container.SetVerbosity(lxc.Verbose)
-
 	template := "/opt/lm-sdk/bin/lxc-lm-download"
 	execname, err := os.Executable()
 	templateAlt := path.Join(path.Dir(execname), "lxc-lm-download")
@@ -140,59 +197,103 @@ func (c *createCmd) run(args []string) error {
 		return fmt.Errorf("The lxc-lm-download was not found on the system")
 	}
 
-	downloader := path.Join(path.Dir(template), "lmsdk-download")
-	if _, err := os.Stat(downloader); os.IsNotExist(err) {
-		return fmt.Errorf("The lmsdk-download tool was not found on the system")
-	}
-
 	// -d link-motion-autoos -a i686 -b i686 -v 0.30  -n autoos-x862
 
 	options := lxc.TemplateOptions{
 		Template:   template,
 		Release:    c.version,
 		Arch:       c.hostArchitecture,
-		FlushCache: true,
+		FlushCache: len(localRootfs) == 0,
 	}
 
 	options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--dist=%s", c.distro))
-	options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--downloader=%s", downloader))
 	options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--variant=%s", c.buildArchitecture))
 	options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--no-validate"))
 
-	if len(os.Getenv(lm_sdk_tools.LmImageServerEnvVar)) > 0 {
-		serverName := os.Getenv(lm_sdk_tools.LmImageServerEnvVar)
-		options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--server=%s", serverName))
+	if len(localRootfs) > 0 {
+		//the template unpacks and applies the local files like a cached image
+		fmt.Printf("Creating the target from %s and %s\n", localRootfs, localMeta)
+		options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--local-rootfs=%s", localRootfs))
+		options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--local-meta=%s", localMeta))
+	} else {
+		downloader := path.Join(path.Dir(template), "lmsdk-download")
+		if _, err := os.Stat(downloader); os.IsNotExist(err) {
+			return fmt.Errorf("The lmsdk-download tool was not found on the system")
+		}
+		options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--downloader=%s", downloader))
+
+		if len(os.Getenv(lm_sdk_tools.LmImageServerEnvVar)) > 0 {
+			serverName := os.Getenv(lm_sdk_tools.LmImageServerEnvVar)
+			options.ExtraArgs = append(options.ExtraArgs, fmt.Sprintf("--server=%s", serverName))
+		}
 	}
 
-	containerUserId, _, containerUserName, err := lm_sdk_tools.DistroToUserIds(c.distro)
-	if err != nil {
+	if err := c.createRootfs(container, containerUser, newFormat, options); err != nil {
+		if !c.keepOnError {
+			lm_sdk_tools.RemoveContainerSync(container.Name())
+		}
 		return err
 	}
 
-	if err := container.Create(options); err != nil {
+	//the rootfs was unpacked with the id mapping of the expected user, if the metadata
+	//could not be read before and the image uses another one the files are owned by the wrong ids
+	imageUser, err := lm_sdk_tools.ResolveContainerUser(c.distro, path.Join(containerDir, lm_sdk_tools.ImageUserFile))
+	if err == nil && imageUser != containerUser {
+		fmt.Printf("The image uses the container user %s (%d:%d), creating the target again with its id mapping\n",
+			imageUser.Name, imageUser.Uid, imageUser.Gid)
+		containerUser = imageUser
+		err = lm_sdk_tools.RemoveContainerSync(container.Name())
+		if err == nil {
+			container, err = lm_sdk_tools.NewContainer(c.name)
+		}
+		if err == nil {
+			//the first run cached the image
+			options.FlushCache = false
+			err = c.createRootfs(container, containerUser, newFormat, options)
+		}
+	}
+	if err != nil {
 		if !c.keepOnError {
 			lm_sdk_tools.RemoveContainerSync(container.Name())
 		}
-		return fmt.Errorf("ERROR1: %v", err.Error())
+		return fmt.Errorf("ERROR: %v", err.Error())
+	}
+
+	imageInfo, err := lm_sdk_tools.ReadKeyValueFile(path.Join(containerDir, lm_sdk_tools.ImageInfoFile))
+	if err != nil {
+		fmt.Printf("Could not read the image information: %v\n", err)
 	}
 
-	if err = c.registerUserInContainer(container, uint(containerUserId), containerUserName); err != nil {
+	lmContainer := lm_sdk_tools.LMTargetContainer{
+		Name:             c.name,
+		Architecture:     c.buildArchitecture,
+		HostArchitecture: c.hostArchitecture,
+		Version:          c.version,
+		Distribution:     c.distro,
+		ImageBuildId:     imageInfo["build"],
+		ImageServer:      imageInfo["server"],
+		Created:          time.Now(),
+		UpdatesEnabled:   false,
+		User:             containerUser,
+		Network:          c.networkMode,
+		Container:        container,
+	}
+
+	if err = lm_sdk_tools.SetNetworkMode(&lmContainer, c.networkMode); err != nil {
 		if !c.keepOnError {
 			lm_sdk_tools.RemoveContainerSync(container.Name())
 		}
-		return fmt.Errorf("ERROR2: %v", err.Error())
+		return fmt.Errorf("ERROR: %v", err.Error())
 	}
 
-	//everything worked out, as last write the config-lm file
-	lmContainer := lm_sdk_tools.LMTargetContainer{
-		Name:           c.name,
-		Architecture:   c.buildArchitecture,
-		Version:        c.version,
-		Distribution:   c.distro,
-		UpdatesEnabled: false,
-		Container:      container,
+	if err = c.registerUserInContainer(&lmContainer); err != nil {
+		if !c.keepOnError {
+			lm_sdk_tools.RemoveContainerSync(container.Name())
+		}
+		return fmt.Errorf("ERROR2: %v", err.Error())
 	}
 
+	//everything worked out, as last write the config-lm file
 	err = FinalizeContainer(&lmContainer)
 	if err != nil {
 		if !c.keepOnError {
@@ -204,7 +305,7 @@ func (c *createCmd) run(args []string) error {
 	return nil
 }
 
-func (c *createCmd) GenerateDefaultConfigFile(distro string, newFormat bool) (string, error) {
+func (c *createCmd) GenerateDefaultConfigFile(distro string, containerUser lm_sdk_tools.ContainerUser, newFormat bool) (string, error) {
 	confDir, err := lm_sdk_tools.ConfigPath()
 	if err != nil {
 		return "", err
@@ -214,74 +315,95 @@ func (c *createCmd) GenerateDefaultConfigFile(distro string, newFormat bool) (st
 
 	fmt.Printf("Creating config file %s, new format: %v\n", confFileName, newFormat)
 
-	confFile, err := os.Create(confFileName)
-	if err != nil {
-		return "", err
-	}
-
-	defer confFile.Close()
-	writer := bufio.NewWriter(confFile)
+	id_map_string := lm_sdk_tools.LXCConfigKey("lxc.idmap", newFormat)
 
-	currUser, err := user.Current()
+	idMap, err := lm_sdk_tools.DefaultIdMap(containerUser, id_map_string)
 	if err != nil {
 		return "", err
 	}
 
-	t_uid, err := strconv.ParseUint(currUser.Uid, 10, 32)
+	edit, err := lm_sdk_tools.NewConfigEdit(confFileName)
 	if err != nil {
 		return "", err
 	}
 
-	t_gid, err := strconv.ParseUint(currUser.Gid, 10, 32)
-	if err != nil {
-		return "", err
+	lines := []string{lm_sdk_tools.ConfigItem{Key: "lxc.include", Value: lm_sdk_tools.LxcDefaultInclude}.String()}
+	for _, item := range idMap {
+		lines = append(lines, item.String())
 	}
+	edit.ReplaceLines(lines)
 
-	containerUid, containerGid, _, err := lm_sdk_tools.DistroToUserIds(c.distro)
-	if err != nil {
+	if _, err = edit.Commit(); err != nil {
 		return "", err
 	}
 
-	uid := uint32(t_uid)
-	gid := uint32(t_gid)
+	return confFileName, nil
+}
 
-	firstUid, uidRange, err := lm_sdk_tools.GetOrCreateUidRange(false)
+/*
+resolveImageUser returns the container user for the image, the user metadata is
+read from the local meta tarball or downloaded from the image server like the
+template does it.
+*/
+func (c *createCmd) resolveImageUser(localMeta string) (lm_sdk_tools.ContainerUser, error) {
+	tempDir, err := ioutil.TempDir("", "lmsdk-meta")
 	if err != nil {
-		return "", err
+		return lm_sdk_tools.ContainerUser{}, err
 	}
+	defer os.RemoveAll(tempDir)
 
-	firstGid, gidRange, err := lm_sdk_tools.GetOrCreateGuidRange(false)
-	if err != nil {
-		return "", err
+	meta := localMeta
+	if len(meta) == 0 {
+		meta = path.Join(tempDir, "meta.tar.xz")
+		err = downloadImageMeta(defaultImageServer(), c.distro, c.version, c.hostArchitecture, c.buildArchitecture, meta)
+		if err != nil {
+			return lm_sdk_tools.ContainerUser{}, err
+		}
 	}
 
-	writer.WriteString("lxc.include = /etc/lxc/default.conf\n")
+	metaDir := path.Join(tempDir, "meta")
+	if err = os.Mkdir(metaDir, 0700); err != nil {
+		return lm_sdk_tools.ContainerUser{}, err
+	}
+	if out, err := exec.Command("tar", "-xJf", meta, "-C", metaDir).CombinedOutput(); err != nil {
+		return lm_sdk_tools.ContainerUser{}, fmt.Errorf("Invalid meta tarball %s: %s", meta, strings.TrimSpace(string(out)))
+	}
 
-	if containerUid >= firstUid && containerUid < (firstUid+uidRange) {
+	//the template prefers the file of the user mode
+	userFile := path.Join(metaDir, "user-user")
+	if _, err = os.Stat(userFile); err != nil {
+		userFile = path.Join(metaDir, "user")
+	}
+	return lm_sdk_tools.ResolveContainerUser(c.distro, userFile)
+}
 
+// createRootfs writes the config for the container user and runs the template
+func (c *createCmd) createRootfs(container lm_sdk_tools.ContainerBackend, containerUser lm_sdk_tools.ContainerUser, newFormat bool, options lxc.TemplateOptions) error {
+	mapfile, err := c.GenerateDefaultConfigFile(c.distro, containerUser, newFormat)
+	if err != nil {
+		return fmt.Errorf("ERROR: %s", err.Error())
 	}
 
-	id_map_string := "lxc.idmap"
-	if !newFormat {
-		id_map_string = "lxc.id_map"
+	err = container.LoadConfigFile(mapfile)
+	if err != nil {
+		return fmt.Errorf("ERROR: %s", err.Error())
 	}
-	//map the first uid and gid range before the current users id
-	writer.WriteString(fmt.Sprintf("%s = u 0 %d %d\n", id_map_string, firstUid, containerUid))
-	writer.WriteString(fmt.Sprintf("%s = g 0 %d %d\n", id_map_string, firstGid, containerGid))
 
-	//now the user ID is mapped 1:1
-	writer.WriteString(fmt.Sprintf("%s = u %d %d 1\n", id_map_string, containerUid, uid))
-	writer.WriteString(fmt.Sprintf("%s = g %d %d 1\n", id_map_string, containerGid, gid))
+	container.SetVerbosity(lxc.Verbose)
 
-	//and the rest
-	writer.WriteString(fmt.Sprintf("%s = u %d %d %d\n", id_map_string, containerUid+1, firstUid+containerUid+1, uidRange-containerUid-1))
-	writer.WriteString(fmt.Sprintf("%s = g %d %d %d\n", id_map_string, containerGid+1, firstGid+containerGid+1, gidRange-containerGid-1))
-	writer.Flush()
+	if err := container.Create(options); err != nil {
+		return fmt.Errorf("ERROR1: %v", err.Error())
+	}
 
-	return confFileName, nil
+	//images can still contain legacy keys, lxc-update-config is optional in the template
+	if _, err = lm_sdk_tools.UpgradeContainerConfig(container); err != nil {
+		return fmt.Errorf("ERROR: Unable to upgrade the container config: %v", err)
+	}
+	return nil
 }
 
-func (c *createCmd) registerUserInContainer(container *lxc.Container, containerUserId uint, containerUserName string) error {
+func (c *createCmd) registerUserInContainer(lmContainer *lm_sdk_tools.LMTargetContainer) error {
+	container, containerUser := lmContainer.Container, lmContainer.User
 
 	currUser, err := user.Current()
 	if err != nil {
@@ -317,25 +439,19 @@ func (c *createCmd) registerUserInContainer(container *lxc.Container, containerU
 		}
 	}
 
-	//add the home dir
-	homedir := pw.Dir
-	err = container.SetConfigItem("lxc.mount.entry", fmt.Sprintf("%s %s none rbind,create=dir 0 0", homedir, homedir[1:]))
-	if err != nil {
-		return err
-	}
-
-	err = container.SetConfigItem("lxc.mount.entry", "/tmp tmp none rbind,create=dir 0 0")
+	edit, err := lm_sdk_tools.LoadConfigEdit(container.ConfigFileName())
 	if err != nil {
 		return err
 	}
 
-	err = container.SetConfigItem("lxc.mount.entry", "/media media none rbind,create=dir 0 0")
-	if err != nil {
-		return err
+	//add the home dir, /tmp and /media
+	for _, entry := range lm_sdk_tools.StandardMountEntries(pw.Dir) {
+		edit.Append("lxc.mount.entry", entry)
 	}
+	//reconfigure replaces the home mount if the home directory changes
+	lmContainer.HomeMount = lm_sdk_tools.HomeMountEntry(pw.Dir)
 
-	err = container.SaveConfigFile(container.ConfigFileName())
-	if err != nil {
+	if _, err = edit.Apply(container); err != nil {
 		return err
 	}
 
@@ -413,34 +529,30 @@ func (c *createCmd) registerUserInContainer(container *lxc.Container, containerU
 	*/
 
 	command := []string{
-		"-P", lm_sdk_tools.LMTargetPath(), "-n", container.Name(), "--",
 		"sed", "-i",
-		fmt.Sprintf("s;/home/%s;/home/%s;", containerUserName, pw.LoginName),
+		fmt.Sprintf("s;/home/%s;/home/%s;", containerUser.Name, pw.LoginName),
 		"/etc/passwd",
 	}
 
-	cmd := exec.Command("lxc-attach", command...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+	exitCode, err := container.RunCommandStatus(command, lxc.DefaultAttachOptions)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Updating the home directory of %s failed", containerUser.Name)
+	}
+	return nil
 }
 
 // FinalizeContainer runs all lmsdk specific tasks after the container has been created
 func FinalizeContainer(container *lm_sdk_tools.LMTargetContainer) error {
-	tools := fixables.NewToolsFixable()
-	if err := tools.FixContainer(container.Container.Name()); err != nil {
-		return fmt.Errorf("Unable to fix container %v", err.Error())
+	if container.Tools == nil {
+		container.Tools = append([]string{}, fixables.DefaultTools...)
 	}
 
-	lmConfig, err := json.MarshalIndent(&container, "  ", "  ")
-	if err != nil {
-		return fmt.Errorf("Unable to marshall config-lm file: %v", err.Error())
-	}
-
-	err = ioutil.WriteFile(container.Container.ConfigFileName()+"-lm", lmConfig, 0664)
-	if err != nil {
-		return fmt.Errorf("Unable to write config-lm file: %v", err.Error())
+	tools := fixables.NewToolsFixable()
+	if err := tools.FixTarget(container); err != nil {
+		return fmt.Errorf("Unable to fix container %v", err.Error())
 	}
-	return nil
+	return lm_sdk_tools.WriteLMContainerConfig(container)
 }
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"link-motion.com/lm-toolchain-sdk-tools"
+	"link-motion.com/lm-toolchain-sdk-tools/fixables"
+)
+
+// installTemplate creates the lxc-lm-download template next to the test binary,
+// create only checks it exists, the FakeBackend does not run it
+func installTemplate(t *testing.T) func() {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := filepath.Join(filepath.Dir(self), "lxc-lm-download")
+	if err = ioutil.WriteFile(template, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Skipf("Unable to install the template: %v", err)
+	}
+	return func() {
+		os.Remove(template)
+	}
+}
+
+// createImage writes a local image without user metadata to dir
+func createImage(t *testing.T, dir string) {
+	metaDir := filepath.Join(dir, "meta")
+	os.Mkdir(metaDir, 0755)
+	ioutil.WriteFile(filepath.Join(metaDir, "config"), []byte("lxc.arch = x86_64\n"), 0644)
+	if out, err := exec.Command("tar", "-cJf", filepath.Join(dir, "meta.tar.xz"), "-C", metaDir, ".").CombinedOutput(); err != nil {
+		t.Fatalf("Creating the meta tarball failed: %s", out)
+	}
+	//the template is not run, the rootfs tarball only has to exist
+	ioutil.WriteFile(filepath.Join(dir, "rootfs.tar.xz"), nil, 0644)
+}
+
+func TestCreate(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("create does not register root in the target")
+	}
+
+	fake, restore := useFakeBackend(t)
+	defer restore()
+	defer installTemplate(t)()
+
+	//the distribution has no known container user
+	distro := "lmsdk-test"
+	idMap, err := lm_sdk_tools.DefaultIdMap(lm_sdk_tools.DefaultContainerUser, lm_sdk_tools.IdMapConfigKey())
+	if err != nil {
+		t.Skipf("The user can not map the container user: %v", err)
+	}
+	if configured, _ := lm_sdk_tools.ReadConfiguredUser(distro); configured != nil {
+		t.Skipf("A user is configured for %s in %s", distro, lm_sdk_tools.ContainerUsersFile)
+	}
+
+	configDir, err := lm_sdk_tools.ConfigPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(configDir, "lmsdk-"+distro+"-default.conf"))
+
+	imageDir, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(imageDir)
+	createImage(t, imageDir)
+
+	currUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := lm_sdk_tools.Getpwnam(currUser.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &createCmd{
+		buildArchitecture: "armv7hl",
+		hostArchitecture:  "amd64",
+		distro:            distro,
+		version:           "1.0",
+		name:              "target",
+		imageDir:          imageDir,
+		networkMode:       lm_sdk_tools.NetworkModeNone,
+	}
+	if err := cmd.run(nil); err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+
+	target, err := lm_sdk_tools.LoadLMContainer("target")
+	if err != nil {
+		t.Fatalf("Loading the created target failed: %v", err)
+	}
+	image := target.Distribution + " " + target.Version + " " + target.Architecture + " " + target.HostArchitecture
+	if image != distro+" 1.0 armv7hl amd64" || target.User != lm_sdk_tools.DefaultContainerUser || target.Network != lm_sdk_tools.NetworkModeNone {
+		t.Errorf("The created target is %+v", target)
+	}
+	if !reflect.DeepEqual(target.Tools, fixables.DefaultTools) || target.HomeMount != lm_sdk_tools.HomeMountEntry(pw.Dir) {
+		t.Errorf("The created target has the tools %v and the home mount %s", target.Tools, target.HomeMount)
+	}
+
+	c := fake.Container("target", lm_sdk_tools.LMTargetPath())
+	values := []string{}
+	for _, item := range idMap {
+		values = append(values, item.Value)
+	}
+	if mapped := c.ConfigItem(lm_sdk_tools.IdMapConfigKey()); !reflect.DeepEqual(mapped, values) {
+		t.Errorf("The target maps %v, expected %v", mapped, values)
+	}
+	mounts := c.ConfigItem("lxc.mount.entry")
+	if !reflect.DeepEqual(mounts, lm_sdk_tools.StandardMountEntries(pw.Dir)) {
+		t.Errorf("The target mounts %v", mounts)
+	}
+
+	//the target is started to move the home directory of the container user
+	if c.State() != lxc.RUNNING {
+		t.Errorf("The target is %v", c.State())
+	}
+	sed := []string{"sed", "-i", "s;/home/system;/home/" + pw.LoginName + ";", "/etc/passwd"}
+	if !reflect.DeepEqual(c.Commands, [][]string{sed}) {
+		t.Errorf("The commands run in the target were %v, expected %v", c.Commands, sed)
+	}
+
+	if _, err := os.Readlink(filepath.Join(filepath.Dir(c.ConfigFileName()), "gcc")); err != nil {
+		t.Errorf("The tools of the target are not linked: %v", err)
+	}
+
+	//the existing target is kept
+	if err := cmd.run(nil); err == nil {
+		t.Errorf("Creating the target again succeeded")
+	}
+	if _, err := lm_sdk_tools.LoadLMContainer("target"); err != nil || len(c.Commands) != 1 {
+		t.Errorf("Creating the target again changed it: %v, %v", err, c.Commands)
+	}
+}
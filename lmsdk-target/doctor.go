@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// minFreeDiskSpace is the space below LMTargetPath() we want to have for builds
+const minFreeDiskSpace = 5 * 1024 * 1024 * 1024
+
+type doctorResult struct {
+	Check   string `json:"check"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+type doctorCmd struct {
+	jsonOutput bool
+	results    []doctorResult
+}
+
+func (c *doctorCmd) usage() string {
+	return `Checks the whole host setup and shows how to fix the problems found.
+
+Unlike initialized all checks are run, the command fails if any check failed.
+
+lmsdk-target doctor [--json]`
+}
+
+func (c *doctorCmd) flags() {
+	gnuflag.BoolVar(&c.jsonOutput, "json", false, "Print the result as JSON")
+}
+
+// check runs a single check, on success fn returns a short description of what was found
+func (c *doctorCmd) check(name string, fix string, fn func() (string, error)) {
+	result := doctorResult{Check: name}
+
+	message, err := fn()
+	if err != nil {
+		result.Message = err.Error()
+		result.Fix = fix
+	} else {
+		result.Passed = true
+		result.Message = message
+	}
+	c.results = append(c.results, result)
+}
+
+func checkLxcTools() (string, error) {
+	missing := []string{}
+	for _, tool := range []string{"lxc-create", "lxc-attach", "lxc-usernsexec"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Not found in PATH: %s", strings.Join(missing, ", "))
+	}
+	return "lxc tools found", nil
+}
+
+func checkLxcVersion() (string, error) {
+	version, err := lm_sdk_tools.InstalledLXCVersion()
+	if err != nil {
+		return "", err
+	}
+	if version.Major < 2 {
+		return "", fmt.Errorf("lxc %s is too old, at least 2.0 is required", version)
+	}
+	if !version.AtLeast(lm_sdk_tools.NewConfigFormatVersion) {
+		return "lxc " + version.String() + ", using the legacy config format", nil
+	}
+	return "lxc " + version.String(), nil
+}
+
+func checkUserNamespaces() (string, error) {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return "", fmt.Errorf("The kernel does not support user namespaces")
+	}
+
+	//only exists on some distributions, e.g. Debian
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/unprivileged_userns_clone"); err == nil {
+		if strings.TrimSpace(string(data)) != "1" {
+			return "", fmt.Errorf("Unprivileged user namespaces are disabled")
+		}
+	}
+
+	if data, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil {
+		if strings.TrimSpace(string(data)) == "0" {
+			return "", fmt.Errorf("user.max_user_namespaces is 0")
+		}
+	}
+	return "User namespaces are enabled", nil
+}
+
+func checkCgroups() (string, error) {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+
+	mounted := false
+	for _, line := range lm_sdk_tools.SplitLines(string(mounts)) {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && (fields[2] == "cgroup" || fields[2] == "cgroup2") {
+			mounted = true
+			break
+		}
+	}
+	if !mounted {
+		return "", fmt.Errorf("No cgroup filesystem is mounted")
+	}
+
+	cgroups, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	//unprivileged containers need to be able to create cgroups below our own
+	notWritable := []string{}
+	for _, line := range lm_sdk_tools.SplitLines(string(cgroups)) {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 || len(fields[1]) == 0 || strings.HasPrefix(fields[1], "name=") {
+			continue
+		}
+
+		controller := strings.Split(fields[1], ",")[0]
+		cgroupDir := path.Join("/sys/fs/cgroup", fields[1], fields[2])
+		if _, err := os.Stat(cgroupDir); err != nil {
+			continue
+		}
+		//2 is W_OK
+		if syscall.Access(cgroupDir, 2) != nil {
+			notWritable = append(notWritable, controller)
+		}
+	}
+
+	if len(notWritable) > 0 {
+		return "", fmt.Errorf("The cgroups of the user are not writable: %s", strings.Join(notWritable, ", "))
+	}
+	return "cgroups are set up", nil
+}
+
+func checkSubIds() (string, error) {
+	idMap, err := lm_sdk_tools.DefaultIdMap(lm_sdk_tools.DefaultContainerUser, lm_sdk_tools.IdMapConfigKey())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d id mappings", len(idMap)), nil
+}
+
+func checkDiskSpace() (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(lm_sdk_tools.LMTargetPath(), &stat); err != nil {
+		return "", err
+	}
+
+	free := uint64(stat.Bavail) * uint64(stat.Bsize)
+	message := fmt.Sprintf("%.1f GiB free", float64(free)/(1024*1024*1024))
+	if free < minFreeDiskSpace {
+		return "", fmt.Errorf("Only %s in %s", message, lm_sdk_tools.LMTargetPath())
+	}
+	return message, nil
+}
+
+// checkTargets verifies every container in LMTargetPath()
+func (c *doctorCmd) checkTargets() {
+	for _, container := range lm_sdk_tools.Containers() {
+		name := container.Name()
+		checkName := "target " + name
+
+		target, err := lm_sdk_tools.LoadLMContainer(name)
+		if err != nil {
+			c.check(checkName, fmt.Sprintf("Recreate the target with lmsdk-target destroy %s and lmsdk-target create", name),
+				func() (string, error) { return "", err })
+			continue
+		}
+
+		c.check(checkName, fmt.Sprintf("Run lmsdk-target reconfigure %s", name), func() (string, error) {
+			rootfs, err := lm_sdk_tools.ContainerRootfs(name)
+			if err != nil {
+				return "", err
+			}
+			if _, err := os.Stat(rootfs); err != nil {
+				return "", fmt.Errorf("The rootfs %s does not exist", rootfs)
+			}
+
+			oldConfig, newConfig, err := lm_sdk_tools.GenerateContainerConfig(target)
+			if err != nil {
+				return "", err
+			}
+			if !reflect.DeepEqual(oldConfig, newConfig) {
+				return "", fmt.Errorf("The lxc config does not match the host setup")
+			}
+			return fmt.Sprintf("%s %s %s", target.Distribution, target.Version, target.Architecture), nil
+		})
+	}
+}
+
+func (c *doctorCmd) runChecks() {
+	const autosetupFix = "Run sudo lmsdk-target autosetup"
+
+	c.check("lxc tools", "Install the lxc package of your distribution", checkLxcTools)
+	c.check("lxc version", "Install lxc 2.0 or newer", checkLxcVersion)
+	c.check("user namespaces", "Enable them with sudo sysctl -w kernel.unprivileged_userns_clone=1", checkUserNamespaces)
+	c.check("cgroups", "Install libpam-cgfs or cgmanager and log in again", checkCgroups)
+	c.check("lxc bridge", autosetupFix, func() (string, error) {
+		if err := lm_sdk_tools.LxcBridgeConfigured(); err != nil {
+			return "", err
+		}
+		return "lxc bridge is configured", nil
+	})
+	c.check("subuid/subgid", autosetupFix, checkSubIds)
+	c.check("lxc usernet", autosetupFix, func() (string, error) {
+		if err := lm_sdk_tools.HasLxcUsernet(); err != nil {
+			return "", err
+		}
+		return "User has network interfaces", nil
+	})
+	c.check("directories", autosetupFix, func() (string, error) {
+		if err := lm_sdk_tools.EnsureRequiredDirectoriesExist(false); err != nil {
+			return "", err
+		}
+		return lm_sdk_tools.LMTargetPath(), nil
+	})
+
+	for _, fixable := range fixable_set {
+		c.check("fixable "+fixable.Name(), "Run lmsdk-target autofix --only "+fixable.Name(), func() (string, error) {
+			if err := fixable.Check(); err != nil {
+				return "", err
+			}
+			return "No problems found", nil
+		})
+	}
+
+	c.checkTargets()
+	c.check("disk space", "Free some space or move the targets to a bigger disk", checkDiskSpace)
+}
+
+func (c *doctorCmd) run(args []string) error {
+	if c.jsonOutput {
+		//the checks print their progress, which would break the JSON
+		stdout := os.Stdout
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = devNull
+			defer devNull.Close()
+		}
+		c.runChecks()
+		os.Stdout = stdout
+	} else {
+		c.runChecks()
+	}
+
+	failed := 0
+	for _, result := range c.results {
+		if !result.Passed {
+			failed++
+		}
+	}
+
+	if c.jsonOutput {
+		js, err := json.MarshalIndent(c.results, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("Could not marshal the result into a valid json string. error: %v.", err)
+		}
+		fmt.Printf("%s\n", js)
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(writer, "\nCHECK\tRESULT\tDETAILS\n")
+		for _, result := range c.results {
+			status := "PASS"
+			if !result.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", result.Check, status, result.Message)
+		}
+		writer.Flush()
+
+		if failed > 0 {
+			fmt.Printf("\nHow to fix the failed checks:\n")
+			for _, result := range c.results {
+				if !result.Passed {
+					fmt.Printf("  %s: %s\n", result.Check, result.Fix)
+				}
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(c.results))
+	}
+	return nil
+}
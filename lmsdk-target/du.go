@@ -0,0 +1,274 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+const (
+	duTarget   = "target"
+	duSnapshot = "snapshot"
+	duImage    = "image"
+	duBuildDir = "builddir"
+)
+
+type duEntry struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+	//some files could not be read, run with sudo to see everything
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type duResult struct {
+	Entries    []duEntry `json:"entries"`
+	Total      uint64    `json:"total"`
+	Incomplete bool      `json:"incomplete,omitempty"`
+}
+
+type duCmd struct {
+	jsonOutput bool
+	//inodes already counted, hardlinks and files shared by overlay snapshots are counted once
+	seen map[[2]uint64]bool
+}
+
+func (c *duCmd) usage() string {
+	return `Shows the disk space used by the targets, their snapshots, the cached
+images and the leftover rpmbuild directories.
+
+Files shared between entries are only counted for the first one. Files of
+the targets that can not be read by the user are missing, run with sudo to
+include them.
+
+lmsdk-target du [--json]`
+}
+
+func (c *duCmd) flags() {
+	gnuflag.BoolVar(&c.jsonOutput, "json", false, "Print the result as JSON")
+}
+
+// diskUsage sums up the allocated blocks below root, paths in skip are not entered
+func (c *duCmd) diskUsage(root string, skip map[string]bool) (uint64, bool) {
+	size := uint64(0)
+	incomplete := false
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			incomplete = true
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if skip[path] {
+			return filepath.SkipDir
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		key := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+		if !c.seen[key] {
+			c.seen[key] = true
+			size += uint64(stat.Blocks) * 512
+		}
+		return nil
+	})
+	return size, incomplete
+}
+
+// targetUsage returns the entries of all targets and their snapshots
+func (c *duCmd) targetUsage() []duEntry {
+	entries := []duEntry{}
+	for _, container := range lm_sdk_tools.Containers() {
+		targetDir := filepath.Join(lm_sdk_tools.LMTargetPath(), container.Name())
+		snapsDir := filepath.Join(targetDir, "snaps")
+
+		size, incomplete := c.diskUsage(targetDir, map[string]bool{snapsDir: true})
+		entries = append(entries, duEntry{
+			Type:       duTarget,
+			Name:       container.Name(),
+			Path:       targetDir,
+			Size:       size,
+			Incomplete: incomplete,
+		})
+
+		snapshots, _ := filepath.Glob(filepath.Join(snapsDir, "*"))
+		for _, snapshot := range snapshots {
+			if info, err := os.Stat(snapshot); err != nil || !info.IsDir() {
+				continue
+			}
+			size, incomplete := c.diskUsage(snapshot, nil)
+			entries = append(entries, duEntry{
+				Type:       duSnapshot,
+				Name:       container.Name() + "/" + filepath.Base(snapshot),
+				Path:       snapshot,
+				Size:       size,
+				Incomplete: incomplete,
+			})
+		}
+	}
+	return entries
+}
+
+// imageCacheDir returns the download cache of lxc-lm-download, which honours LXC_CACHE_PATH
+func imageCacheDir() (string, error) {
+	if cachePath := os.Getenv("LXC_CACHE_PATH"); len(cachePath) > 0 {
+		return filepath.Join(cachePath, "download"), nil
+	}
+
+	user, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(user.HomeDir, ".cache", "lxc", "download"), nil
+}
+
+// imageUsage returns one entry per cached image, which are in <dist>/<release>/<arch>/<variant>
+func (c *duCmd) imageUsage() ([]duEntry, error) {
+	cacheDir, err := imageCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := filepath.Glob(filepath.Join(cacheDir, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []duEntry{}
+	for _, image := range images {
+		if info, err := os.Stat(image); err != nil || !info.IsDir() {
+			continue
+		}
+
+		name, _ := filepath.Rel(cacheDir, image)
+		size, incomplete := c.diskUsage(image, nil)
+		entries = append(entries, duEntry{
+			Type:       duImage,
+			Name:       strings.Replace(name, string(filepath.Separator), " ", -1),
+			Path:       image,
+			Size:       size,
+			Incomplete: incomplete,
+		})
+	}
+	return entries, nil
+}
+
+// buildDirUsage returns the temporary directories rpmbuild leaves behind
+func (c *duCmd) buildDirUsage() ([]duEntry, error) {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "lmsdk-target*"))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []duEntry{}
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+
+		size, incomplete := c.diskUsage(dir, nil)
+		entries = append(entries, duEntry{
+			Type:       duBuildDir,
+			Name:       filepath.Base(dir),
+			Path:       dir,
+			Size:       size,
+			Incomplete: incomplete,
+		})
+	}
+	return entries, nil
+}
+
+// formatSize prints a size in bytes with a binary unit
+func formatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func (c *duCmd) run(args []string) error {
+	c.seen = map[[2]uint64]bool{}
+	result := duResult{Entries: c.targetUsage()}
+
+	images, err := c.imageUsage()
+	if err != nil {
+		return err
+	}
+	result.Entries = append(result.Entries, images...)
+
+	buildDirs, err := c.buildDirUsage()
+	if err != nil {
+		return err
+	}
+	result.Entries = append(result.Entries, buildDirs...)
+
+	for _, entry := range result.Entries {
+		result.Total += entry.Size
+		result.Incomplete = result.Incomplete || entry.Incomplete
+	}
+
+	if c.jsonOutput {
+		js, err := json.MarshalIndent(result, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("Could not marshal the result into a valid json string. error: %v.", err)
+		}
+		fmt.Printf("%s\n", js)
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "TYPE\tNAME\tSIZE\tPATH\n")
+	for _, entry := range result.Entries {
+		size := formatSize(entry.Size)
+		if entry.Incomplete {
+			size = ">" + size
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", entry.Type, entry.Name, size, entry.Path)
+	}
+	fmt.Fprintf(writer, "total\t\t%s\t\n", formatSize(result.Total))
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if result.Incomplete {
+		fmt.Println("\nSome files could not be read, sizes marked with > are incomplete. Run with sudo to include them.")
+	}
+	return nil
+}
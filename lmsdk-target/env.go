@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type envCmd struct {
+}
+
+func (c *envCmd) usage() string {
+	return fmt.Sprintf(`Manages the host environment variables passed through to a target.
+
+lmsdk-target env list <container>
+lmsdk-target env add <container> name...
+lmsdk-target env remove <container> name...
+
+Commands run in the target, including the wrapped tools, get the
+variables of the host that are on the list. Names can contain * as
+wildcard, e.g. CCACHE_*. PATH, HOME, USER, LOGNAME, SHELL, LC_ALL and
+LD_* are set for the target and can not be passed through. Variables set
+with --env or --env-file and the file named in %s are applied
+on top.`, lm_sdk_tools.EnvFileEnvVar)
+}
+
+func (c *envCmd) flags() {
+}
+
+func (c *envCmd) list(target *lm_sdk_tools.LMTargetContainer) error {
+	for _, pattern := range target.EnvPassthrough {
+		fmt.Println(pattern)
+	}
+	return nil
+}
+
+func (c *envCmd) add(target *lm_sdk_tools.LMTargetContainer, patterns []string) error {
+	for _, pattern := range patterns {
+		if err := lm_sdk_tools.CheckEnvPattern(pattern); err != nil {
+			return err
+		}
+		if !containsString(target.EnvPassthrough, pattern) {
+			target.EnvPassthrough = append(target.EnvPassthrough, pattern)
+		}
+	}
+	sort.Strings(target.EnvPassthrough)
+	return lm_sdk_tools.WriteLMContainerConfig(target)
+}
+
+func (c *envCmd) remove(target *lm_sdk_tools.LMTargetContainer, patterns []string) error {
+	passthrough := []string{}
+	for _, pattern := range target.EnvPassthrough {
+		if !containsString(patterns, pattern) {
+			passthrough = append(passthrough, pattern)
+		}
+	}
+	if len(passthrough) == 0 {
+		passthrough = nil
+	}
+	target.EnvPassthrough = passthrough
+	return lm_sdk_tools.WriteLMContainerConfig(target)
+}
+
+func (c *envCmd) run(args []string) error {
+	if len(args) < 2 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	target, err := lm_sdk_tools.LoadLMContainer(args[1])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	switch args[0] {
+	case "list":
+		return c.list(target)
+	case "add", "remove":
+		if len(args) < 3 {
+			PrintUsage(c)
+			return fmt.Errorf("Missing arguments.")
+		}
+		if args[0] == "add" {
+			return c.add(target, args[2:])
+		}
+		return c.remove(target, args[2:])
+	}
+
+	PrintUsage(c)
+	return fmt.Errorf("Unknown env command %s", args[0])
+}
+
+// envAssignments collects repeated --env options
+type envAssignments []string
+
+func (e *envAssignments) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envAssignments) Set(value string) error {
+	if _, _, err := lm_sdk_tools.ParseEnvAssignment(value); err != nil {
+		return err
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// envOptions are the --env and --env-file options of the commands that run something in a target
+type envOptions struct {
+	assignments envAssignments
+	envFile     string
+}
+
+func (o *envOptions) flags() {
+	gnuflag.Var(&o.assignments, "env", "Set the environment variable KEY=VALUE in the target, can be given multiple times.")
+	gnuflag.StringVar(&o.envFile, "env-file", "", "Read environment variables from a file of KEY=VALUE lines.")
+}
+
+// environment returns the variables of the options, the ones of --env win over the file
+func (o *envOptions) environment() ([]string, error) {
+	env := []string{}
+	if len(o.envFile) > 0 {
+		fileEnv, err := lm_sdk_tools.ReadEnvFile(o.envFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the env file: %v", err)
+		}
+		env = append(env, fileEnv...)
+	}
+	return append(env, o.assignments...), nil
+}
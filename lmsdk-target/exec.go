@@ -21,9 +21,9 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"syscall"
+	"os/user"
 
+	"gopkg.in/lxc/go-lxc.v2"
 	"launchpad.net/gnuflag"
 	"link-motion.com/lm-toolchain-sdk-tools"
 )
@@ -32,6 +32,7 @@ type execCmd struct {
 	maintMode bool
 	container string
 	user      string
+	env       envOptions
 }
 
 func (c *execCmd) usage() string {
@@ -42,11 +43,70 @@ func (c *execCmd) usage() string {
 
 	return fmt.Sprintf(`Executes a command in the container.
 
-lmsdk-target %s <container> [command]`, myMode)
+Without a command a login shell is started. The exit code of the command
+is returned, or 128+signal if it was killed.
+
+Besides the environment of the target and the host variables passed
+through to it, see lmsdk-target env, variables can be set with --env
+KEY=VALUE and --env-file.
+
+lmsdk-target %s [-u user] [--env KEY=VALUE]... [--env-file file] <container> [command]`, myMode)
 }
 
 func (c *execCmd) flags() {
 	gnuflag.StringVar(&c.user, "u", "", "Username to login before executing the command.")
+	c.env.flags()
+}
+
+// attachOptions returns the user and environment the command runs with
+func (c *execCmd) attachOptions(lmCont *lm_sdk_tools.LMTargetContainer) (lxc.AttachOptions, error) {
+	options := lxc.DefaultAttachOptions
+	options.ClearEnv = true
+
+	userName, home := "root", "/root"
+	if c.maintMode {
+		options.UID = 0
+		options.GID = 0
+	} else {
+		userName = c.user
+		entry, err := lm_sdk_tools.LookupContainerPasswd(lmCont.Container, c.user)
+		if err == nil {
+			options.UID = int(entry.Uid)
+			options.GID = int(entry.Gid)
+			home = entry.Home
+		} else if c.user == lmCont.User.Name {
+			//the home of the container user is mounted from the host
+			currUser, err := user.Current()
+			if err != nil {
+				return options, err
+			}
+			options.UID = int(lmCont.User.Uid)
+			options.GID = int(lmCont.User.Gid)
+			home = currUser.HomeDir
+		} else {
+			return options, err
+		}
+	}
+
+	//without groups lxc drops the supplementary groups, the user gets the ones of the container
+	groups, err := lm_sdk_tools.LookupContainerGroups(lmCont.Container, userName)
+	if err != nil && !os.IsNotExist(err) {
+		return options, err
+	}
+	options.Groups = groups
+
+	options.Env = []string{
+		"HOME=" + home,
+		"USER=" + userName,
+		"LOGNAME=" + userName,
+		"SHELL=/bin/bash",
+		"PATH=" + defaultContainerPath,
+	}
+	if term := os.Getenv("TERM"); len(term) > 0 {
+		options.Env = append(options.Env, "TERM="+term)
+	}
+	options.Cwd = home
+	return options, nil
 }
 
 func (c *execCmd) run(args []string) error {
@@ -58,67 +118,51 @@ func (c *execCmd) run(args []string) error {
 	c.container = args[0]
 	args = args[1:]
 
-	if len(c.user) == 0 {
-		lmCont, err := lm_sdk_tools.LoadLMContainer(c.container)
-		if err != nil {
-			return err
-		}
-		_, _, cUser, err := lm_sdk_tools.DistroToUserIds(lmCont.Distribution)
-		if err != nil {
-			return err
-		}
-
-		c.user = cUser
-	}
-
-	lxc_command, err := exec.LookPath("lxc-attach")
+	lmCont, err := lm_sdk_tools.LoadLMContainer(c.container)
 	if err != nil {
 		return err
 	}
 
-	lxc_args := []string{
-		lxc_command, "-P", lm_sdk_tools.LMTargetPath(),
-		"-n", c.container, "--",
-		"su",
+	if lmCont.Container.State() != lxc.RUNNING {
+		return fmt.Errorf("The container %s is not running", c.container)
 	}
 
-	if len(args) == 0 {
-		lxc_args = append(lxc_args, "-l")
+	if len(c.user) == 0 {
+		c.user = lmCont.User.Name
 	}
 
-	lxc_args = append(lxc_args, []string{
-		"-s", "/bin/bash"}...)
+	options, err := c.attachOptions(lmCont)
+	if err != nil {
+		return err
+	}
 
-	if !c.maintMode {
-		lxc_args = append(lxc_args, c.user)
+	extraEnv, err := c.env.environment()
+	if err != nil {
+		return err
+	}
+	env, err := lmCont.CommandEnvironment(extraEnv)
+	if err != nil {
+		return err
 	}
 
+	//the login shell reads the profiles, which would override the environment,
+	//then env sets it and runs the command without another round of shell quoting,
+	//-- keeps a command starting with - from being taken as option of env
+	command := []string{"/bin/bash", "-l", "-c", "exec env -- \"$@\"", "bash"}
+	command = append(command, env...)
 	if len(args) > 0 {
-		rcFiles := []string{"/etc/profile", "$HOME/.profile"}
-		cwd, _ := os.Getwd()
-
-		program := ""
-		for _, rcfile := range rcFiles {
-			program += "test -f " + rcfile + " && . " + rcfile + " &> /dev/null; "
-		}
-
 		//make sure the working directory is the same
-		program += "cd \"" + cwd + "\" && "
-
-		//force C locale as QtCreator needs it
-		program += " LC_ALL=C "
-
-		for _, arg := range args {
-			program += " " + lm_sdk_tools.QuoteString(arg)
-		}
-
-		lxc_args = append(lxc_args, []string{
-			"-c", program}...)
+		options.Cwd, _ = os.Getwd()
+		command = append(command, args...)
+	} else {
+		//the profiles were read already, the shell only needs the bashrc
+		command = append(command, "/bin/bash")
 	}
 
-	os.Stdout.Sync()
-	os.Stderr.Sync()
-	err = syscall.Exec(lxc_command, lxc_args, os.Environ())
-	fmt.Printf("Error: %v\n", err)
+	exitCode, err := lm_sdk_tools.RunAttached(lmCont.Container, command, options)
+	if err != nil {
+		return fmt.Errorf("Unable to run the command in %s: %v", c.container, err)
+	}
+	os.Exit(exitCode)
 	return nil
 }
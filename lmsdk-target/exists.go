@@ -23,7 +23,6 @@ import (
 
 	"os"
 
-	"gopkg.in/lxc/go-lxc.v2"
 	"link-motion.com/lm-toolchain-sdk-tools"
 )
 
@@ -45,7 +44,7 @@ func (c *existsCmd) run(args []string) error {
 		os.Exit(1)
 	}
 
-	container, err := lxc.NewContainer(args[0], lm_sdk_tools.LMTargetPath())
+	container, err := lm_sdk_tools.NewContainer(args[0])
 	if err != nil {
 		return fmt.Errorf("ERROR: %s", err.Error())
 	}
@@ -22,6 +22,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
@@ -35,9 +36,15 @@ type imageDesc struct {
 	Version      string    `json:"version"`
 	Variant      string    `json:"variant"`
 	Arch         string    `json:"arch"`
+	BuildId      string    `json:"buildId"`
 	UploadDate   time.Time `json:"uploadDate"`
+	//the directory of the image files on the server
+	Path string `json:"-"`
 }
 
+// imageBuildDateFormat is the format of the build ids in the image index
+const imageBuildDateFormat = "2006 01 02 15:04"
+
 type imagesCmd struct {
 }
 
@@ -50,17 +57,26 @@ lmsdk-target images`
 func (c *imagesCmd) flags() {
 }
 
+// defaultImageServer returns the image server new targets are created from
+func defaultImageServer() string {
+	if len(os.Getenv(lm_sdk_tools.LmImageServerEnvVar)) > 0 {
+		return os.Getenv(lm_sdk_tools.LmImageServerEnvVar)
+	}
+	return "https://sdk.link-motion.com/images"
+}
+
 func findRelevantImages() ([]imageDesc, error) {
+	return findServerImages(defaultImageServer())
+}
 
+// serverGet requests a file from the image server, with the credentials of the user if set
+func serverGet(url string) (*http.Response, error) {
 	client := &http.Client{}
 
-	url := "https://sdk.link-motion.com/images/meta/1.0/index-user"
-	if len(os.Getenv(lm_sdk_tools.LmImageServerEnvVar)) > 0 {
-		serverName := os.Getenv(lm_sdk_tools.LmImageServerEnvVar)
-		url = fmt.Sprintf("%s/meta/1.0/index-user", serverName)
-	}
-
 	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(os.Getenv("LM_USERNAME")) > 0 {
 		req.SetBasicAuth(
@@ -73,6 +89,22 @@ func findRelevantImages() ([]imageDesc, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unable to download %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// findServerImages downloads the image index of the given server
+func findServerImages(server string) ([]imageDesc, error) {
+
+	url := fmt.Sprintf("%s/meta/1.0/index-user", strings.TrimSuffix(server, "/"))
+
+	resp, err := serverGet(url)
+	if err != nil {
+		return nil, err
+	}
 
 	defer resp.Body.Close()
 
@@ -87,7 +119,7 @@ func findRelevantImages() ([]imageDesc, error) {
 		}
 
 		//Mon Jan 2 15:04:05 MST 2006  (MST is GMT-0700)
-		datetime, err := time.Parse("2006 01 02 15:04", fields[4])
+		datetime, err := time.Parse(imageBuildDateFormat, fields[4])
 		if err != nil {
 			fmt.Printf("Failed to parse date: %v", err)
 			continue
@@ -98,13 +130,47 @@ func findRelevantImages() ([]imageDesc, error) {
 			Version:      fields[1],
 			Arch:         fields[2],
 			Variant:      fields[3],
+			BuildId:      fields[4],
 			UploadDate:   datetime,
+			Path:         fields[5],
 		})
 
 	}
 	return imageDescs, nil
 }
 
+// downloadImageMeta stores the meta tarball of the image the download template would pick in fileName
+func downloadImageMeta(server string, distro string, version string, arch string, variant string, fileName string) error {
+	images, err := findServerImages(server)
+	if err != nil {
+		return err
+	}
+
+	//like the template the first matching entry of the index is used
+	for _, image := range images {
+		if image.Distribution != distro || image.Version != version || image.Arch != arch || image.Variant != variant {
+			continue
+		}
+
+		resp, err := serverGet(fmt.Sprintf("%s/%s/meta.tar.xz", strings.TrimSuffix(server, "/"), strings.Trim(image.Path, "/")))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		file, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(file, resp.Body); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+	return fmt.Errorf("No image %s %s %s %s on %s", distro, version, arch, variant, server)
+}
+
 func (c *imagesCmd) run(args []string) error {
 
 	imageDescs, err := findRelevantImages()
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type infoCmd struct {
+	jsonOutput bool
+}
+
+func (c *infoCmd) usage() string {
+	return `Shows everything known about a container and the image it was created from.
+
+lmsdk-target info [--json] container`
+}
+
+func (c *infoCmd) flags() {
+	gnuflag.BoolVar(&c.jsonOutput, "json", false, "Print the information as JSON")
+}
+
+func (c *infoCmd) run(args []string) error {
+	if len(args) < 1 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	container, err := lm_sdk_tools.LoadLMContainer(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	if c.jsonOutput {
+		data, err := json.MarshalIndent(container, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	orUnknown := func(value string) string {
+		if len(value) == 0 {
+			return "unknown"
+		}
+		return value
+	}
+
+	created := "unknown"
+	if !container.Created.IsZero() {
+		created = container.Created.Format(time.RFC1123)
+	}
+
+	tools := "unknown"
+	if container.Tools != nil {
+		tools = strings.Join(container.Tools, " ")
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(writer, "Name:\t%s\n", container.Name)
+	fmt.Fprintf(writer, "State:\t%s\n", container.Container.State())
+	fmt.Fprintf(writer, "Distribution:\t%s\n", container.Distribution)
+	fmt.Fprintf(writer, "Version:\t%s\n", container.Version)
+	fmt.Fprintf(writer, "Architecture:\t%s\n", container.Architecture)
+	fmt.Fprintf(writer, "Host architecture:\t%s\n", orUnknown(container.HostArchitecture))
+	fmt.Fprintf(writer, "Image build:\t%s\n", orUnknown(container.ImageBuildId))
+	fmt.Fprintf(writer, "Image server:\t%s\n", orUnknown(container.ImageServer))
+	fmt.Fprintf(writer, "Created:\t%s\n", created)
+	fmt.Fprintf(writer, "Container user:\t%s (%d:%d)\n", container.User.Name, container.User.Uid, container.User.Gid)
+	fmt.Fprintf(writer, "Updates enabled:\t%v\n", container.UpdatesEnabled)
+	fmt.Fprintf(writer, "Network mode:\t%s\n", container.NetworkMode())
+	fmt.Fprintf(writer, "Tools:\t%s\n", tools)
+	for _, envVar := range container.EnvironmentList() {
+		fmt.Fprintf(writer, "Environment:\t%s\n", envVar)
+	}
+	if len(container.EnvPassthrough) > 0 {
+		fmt.Fprintf(writer, "Host environment:\t%s\n", strings.Join(container.EnvPassthrough, " "))
+	}
+	if container.ConfigOutdated() {
+		fmt.Fprintf(writer, "Config version:\t%d (outdated, the current version is %d, run lmsdk-target autofix --only lmconfig)\n",
+			container.StoredConfigVersion(), lm_sdk_tools.LMConfigVersion)
+	} else {
+		fmt.Fprintf(writer, "Config version:\t%d\n", container.ConfigVersion)
+	}
+	fmt.Fprintf(writer, "Config file:\t%s\n", container.Container.ConfigFileName())
+	return writer.Flush()
+}
@@ -72,13 +72,13 @@ func (c *initializedCmd) run(args []string) error {
 	}
 
 	fmt.Println("Checking for subUID setup...")
-	if _, _, err := lm_sdk_tools.GetOrCreateUidRange(false); err != nil {
+	if _, err := lm_sdk_tools.GetOrCreateUidRange(false); err != nil {
 		fmt.Printf("subUID setup check failed with error: %v\n", err)
 		os.Exit(ERR_NO_SETUP)
 	}
 
 	fmt.Println("Checking for subGID setup...")
-	if _, _, err := lm_sdk_tools.GetOrCreateGuidRange(false); err != nil {
+	if _, err := lm_sdk_tools.GetOrCreateGuidRange(false); err != nil {
 		fmt.Printf("subGID setup check failed with error: %v\n", err)
 		os.Exit(ERR_NO_SETUP)
 	}
@@ -95,13 +95,17 @@ func (c *initializedCmd) run(args []string) error {
 		os.Exit(ERR_NO_SETUP)
 	}
 
+	needsFixing := false
 	for _, fixable := range fixable_set {
 		fixableErr := fixable.Check()
 		if fixableErr != nil {
-			fmt.Printf("Error: %v\n", fixableErr)
-			os.Exit(ERR_NEEDS_FIXING)
+			fmt.Printf("Error in %s: %v\n", fixable.Name(), fixableErr)
+			needsFixing = true
 		}
 	}
+	if needsFixing {
+		os.Exit(ERR_NEEDS_FIXING)
+	}
 
 	fmt.Println("Container backend is ready.")
 	return nil
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type lifecycleAction int
+
+const (
+	startAction lifecycleAction = iota + 1
+	stopAction
+	restartAction
+)
+
+type lifecycleCmd struct {
+	action  lifecycleAction
+	timeout int
+}
+
+func (c *lifecycleCmd) usage() string {
+	switch c.action {
+	case stopAction:
+		return `Stops a container.
+
+lmsdk-target stop [-t SECONDS] container`
+	case restartAction:
+		return `Restarts a container.
+
+lmsdk-target restart [-t SECONDS] container`
+	}
+	return `Starts a container.
+
+lmsdk-target start container`
+}
+
+func (c *lifecycleCmd) flags() {
+	if c.action != startAction {
+		gnuflag.IntVar(&c.timeout, "t", int(lm_sdk_tools.DefaultStopTimeout/time.Second),
+			"Seconds to wait for a clean shutdown before the container is killed")
+	}
+}
+
+func (c *lifecycleCmd) run(args []string) error {
+	if len(args) < 1 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	if c.timeout < 0 {
+		return fmt.Errorf("Invalid timeout: %d", c.timeout)
+	}
+
+	container, err := lm_sdk_tools.LoadLMContainer(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	if c.action == stopAction || c.action == restartAction {
+		fmt.Printf("Stopping container %s...\n", container.Name)
+		err = lm_sdk_tools.StopContainerSync(container, time.Duration(c.timeout)*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.action == startAction || c.action == restartAction {
+		fmt.Printf("Starting container %s...\n", container.Name)
+		err = lm_sdk_tools.BootContainerSync(container)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
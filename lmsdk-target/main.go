@@ -46,25 +46,40 @@ type command interface {
 }
 
 var commands = map[string]command{
-	"list":        &listCmd{},
-	"help":        &helpCmd{},
-	"create":      &createCmd{},
-	"rootfs":      &rootfsCmd{},
-	"status":      &statusCmd{},
-	"exists":      &existsCmd{},
-	"maint":       &execCmd{maintMode: true},
-	"exec":        &execCmd{maintMode: false},
-	"run":         &execCmd{maintMode: false},
-	"destroy":     &destroyCmd{},
-	"images":      &imagesCmd{},
-	"upgrade":     &upgradeCmd{},
-	"initialized": &initializedCmd{},
-	"autosetup":   &autosetupCmd{},
-	"autofix":     &autofixCmd{},
-	"rpmbuild":    &rpmbuildCmd{},
-	"username":    &usernameCmd{},
-	"snapshot":    &snapshotCmd{},
-	"rpminstall":  &rpmInstall{},
+	"list":            &listCmd{},
+	"help":            &helpCmd{},
+	"apply":           &applyCmd{},
+	"create":          &createCmd{},
+	"clone":           &cloneCmd{},
+	"rootfs":          &rootfsCmd{},
+	"reconfigure":     &reconfigureCmd{},
+	"migrate-storage": &migrateStorageCmd{},
+	"status":          &statusCmd{},
+	"settings":        &settingsCmd{},
+	"teardown":        &teardownCmd{},
+	"tools":           &toolsCmd{},
+	"env":             &envCmd{},
+	"exists":          &existsCmd{},
+	"maint":           &execCmd{maintMode: true},
+	"exec":            &execCmd{maintMode: false},
+	"run":             &execCmd{maintMode: false},
+	"destroy":         &destroyCmd{},
+	"doctor":          &doctorCmd{},
+	"du":              &duCmd{},
+	"images":          &imagesCmd{},
+	"info":            &infoCmd{},
+	"upgrade":         &upgradeCmd{},
+	"initialized":     &initializedCmd{},
+	"outdated":        &outdatedCmd{},
+	"autosetup":       &autosetupCmd{},
+	"autofix":         &autofixCmd{},
+	"rpmbuild":        &rpmbuildCmd{},
+	"username":        &usernameCmd{},
+	"snapshot":        &snapshotCmd{},
+	"rpminstall":      &rpmInstall{},
+	"start":           &lifecycleCmd{action: startAction},
+	"stop":            &lifecycleCmd{action: stopAction},
+	"restart":         &lifecycleCmd{action: restartAction},
 	//"set" : &setCmd{},
 }
 
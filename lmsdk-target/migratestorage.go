@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// storagePathKeys are the config keys that can contain paths inside the target directory
+var storagePathKeys = map[string]bool{
+	"lxc.rootfs":          true,
+	"lxc.rootfs.path":     true,
+	"lxc.mount":           true,
+	"lxc.mount.fstab":     true,
+	"lxc.mount.entry":     true,
+	"lxc.include":         true,
+	"lxc.logfile":         true,
+	"lxc.log.file":        true,
+	"lxc.console.logfile": true,
+}
+
+type migrateStorageCmd struct {
+	yes bool
+}
+
+func (c *migrateStorageCmd) usage() string {
+	return `Moves all targets including their snapshots to a new storage root.
+
+The targets are moved to ROOT/<user>/containers, the paths in their configs
+are rewritten and ROOT is stored in ~/.config/lm-sdk/storage.conf. All
+targets have to be stopped. If anything fails the moved targets are moved back.
+
+The storage root can also be set with the LM_SDK_STORAGE environment variable,
+which wins over the config file.
+
+lmsdk-target migrate-storage [-y] ROOT`
+}
+
+func (c *migrateStorageCmd) flags() {
+	gnuflag.BoolVar(&c.yes, "y", false, "Assume yes to all questions.")
+}
+
+// moveStorageEntry renames src to dst, across file systems it is copied and removed
+func moveStorageEntry(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	fmt.Printf("Copying %s to %s...\n", src, dst)
+	cmd := exec.Command("cp", "-a", "--reflink=auto", src, dst)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("Copying %s failed: %v", src, err)
+	}
+	return os.RemoveAll(src)
+}
+
+// rewriteStoragePaths replaces oldPath by newPath in the path values of a lxc config file
+func rewriteStoragePaths(fileName string, oldPath string, newPath string) error {
+	edit, err := lm_sdk_tools.LoadConfigEdit(fileName)
+	if err != nil {
+		return err
+	}
+
+	lines := edit.Lines()
+	for i, line := range lines {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 || strings.HasPrefix(strings.TrimSpace(line), "#") ||
+			!storagePathKeys[strings.TrimSpace(keyValue[0])] {
+			continue
+		}
+		lines[i] = keyValue[0] + "=" + strings.Replace(keyValue[1], oldPath+"/", newPath+"/", -1)
+	}
+	edit.ReplaceLines(lines)
+
+	_, err = edit.Commit()
+	return err
+}
+
+// rewriteTargetPaths fixes the config of a target and of all its snapshots
+func rewriteTargetPaths(targetDir string, oldPath string, newPath string) error {
+	configs := []string{filepath.Join(targetDir, "config")}
+	snapshots, err := filepath.Glob(filepath.Join(targetDir, "snaps", "*", "config"))
+	if err != nil {
+		return err
+	}
+
+	for _, config := range append(configs, snapshots...) {
+		if _, err := os.Stat(config); os.IsNotExist(err) {
+			continue
+		}
+		if err := rewriteStoragePaths(config, oldPath, newPath); err != nil {
+			return fmt.Errorf("Unable to update %s: %v", config, err)
+		}
+	}
+	return nil
+}
+
+// moveTarget moves one entry of the target directory and fixes its paths
+func moveTarget(name string, oldPath string, newPath string) error {
+	src := filepath.Join(oldPath, name)
+	dst := filepath.Join(newPath, name)
+
+	if err := moveStorageEntry(src, dst); err != nil {
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		if err = rewriteTargetPaths(dst, oldPath, newPath); err != nil {
+			moveStorageEntry(dst, src)
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *migrateStorageCmd) run(args []string) error {
+	if len(args) < 1 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	if os.Getuid() != 0 {
+		return fmt.Errorf("This command needs to run as root")
+	}
+
+	newRoot, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	oldPath := lm_sdk_tools.LMTargetPath()
+	newPath, err := lm_sdk_tools.TargetPathInRoot(newRoot)
+	if err != nil {
+		return err
+	}
+
+	if oldPath == newPath {
+		return fmt.Errorf("The targets are already stored in %s", newPath)
+	}
+	if strings.HasPrefix(newPath+"/", oldPath+"/") || strings.HasPrefix(oldPath+"/", newPath+"/") {
+		return fmt.Errorf("%s and %s can not contain each other", oldPath, newPath)
+	}
+
+	running := []string{}
+	for _, container := range lm_sdk_tools.Containers() {
+		if container.State() != lxc.STOPPED {
+			running = append(running, container.Name())
+		}
+	}
+	if len(running) > 0 {
+		return fmt.Errorf("Please stop all targets first, running are: %s", strings.Join(running, ", "))
+	}
+
+	entries, err := ioutil.ReadDir(oldPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !c.yes {
+		question := fmt.Sprintf("Move %d targets from %s to %s?", len(entries), oldPath, newPath)
+		if !lm_sdk_tools.GetUserConfirmation(question) {
+			return fmt.Errorf("Cancelled by user.")
+		}
+	}
+
+	if err = lm_sdk_tools.EnsureTargetDirectoriesExist(newPath, true); err != nil {
+		return fmt.Errorf("Directory setup failed with error: %v", err)
+	}
+
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(newPath, entry.Name())); err == nil {
+			return fmt.Errorf("%s exists already in %s", entry.Name(), newPath)
+		}
+	}
+
+	moved := []string{}
+	for _, entry := range entries {
+		fmt.Printf("Moving %s .....", entry.Name())
+		err = moveTarget(entry.Name(), oldPath, newPath)
+		if err == nil {
+			fmt.Println(" DONE")
+			moved = append(moved, entry.Name())
+			continue
+		}
+
+		fmt.Println(" FAILED")
+		for i := len(moved) - 1; i >= 0; i-- {
+			fmt.Printf("Moving %s back .....", moved[i])
+			if rollbackErr := moveTarget(moved[i], newPath, oldPath); rollbackErr != nil {
+				fmt.Printf(" FAILED\n%v\n", rollbackErr)
+			} else {
+				fmt.Println(" DONE")
+			}
+		}
+		return fmt.Errorf("Moving %s failed: %v", entry.Name(), err)
+	}
+
+	if err = lm_sdk_tools.WriteStorageRoot(newRoot); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nThe targets are now stored in %s\n", newPath)
+	if len(os.Getenv(lm_sdk_tools.LmStorageEnvVar)) > 0 {
+		fmt.Printf("%s is set and overrides the new storage root, please update or unset it.\n", lm_sdk_tools.LmStorageEnvVar)
+	}
+	return nil
+}
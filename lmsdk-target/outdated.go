@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+const (
+	targetUpToDate    = "up-to-date"
+	targetOutdated    = "outdated"
+	targetUnknown     = "unknown"
+	targetUnavailable = "unavailable"
+)
+
+type outdatedTarget struct {
+	Name          string `json:"name"`
+	Distribution  string `json:"distribution"`
+	Version       string `json:"version"`
+	Arch          string `json:"arch"`
+	Variant       string `json:"variant"`
+	BuildId       string `json:"buildId"`
+	LatestBuildId string `json:"latestBuildId"`
+	Status        string `json:"status"`
+}
+
+type outdatedCmd struct {
+	jsonOutput bool
+}
+
+func (c *outdatedCmd) usage() string {
+	return `Checks if newer images exist for the targets.
+
+Each target is checked against the image server it was created from,
+targets created from local files use the default server.
+
+The status of a target is one of:
+  up-to-date   the target was created from the newest build
+  outdated     a newer build is available
+  unknown      the build the target was created from is not known
+  unavailable  the image is not in the image index anymore
+
+lmsdk-target outdated [--json] [container...]`
+}
+
+func (c *outdatedCmd) flags() {
+	gnuflag.BoolVar(&c.jsonOutput, "json", false, "Print the result as JSON")
+}
+
+// targetImageServer returns the server recorded for the target, targets created from
+// local files or before the server was recorded use the default one
+func targetImageServer(target *lm_sdk_tools.LMTargetContainer) string {
+	if strings.HasPrefix(target.ImageServer, "http://") || strings.HasPrefix(target.ImageServer, "https://") {
+		return target.ImageServer
+	}
+	return defaultImageServer()
+}
+
+// checkTarget compares the build of the target with the newest matching image
+func checkTarget(target *lm_sdk_tools.LMTargetContainer, images []imageDesc) outdatedTarget {
+	result := outdatedTarget{
+		Name:         target.Name,
+		Distribution: target.Distribution,
+		Version:      target.Version,
+		Arch:         target.HostArchitecture,
+		Variant:      target.Architecture,
+		BuildId:      target.ImageBuildId,
+		Status:       targetUnavailable,
+	}
+
+	var latest *imageDesc
+	for i, image := range images {
+		if image.Distribution != target.Distribution || image.Version != target.Version ||
+			image.Variant != target.Architecture {
+			continue
+		}
+		//older targets did not record the host architecture
+		if len(target.HostArchitecture) > 0 && image.Arch != target.HostArchitecture {
+			continue
+		}
+		if latest == nil || image.UploadDate.After(latest.UploadDate) {
+			latest = &images[i]
+		}
+	}
+
+	if latest == nil {
+		return result
+	}
+	result.LatestBuildId = latest.BuildId
+
+	buildDate, err := time.Parse(imageBuildDateFormat, target.ImageBuildId)
+	if err != nil {
+		result.Status = targetUnknown
+	} else if latest.UploadDate.After(buildDate) {
+		result.Status = targetOutdated
+	} else {
+		result.Status = targetUpToDate
+	}
+	return result
+}
+
+func (c *outdatedCmd) run(args []string) error {
+	var targets []lm_sdk_tools.LMTargetContainer
+	if len(args) > 0 {
+		for _, name := range args {
+			target, err := lm_sdk_tools.LoadLMContainer(name)
+			if err != nil {
+				return fmt.Errorf("Could not connect to the Container: %v", err)
+			}
+			targets = append(targets, *target)
+		}
+	} else {
+		var err error
+		targets, err = lm_sdk_tools.FindLMTargets()
+		if err != nil {
+			return err
+		}
+	}
+
+	//every target is compared with the index of the server it was created from
+	indexes := make(map[string][]imageDesc)
+	results := []outdatedTarget{}
+	for i := range targets {
+		server := targetImageServer(&targets[i])
+		images, ok := indexes[server]
+		if !ok {
+			var err error
+			images, err = findServerImages(server)
+			if err != nil {
+				return fmt.Errorf("Could not query the image index of %s: %v", server, err)
+			}
+			indexes[server] = images
+		}
+		results = append(results, checkTarget(&targets[i], images))
+	}
+
+	if c.jsonOutput {
+		js, err := json.MarshalIndent(results, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("Could not marshal the result into a valid json string. error: %v.", err)
+		}
+		fmt.Printf("%s\n", js)
+		return nil
+	}
+
+	orNone := func(value string) string {
+		if len(value) == 0 {
+			return "-"
+		}
+		return value
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "NAME\tIMAGE\tBUILD\tLATEST\tSTATUS\n")
+	for _, result := range results {
+		fmt.Fprintf(writer, "%s\t%s %s %s\t%s\t%s\t%s\n", result.Name,
+			result.Distribution, result.Version, result.Variant,
+			orNone(result.BuildId), orNone(result.LatestBuildId), result.Status)
+	}
+	return writer.Flush()
+}
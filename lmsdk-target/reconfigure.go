@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type reconfigureCmd struct {
+	dryRun bool
+}
+
+func (c *reconfigureCmd) usage() string {
+	return `Regenerates the LXC config of a container from the current host setup.
+
+Rewrites the id mappings, the standard mounts and the lxc.include of the
+container, the old config is kept as backup next to it.
+
+lmsdk-target reconfigure [--dry-run] container`
+}
+
+func (c *reconfigureCmd) flags() {
+	gnuflag.BoolVar(&c.dryRun, "dry-run", false, "Only show the changes, do not write the config")
+}
+
+func (c *reconfigureCmd) run(args []string) error {
+	if len(args) < 1 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	container, err := lm_sdk_tools.LoadLMContainer(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	oldConfig, newConfig, err := lm_sdk_tools.GenerateContainerConfig(container)
+	if err != nil {
+		return err
+	}
+
+	configFile := container.Container.ConfigFileName()
+	diff := lm_sdk_tools.UnifiedDiff(configFile, configFile, oldConfig, newConfig)
+	if diff == "" {
+		fmt.Println("The container config is up to date.")
+		return nil
+	}
+
+	fmt.Print(diff)
+	if c.dryRun {
+		return nil
+	}
+
+	//the config is only applied on the next start
+	restart := container.Container.State() != lxc.STOPPED
+	if restart {
+		fmt.Printf("Stopping container...\n")
+		if err := lm_sdk_tools.StopContainerSync(container, lm_sdk_tools.DefaultStopTimeout); err != nil {
+			return fmt.Errorf("Failed to stop the container: %v", err)
+		}
+	}
+
+	backup, err := lm_sdk_tools.UpdateConfigSync(container)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Container config updated, the old config was saved as %s\n", backup)
+
+	if restart {
+		fmt.Printf("Starting container...\n")
+		if err := lm_sdk_tools.BootContainerSync(container); err != nil {
+			return fmt.Errorf("Failed to restart container: %v", err)
+		}
+	}
+	return nil
+}
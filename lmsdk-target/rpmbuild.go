@@ -46,12 +46,13 @@ type rpmbuildCmd struct {
 	installDeps       bool
 	upgrade           bool
 	nocleanbuild      bool
+	env               envOptions
 }
 
 func (c *rpmbuildCmd) usage() string {
 	return (`Build a rpm in a container build target.
 
-lmsdk-target rpmbuild container <sourcedir> [-t tarballname] [-j threads] [-s specfile] [-o output directory] [--build-deps] [--install]`)
+lmsdk-target rpmbuild container <sourcedir> [-t tarballname] [-j threads] [-s specfile] [-o output directory] [--build-deps] [--install] [--env KEY=VALUE]... [--env-file file]`)
 }
 
 func (c *rpmbuildCmd) flags() {
@@ -63,6 +64,7 @@ func (c *rpmbuildCmd) flags() {
 	gnuflag.BoolVar(&c.installDeps, "build-deps", false, "Install build dependencies")
 	gnuflag.BoolVar(&c.upgrade, "upgrade-before", false, "Upgrade container before starting the build")
 	gnuflag.BoolVar(&c.nocleanbuild, "nocleanbuild", false, "Don't clean up the build container after building")
+	c.env.flags()
 }
 
 /**
@@ -304,12 +306,22 @@ func (c *rpmbuildCmd) run(args []string) error {
 	c.container = args[0]
 	c.projectDir = args[1]
 
+	extraEnv, err := c.env.environment()
+	if err != nil {
+		return err
+	}
+
 	//make sure the container is up and running
 	container, err := lm_sdk_tools.LoadLMContainer(c.container)
 	if err != nil {
 		return fmt.Errorf("Could not connect to the Container: %v\n", err)
 	}
 
+	//recovered targets do not know what they build for
+	if len(container.Architecture) == 0 {
+		return fmt.Errorf("The build architecture of %s is unknown, please recreate the target", c.container)
+	}
+
 	//get executable name of lmsdk-target, for future use
 	me, err := os.Executable()
 	if err != nil {
@@ -510,6 +522,8 @@ func (c *rpmbuildCmd) run(args []string) error {
 		"LC_ALL=C",
 		fmt.Sprintf("MAKEFLAGS=-j%d", c.jobs),
 	}
+	//the variables of the options win over the defaults
+	envVars = append(envVars, extraEnv...)
 
 	command := fmt.Sprintf("rpmbuild -bb %s --define \"_topdir %s\" --target %s",
 		filepath.Join(rpmSourcesDir, specfileName),
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+var topdirRegex = regexp.MustCompile(`_topdir ([^"]+)"`)
+
+/*
+rpmbuildHook answers the commands rpmbuild runs in the target like rpmspec
+and rpmbuild would. The build creates a package in the RPMS directory of the
+topdir and exits with exitCode.
+*/
+func rpmbuildHook(exitCode int) func(*lm_sdk_tools.FakeContainer, []string, lxc.AttachOptions) (int, error) {
+	answers := map[string]string{
+		`--qf "%{name}"`:            "hello",
+		`--qf "%{version}"`:         "1.0",
+		`--qf "%{Name}-%{Version}"`: "hello-1.0",
+	}
+
+	return func(c *lm_sdk_tools.FakeContainer, args []string, options lxc.AttachOptions) (int, error) {
+		command := args[len(args)-1]
+		if strings.Contains(command, "rpmspec -q --srpm") {
+			for query, answer := range answers {
+				if strings.Contains(command, query) {
+					syscall.Write(int(options.StdoutFd), []byte(answer))
+					return 0, nil
+				}
+			}
+			return 1, nil
+		}
+
+		if match := topdirRegex.FindStringSubmatch(command); strings.Contains(command, "rpmbuild -bb") && match != nil {
+			rpmDir := filepath.Join(match[1], "RPMS", "armv7hl")
+			if err := os.MkdirAll(rpmDir, 0755); err != nil {
+				return 1, err
+			}
+			return exitCode, ioutil.WriteFile(filepath.Join(rpmDir, "hello-1.0-1.armv7hl.rpm"), nil, 0644)
+		}
+		return 127, nil
+	}
+}
+
+// buildCommand returns the rpmbuild command run in the target and its topdir
+func buildCommand(c *lm_sdk_tools.FakeContainer) (string, string) {
+	for _, args := range c.Commands {
+		command := args[len(args)-1]
+		if match := topdirRegex.FindStringSubmatch(command); strings.Contains(command, "rpmbuild -bb") && match != nil {
+			return command, match[1]
+		}
+	}
+	return "", ""
+}
+
+func TestRpmbuild(t *testing.T) {
+	fake, restore := useFakeBackend(t)
+	defer restore()
+
+	projectDir, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	spec := "Name: hello\nVersion: 1.0\nSource0: %{name}-%{version}.tar.xz\n"
+	ioutil.WriteFile(filepath.Join(projectDir, "hello.spec"), []byte(spec), 0644)
+	ioutil.WriteFile(filepath.Join(projectDir, "main.c"), []byte("int main() { return 0; }\n"), 0644)
+	ioutil.WriteFile(filepath.Join(projectDir, "fix.patch"), nil, 0644)
+
+	tests := []struct {
+		exitCode int
+		fails    bool
+	}{
+		{0, false},
+		{1, true},
+	}
+
+	for _, test := range tests {
+		outputDir, err := ioutil.TempDir("", "lmsdk-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outputDir)
+
+		createTarget(t, "target")
+		c := fake.Container("target", lm_sdk_tools.LMTargetPath())
+		c.Commands = nil
+		fake.RunHook = rpmbuildHook(test.exitCode)
+
+		cmd := &rpmbuildCmd{jobs: 2, nocleanbuild: true, outputDirectory: outputDir}
+		cmd.env.assignments = []string{"FOO=bar"}
+		if err := cmd.run([]string{"target", projectDir}); (err != nil) != test.fails {
+			t.Errorf("Exit code %d: run() returned %v", test.exitCode, err)
+		}
+
+		//the target is started for the build
+		if c.State() != lxc.RUNNING {
+			t.Errorf("Exit code %d: the target is %v", test.exitCode, c.State())
+		}
+
+		command, topdir := buildCommand(c)
+		if len(topdir) == 0 {
+			t.Fatalf("Exit code %d: rpmbuild was not run, the commands were %v", test.exitCode, c.Commands)
+		}
+		defer os.RemoveAll(topdir)
+
+		for _, arg := range []string{"MAKEFLAGS=-j2", "FOO=bar", "--target armv7hl", filepath.Join(topdir, "SOURCES", "hello.spec")} {
+			if !strings.Contains(command, arg) {
+				t.Errorf("Exit code %d: the rpmbuild command %s does not contain %s", test.exitCode, command, arg)
+			}
+		}
+
+		//the tarball name is guessed from the Source0 of the spec file
+		for _, name := range []string{"hello.spec", "fix.patch", "hello-1.0.tar.xz"} {
+			if _, err := os.Stat(filepath.Join(topdir, "SOURCES", name)); err != nil {
+				t.Errorf("Exit code %d: %s was not copied to the build dir: %v", test.exitCode, name, err)
+			}
+		}
+		out, err := exec.Command("tar", "-tJf", filepath.Join(topdir, "SOURCES", "hello-1.0.tar.xz")).Output()
+		if err != nil || !strings.Contains(string(out), "hello-1.0/main.c") {
+			t.Errorf("Exit code %d: the tarball contains %s, %v", test.exitCode, out, err)
+		}
+
+		//the packages are only copied if the build worked
+		_, err = os.Stat(filepath.Join(outputDir, "hello-1.0-1.armv7hl.rpm"))
+		if (err == nil) == test.fails {
+			t.Errorf("Exit code %d: the package in the output directory: %v", test.exitCode, err)
+		}
+
+		c.Stop()
+		c.Destroy()
+	}
+}
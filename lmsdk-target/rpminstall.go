@@ -75,11 +75,16 @@ func (c *rpmInstall) run(args []string) error {
 		commandStr = "zypper --non-interactive install %s"
 	}
 
+	packages := []string{}
+	for _, pkg := range args[1:] {
+		packages = append(packages, lm_sdk_tools.QuoteString(pkg))
+	}
+
 	exitCode, err := lm_sdk_tools.RunInContainer(
 		container,
 		true,
 		[]string{},
-		fmt.Sprintf(commandStr, strings.Join(args[1:], " ")),
+		fmt.Sprintf(commandStr, strings.Join(packages, " ")),
 		os.Stdout.Fd(),
 		os.Stderr.Fd(),
 	)
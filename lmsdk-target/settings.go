@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type settingsCmd struct {
+	networkMode string
+}
+
+func (c *settingsCmd) usage() string {
+	return `Shows or changes the settings of a target.
+
+Without options the current settings are shown. The network mode is one of
+bridged, none or host-shared, a running target is restarted to apply it.
+
+lmsdk-target settings [--network MODE] container`
+}
+
+func (c *settingsCmd) flags() {
+	gnuflag.StringVar(&c.networkMode, "network", "", "Network mode of the target: bridged, none or host-shared")
+}
+
+func (c *settingsCmd) run(args []string) error {
+	if len(args) < 1 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	container, err := lm_sdk_tools.LoadLMContainer(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	if len(c.networkMode) == 0 {
+		fmt.Printf("network: %s\n", container.NetworkMode())
+		return nil
+	}
+
+	if err := lm_sdk_tools.CheckNetworkMode(c.networkMode); err != nil {
+		return err
+	}
+
+	if container.NetworkMode() == c.networkMode {
+		fmt.Printf("The network mode is already %s\n", c.networkMode)
+		return nil
+	}
+
+	wasRunning := container.Container.State() != lxc.STOPPED
+	if wasRunning {
+		fmt.Printf("Stopping container...\n")
+		if err := lm_sdk_tools.StopContainerSync(container, lm_sdk_tools.DefaultStopTimeout); err != nil {
+			return fmt.Errorf("Failed to stop the container: %v", err)
+		}
+	}
+
+	if err := lm_sdk_tools.SetNetworkMode(container, c.networkMode); err != nil {
+		return err
+	}
+	if err := lm_sdk_tools.WriteLMContainerConfig(container); err != nil {
+		return err
+	}
+	fmt.Printf("The network mode of %s is now %s\n", container.Name, c.networkMode)
+
+	if wasRunning {
+		fmt.Printf("Starting container...\n")
+		if err := lm_sdk_tools.BootContainerSync(container); err != nil {
+			return fmt.Errorf("Could not start the Container: %v", err)
+		}
+	}
+	return nil
+}
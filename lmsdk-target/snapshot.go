@@ -72,7 +72,9 @@ func (c *snapshotCmd) run(args []string) error {
 		if container.Container.State() != lxc.STOPPED {
 			fmt.Printf("Stopping container...\n")
 			startContainer = true
-			container.Container.Stop()
+			if err := lm_sdk_tools.StopContainerSync(container, lm_sdk_tools.DefaultStopTimeout); err != nil {
+				return fmt.Errorf("Failed to stop the container: %v", err)
+			}
 		}
 	}
 
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/lxc/go-lxc.v2"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// snapshotNames returns the names of the snapshots of the fake container
+func snapshotNames(t *testing.T, c *lm_sdk_tools.FakeContainer) []string {
+	snaps, err := c.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, snap := range snaps {
+		names = append(names, snap.Name)
+	}
+	return names
+}
+
+func TestSnapshot(t *testing.T) {
+	fake, restore := useFakeBackend(t)
+	defer restore()
+
+	target := createTarget(t, "target")
+	if err := FinalizeContainer(target); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Container("target", lm_sdk_tools.LMTargetPath())
+	c.Start()
+	tool := filepath.Join(filepath.Dir(target.Container.ConfigFileName()), "gcc")
+
+	tests := []struct {
+		cmd snapshotCmd
+		//changes the config and removes a tool link before the command
+		change    bool
+		snapshots []string
+		//the config value the target has afterwards
+		environment string
+	}{
+		{snapshotCmd{}, false, []string{"snap0"}, ""},
+		{snapshotCmd{}, true, []string{"snap0", "snap1"}, "CHANGED=1"},
+		{snapshotCmd{list: true}, false, []string{"snap0", "snap1"}, "CHANGED=1"},
+		//restoring brings back the config of the snapshot and the tool links
+		{snapshotCmd{snapshotName: "snap0", restore: true}, false, []string{"snap0", "snap1"}, ""},
+		{snapshotCmd{snapshotName: "snap1", destroy: true}, false, []string{"snap0"}, ""},
+		{snapshotCmd{}, true, []string{"snap0", "snap1"}, "CHANGED=1"},
+		//the oldest snapshot is restored and all others are removed
+		{snapshotCmd{reset: true}, false, []string{"snap0"}, ""},
+	}
+
+	for i, test := range tests {
+		if test.change {
+			c.SetConfigItem("lxc.environment", "CHANGED=1")
+			os.Remove(tool)
+		}
+
+		if err := test.cmd.run([]string{"target"}); err != nil {
+			t.Fatalf("Test %d: run() failed: %v", i, err)
+		}
+
+		if names := snapshotNames(t, c); !reflect.DeepEqual(names, test.snapshots) {
+			t.Errorf("Test %d: the target has the snapshots %v, expected %v", i, names, test.snapshots)
+		}
+		if value := c.ConfigItem("lxc.environment")[0]; value != test.environment {
+			t.Errorf("Test %d: lxc.environment is '%s', expected '%s'", i, value, test.environment)
+		}
+		//the target is started again after the snapshot was taken or restored
+		if c.State() != lxc.RUNNING {
+			t.Errorf("Test %d: the target is %v", i, c.State())
+		}
+		if _, err := os.Readlink(tool); err != nil && test.environment == "" {
+			t.Errorf("Test %d: the tool link of the target is missing: %v", i, err)
+		}
+		if _, err := lm_sdk_tools.LoadLMContainer("target"); err != nil {
+			t.Errorf("Test %d: the config-lm file is broken: %v", i, err)
+		}
+	}
+
+	if err := (&snapshotCmd{}).run([]string{"missing"}); err == nil {
+		t.Errorf("Creating a snapshot of a missing target succeeded")
+	}
+}
@@ -50,7 +50,7 @@ func (c *statusCmd) run(args []string) error {
 
 	c.container = args[0]
 
-	container, err := lxc.NewContainer(c.container, lm_sdk_tools.LMTargetPath())
+	container, err := lm_sdk_tools.NewContainer(c.container)
 	if err != nil {
 		return fmt.Errorf("ERROR: %s", err.Error())
 	}
@@ -59,6 +59,15 @@ func (c *statusCmd) run(args []string) error {
 		return fmt.Errorf("Container does not exist")
 	}
 
+	target, err := lm_sdk_tools.LoadLMContainer(c.container)
+	if lm_sdk_tools.IsLMConfigError(err) {
+		//the status only needs the network mode, which the lxc config still knows
+		target, err = lm_sdk_tools.RecoverLMContainer(container)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
 	info := container.State()
 
 	if container.State() != lxc.RUNNING {
@@ -67,16 +76,20 @@ func (c *statusCmd) run(args []string) error {
 
 	result := make(map[string]string)
 	result["status"] = info.String()
-
-	if _, err := container.WaitIPAddresses(5 * time.Second); err != nil {
-		log.Fatalf("Could not query IP addresses: %v\n", err)
-	}
-
-	ips, err := container.IPv4Address("eth0")
-	if err != nil {
-		log.Fatalf("Could not query IP addresses: %v\n", err)
+	result["network"] = target.NetworkMode()
+
+	//without a own network the container has no address we could report
+	if target.NetworkMode() == lm_sdk_tools.NetworkModeBridged {
+		if _, err := container.WaitIPAddresses(5 * time.Second); err != nil {
+			log.Fatalf("Could not query IP addresses: %v\n", err)
+		}
+
+		ips, err := container.IPv4Address("eth0")
+		if err != nil {
+			log.Fatalf("Could not query IP addresses: %v\n", err)
+		}
+		result["ipv4"] = ips[0]
 	}
-	result["ipv4"] = ips[0]
 
 	js, err := json.Marshal(result)
 	if err != nil {
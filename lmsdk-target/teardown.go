@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+type teardownCmd struct {
+	yes            bool
+	destroyTargets bool
+}
+
+func (c *teardownCmd) usage() string {
+	return `Reverts the host setup done by autosetup for the current user.
+
+Removes the subuid, subgid and lxc-usernet entries autosetup added for the
+user, entries that existed before are kept. The lxc-net config is restored,
+unless the lxc bridge is still used by other entries. Directories
+created by autosetup are removed if they are empty.
+
+lmsdk-target teardown [-y] [--destroy-targets]`
+}
+
+func (c *teardownCmd) flags() {
+	gnuflag.BoolVar(&c.yes, "y", false, "Assume yes to all questions.")
+	gnuflag.BoolVar(&c.destroyTargets, "destroy-targets", false, "Also destroy all targets of the user")
+}
+
+func runSystemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// restoreFile puts back the content of a file from before autosetup changed it
+func restoreFile(state *lm_sdk_tools.HostSetupState, fileName string) (bool, error) {
+	change := state.FileChange(fileName)
+	if change == nil {
+		return false, nil
+	}
+
+	if backup, err := lm_sdk_tools.BackupFile(fileName); err == nil {
+		fmt.Printf("\nThe current %s was saved as %s", fileName, backup)
+	}
+
+	var err error
+	if change.Existed {
+		mode := change.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		err = lm_sdk_tools.WriteFileAtomic(fileName, []byte(change.Original), mode)
+	} else {
+		err = os.Remove(fileName)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Restoring %s failed: %v", fileName, err)
+	}
+	return true, nil
+}
+
+// addedLines returns the lines autosetup added to a file, entries that existed before are not touched
+func addedLines(state *lm_sdk_tools.HostSetupState, fileName string) []string {
+	if change := state.FileChange(fileName); change != nil {
+		return change.Added
+	}
+	return nil
+}
+
+// restoreBridgeConfig puts back the lxc-net and lxc default config from before autosetup changed them
+func (c *teardownCmd) restoreBridgeConfig(state *lm_sdk_tools.HostSetupState) error {
+	restored := false
+	for _, fileName := range []string{lm_sdk_tools.LxcBridgeFile, lm_sdk_tools.LxcDefaultInclude} {
+		changed, err := restoreFile(state, fileName)
+		if err != nil {
+			return err
+		}
+		restored = restored || changed
+	}
+
+	if !restored {
+		fmt.Println(" NOTHING TO DO")
+		return nil
+	}
+	fmt.Println()
+
+	var err error
+	for _, service := range state.Services {
+		if !service.WasEnabled {
+			if err = runSystemctl("disable", service.Name); err != nil {
+				return fmt.Errorf("Disabling %s failed: %v", service.Name, err)
+			}
+		}
+		if err = runSystemctl("restart", service.Name); err != nil {
+			return fmt.Errorf("Restarting %s failed: %v", service.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *teardownCmd) run(args []string) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("This command needs to run as root")
+	}
+
+	lxcUser, err := lm_sdk_tools.LxcContainerUser()
+	if err != nil {
+		return err
+	}
+
+	state, err := lm_sdk_tools.LoadHostSetupState()
+	if err != nil {
+		return err
+	}
+
+	if !c.yes {
+		question := fmt.Sprintf("WARNING: This removes the container setup of %s, are you sure?", lxcUser.Username)
+		if c.destroyTargets {
+			question = fmt.Sprintf("WARNING: This removes the container setup and ALL targets of %s, are you sure?", lxcUser.Username)
+		}
+		if !lm_sdk_tools.GetUserConfirmation(question) {
+			return fmt.Errorf("Cancelled by user.")
+		}
+	}
+
+	if c.destroyTargets {
+		fmt.Println("Destroying targets:")
+		for _, container := range lm_sdk_tools.Containers() {
+			fmt.Printf("Destroying %s .....", container.Name())
+			if err := lm_sdk_tools.RemoveContainerSync(container.Name()); err != nil {
+				fmt.Println(" FAILED")
+				return err
+			}
+			fmt.Println(" DONE")
+		}
+	} else if len(lm_sdk_tools.Containers()) > 0 {
+		fmt.Println("The existing targets are kept, but can not be started anymore.")
+	}
+
+	for _, fileName := range []string{lm_sdk_tools.SubUidFile, lm_sdk_tools.SubGidFile} {
+		fmt.Printf("\nRemoving the entries from %s .....", fileName)
+		removed, err := lm_sdk_tools.RemoveSubIdRanges(fileName, addedLines(state, fileName))
+		if err != nil {
+			fmt.Println(" FAILED")
+			return err
+		}
+		fmt.Printf(" %d REMOVED\n", removed)
+	}
+
+	fmt.Printf("\nRemoving the entries from %s .....", lm_sdk_tools.LxcUsernetFile)
+	remaining, err := lm_sdk_tools.RemoveLxcUsernet(addedLines(state, lm_sdk_tools.LxcUsernetFile))
+	if err != nil {
+		fmt.Println(" FAILED")
+		return err
+	}
+	fmt.Println(" DONE")
+
+	fmt.Printf("\nRestoring the lxc network config .....")
+	if remaining > 0 {
+		fmt.Printf(" SKIPPED\nThe bridge is still used by the remaining entries in %s\n", lm_sdk_tools.LxcUsernetFile)
+	} else if err := c.restoreBridgeConfig(state); err != nil {
+		fmt.Println(" FAILED")
+		return err
+	}
+
+	//the state file is in the default storage root, which can be one of the directories
+	stateFile, err := lm_sdk_tools.HostSetupStateFile()
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	//only empty directories are removed, the deepest first
+	for i := len(state.Directories) - 1; i >= 0; i-- {
+		dir := state.Directories[i]
+		if files, err := ioutil.ReadDir(dir); err == nil && len(files) == 0 {
+			fmt.Printf("Removing directory %s\n", dir)
+			os.Remove(dir)
+		}
+	}
+
+	fmt.Println("\nThe host setup was removed.")
+	return nil
+}
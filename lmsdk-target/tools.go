@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"launchpad.net/gnuflag"
+	"link-motion.com/lm-toolchain-sdk-tools"
+	"link-motion.com/lm-toolchain-sdk-tools/fixables"
+)
+
+// defaultContainerPath is used if the target environment does not set PATH
+const defaultContainerPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// toolCandidateRegex matches the executables tools sync offers to wrap,
+// including cross compilers and versioned or suffixed variants
+var toolCandidateRegex = regexp.MustCompile("^(" + strings.Join([]string{
+	`([A-Za-z0-9_]+-)*(gcc|g\+\+|cc|c\+\+|cpp|clang|clang\+\+|gfortran)(-[0-9.]+)?`,
+	`make|gmake|cmake|ctest|cpack|ninja|meson|scons`,
+	`autoconf|autoreconf|automake|libtool|libtoolize|pkg-config|pkgconf|rpmbuild`,
+	`gdb|gdbserver|lldb`,
+	`(qmake|moc|rcc|uic|lupdate|lrelease|lconvert|qdoc|qtquickcompiler|qmlcachegen|qmlplugindump|qdbusxml2cpp|qdbuscpp2xml)(-qt[0-9])?`,
+}, "|") + ")$")
+
+type toolsCmd struct {
+	yes bool
+}
+
+func (c *toolsCmd) usage() string {
+	return `Manages the tools of a target that are linked to lmsdk-wrapper.
+
+lmsdk-target tools list <container>
+lmsdk-target tools add <container> tool...
+lmsdk-target tools remove <container> tool...
+lmsdk-target tools sync [-y] <container>
+
+sync scans the PATH of the target for compilers and build tools and offers
+to wrap the ones not wrapped yet, and to remove tools that do not exist in
+the target anymore. With -y all offers are accepted.`
+}
+
+func (c *toolsCmd) flags() {
+	gnuflag.BoolVar(&c.yes, "y", false, "Assume yes to all questions.")
+}
+
+// containerExecutables returns the executables in the PATH of the target, mapped to their directory
+func containerExecutables(target *lm_sdk_tools.LMTargetContainer) (map[string]string, error) {
+	rootfs, err := lm_sdk_tools.ContainerRootfs(target.Name)
+	if err != nil {
+		return nil, err
+	}
+	rootfsDirs := lm_sdk_tools.RootfsDirs(rootfs)
+
+	searchPath := target.Environment["PATH"]
+	if len(searchPath) == 0 {
+		searchPath = defaultContainerPath
+	}
+
+	executables := map[string]string{}
+	for _, dir := range filepath.SplitList(searchPath) {
+		//files in the upper directory of a overlay hide the lower ones, removed files by a whiteout
+		hidden := map[string]bool{}
+		for _, rootfsDir := range rootfsDirs {
+			files, err := ioutil.ReadDir(filepath.Join(rootfsDir, dir))
+			if err != nil {
+				continue
+			}
+
+			for _, file := range files {
+				if hidden[file.Name()] {
+					continue
+				}
+				hidden[file.Name()] = true
+
+				//links are mostly alternatives, their targets are absolute inside the rootfs
+				isExecutable := file.Mode()&os.ModeSymlink != 0 || (file.Mode().IsRegular() && file.Mode()&0111 != 0)
+				if _, found := executables[file.Name()]; !found && isExecutable {
+					executables[file.Name()] = dir
+				}
+			}
+		}
+	}
+	return executables, nil
+}
+
+// saveTools writes the tool list and updates the links
+func saveTools(target *lm_sdk_tools.LMTargetContainer, tools []string) error {
+	sort.Strings(tools)
+	target.Tools = tools
+	if err := lm_sdk_tools.WriteLMContainerConfig(target); err != nil {
+		return err
+	}
+	return fixables.NewToolsFixable().FixContainer(target.Name)
+}
+
+func (c *toolsCmd) list(target *lm_sdk_tools.LMTargetContainer) error {
+	for _, tool := range fixables.TargetTools(target) {
+		fmt.Println(tool)
+	}
+	return nil
+}
+
+func (c *toolsCmd) add(target *lm_sdk_tools.LMTargetContainer, names []string) error {
+	tools := fixables.TargetTools(target)
+	for _, name := range names {
+		if err := fixables.ValidateToolName(name); err != nil {
+			return err
+		}
+		if !containsString(tools, name) {
+			tools = append(tools, name)
+		}
+	}
+	return saveTools(target, tools)
+}
+
+func (c *toolsCmd) remove(target *lm_sdk_tools.LMTargetContainer, names []string) error {
+	tools := []string{}
+	for _, tool := range fixables.TargetTools(target) {
+		if !containsString(names, tool) {
+			tools = append(tools, tool)
+		}
+	}
+	return saveTools(target, tools)
+}
+
+func (c *toolsCmd) sync(target *lm_sdk_tools.LMTargetContainer) error {
+	executables, err := containerExecutables(target)
+	if err != nil {
+		return err
+	}
+
+	current := fixables.TargetTools(target)
+	tools := []string{}
+	for _, tool := range current {
+		if _, found := executables[tool]; !found &&
+			(c.yes || lm_sdk_tools.GetUserConfirmation(fmt.Sprintf("%s does not exist in the target, remove it?", tool))) {
+			continue
+		}
+		tools = append(tools, tool)
+	}
+
+	candidates := []string{}
+	for name := range executables {
+		if toolCandidateRegex.MatchString(name) && !containsString(current, name) && fixables.ValidateToolName(name) == nil {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+
+	for _, name := range candidates {
+		question := fmt.Sprintf("Wrap %s/%s?", executables[name], name)
+		if c.yes || lm_sdk_tools.GetUserConfirmation(question) {
+			fmt.Printf("Adding %s\n", name)
+			tools = append(tools, name)
+		}
+	}
+
+	return saveTools(target, tools)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *toolsCmd) run(args []string) error {
+	if len(args) < 2 {
+		PrintUsage(c)
+		return fmt.Errorf("Missing arguments.")
+	}
+
+	target, err := lm_sdk_tools.LoadLMContainer(args[1])
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Container: %v", err)
+	}
+
+	switch args[0] {
+	case "list":
+		return c.list(target)
+	case "sync":
+		return c.sync(target)
+	case "add", "remove":
+		if len(args) < 3 {
+			PrintUsage(c)
+			return fmt.Errorf("Missing arguments.")
+		}
+		if args[0] == "add" {
+			return c.add(target, args[2:])
+		}
+		return c.remove(target, args[2:])
+	}
+
+	PrintUsage(c)
+	return fmt.Errorf("Unknown tools command %s", args[0])
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"link-motion.com/lm-toolchain-sdk-tools"
+)
+
+// createFiles creates the files below dir with the given permissions
+func createFiles(t *testing.T, dir string, files map[string]os.FileMode) {
+	for name, perm := range files {
+		fileName := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, nil, perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContainerExecutables(t *testing.T) {
+	_, restore := useFakeBackend(t)
+	defer restore()
+
+	target := createTarget(t, "target")
+	target.Environment = map[string]string{"PATH": "/usr/local/bin:/usr/bin"}
+	dir := filepath.Dir(target.Container.ConfigFileName())
+	lower := filepath.Join(lm_sdk_tools.LMTargetPath(), "base", "rootfs")
+	upper := filepath.Join(dir, "delta0")
+
+	createFiles(t, lower, map[string]os.FileMode{
+		"usr/bin/gcc":         0755,
+		"usr/bin/g++":         0755,
+		"usr/bin/make":        0755,
+		"usr/bin/README":      0644,
+		"usr/local/bin/cmake": 0755,
+	})
+	//the snapshot replaced make by a file that is not executable and installed ninja
+	createFiles(t, upper, map[string]os.FileMode{
+		"usr/bin/make":  0644,
+		"usr/bin/ninja": 0755,
+	})
+
+	tests := []struct {
+		rootfs      string
+		executables map[string]string
+	}{
+		{"dir:" + lower, map[string]string{"gcc": "/usr/bin", "g++": "/usr/bin", "make": "/usr/bin", "cmake": "/usr/local/bin"}},
+		{"overlay:" + lower + ":" + upper, map[string]string{"gcc": "/usr/bin", "g++": "/usr/bin", "ninja": "/usr/bin", "cmake": "/usr/local/bin"}},
+	}
+
+	for _, test := range tests {
+		target.Container.ClearConfigItem(lm_sdk_tools.ConfigKey("lxc.rootfs.path"))
+		target.Container.SetConfigItem(lm_sdk_tools.ConfigKey("lxc.rootfs.path"), test.rootfs)
+
+		executables, err := containerExecutables(target)
+		if err != nil {
+			t.Errorf("%s: containerExecutables() failed: %v", test.rootfs, err)
+		} else if !reflect.DeepEqual(executables, test.executables) {
+			t.Errorf("%s: containerExecutables() = %v, expected %v", test.rootfs, executables, test.executables)
+		}
+	}
+}
@@ -53,10 +53,6 @@ func (c *usernameCmd) run(args []string) error {
 		return fmt.Errorf("Container does not exist")
 	}
 
-	_, _, username, err := lm_sdk_tools.DistroToUserIds(container.Distribution)
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%s\n", username)
+	fmt.Printf("%s\n", container.User.Name)
 	return nil
 }
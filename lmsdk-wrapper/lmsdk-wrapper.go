@@ -202,15 +202,20 @@ func executeCommand() int {
 	//write the current shells PID into the pidfile
 	program += fmt.Sprintf("echo $$ > %s; ", pidfile)
 
-	//force C locale as QtCreator needs it
-	program += " LC_ALL=C exec"
+	//env sets the environment of the target and runs the command
+	env, err := c.CommandEnvironment(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	program += "exec env --"
 
-	for _, arg := range args {
+	for _, arg := range append(env, args...) {
 		program += " " + lm_sdk_tools.QuoteString(arg)
 	}
 
 	go func() {
-		ch := make(chan os.Signal)
+		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 		for {
@@ -241,17 +246,10 @@ func executeCommand() int {
 	go mapFunc(stdout_r, os.Stdout, &wg)
 	go mapFunc(stderr_r, os.Stderr, &wg)
 
-	cid, cgid, _, err := lm_sdk_tools.DistroToUserIds(c.Distribution)
-
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		return 1
-	}
-
 	options := lxc.DefaultAttachOptions
 	options.ClearEnv = true
-	options.UID = int(cid)
-	options.GID = int(cgid)
+	options.UID = int(c.User.Uid)
+	options.GID = int(c.User.Gid)
 	options.Cwd, _ = os.Getwd()
 	options.StdinFd = os.Stdin.Fd()
 	options.StderrFd = stderr_w.Fd()
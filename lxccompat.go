@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LXCSemVersion is a parsed lxc version, e.g. 2.1.1 or 3.0.0~beta1
+type LXCSemVersion struct {
+	Major int
+	Minor int
+	Patch int
+	//pre release or distribution suffix, e.g. ~beta1 or -0ubuntu1
+	Suffix string
+}
+
+// NewConfigFormatVersion is the first lxc version using the new config keys
+var NewConfigFormatVersion = LXCSemVersion{Major: 2, Minor: 1}
+
+var lxcVersionRegex = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?(.*)$`)
+
+// ParseLXCVersion parses the version string of lxc, a missing patch level is 0
+func ParseLXCVersion(version string) (LXCSemVersion, error) {
+	match := lxcVersionRegex.FindStringSubmatch(strings.TrimSpace(version))
+	if match == nil {
+		return LXCSemVersion{}, fmt.Errorf("Unable to parse the lxc version '%s'", version)
+	}
+
+	parsed := LXCSemVersion{Suffix: match[4]}
+	for i, target := range []*int{&parsed.Major, &parsed.Minor, &parsed.Patch} {
+		if len(match[i+1]) == 0 {
+			continue
+		}
+		number, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return LXCSemVersion{}, fmt.Errorf("Unable to parse the lxc version '%s'", version)
+		}
+		*target = number
+	}
+	return parsed, nil
+}
+
+// Compare returns -1, 0 or 1 if v is older, equal or newer than other, suffixes are ignored
+func (v LXCSemVersion) Compare(other LXCSemVersion) int {
+	for _, diff := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if diff < 0 {
+			return -1
+		} else if diff > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast returns true if v is other or newer
+func (v LXCSemVersion) AtLeast(other LXCSemVersion) bool {
+	return v.Compare(other) >= 0
+}
+
+func (v LXCSemVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d%s", v.Major, v.Minor, v.Patch, v.Suffix)
+}
+
+// InstalledLXCVersion returns the parsed version of the lxc library
+func InstalledLXCVersion() (LXCSemVersion, error) {
+	return ParseLXCVersion(LXCVersion())
+}
+
+// IsNewConfigFormat returns true if a lxc of the version reads the new config keys
+func IsNewConfigFormat(version string) bool {
+	parsed, err := ParseLXCVersion(version)
+	if err != nil {
+		//unknown versions are assumed to be recent
+		return !strings.HasPrefix(version, "2.0") && !strings.HasPrefix(version, "1.")
+	}
+	return parsed.AtLeast(NewConfigFormatVersion)
+}
+
+// legacyConfigKeys maps the keys renamed in lxc 2.1 to their new name, like lxc-update-config does.
+// lxc.network.* is handled separately
+var legacyConfigKeys = map[string]string{
+	"lxc.aa_allow_incomplete": "lxc.apparmor.allow_incomplete",
+	"lxc.aa_profile":          "lxc.apparmor.profile",
+	"lxc.console":             "lxc.console.path",
+	"lxc.devttydir":           "lxc.tty.dir",
+	"lxc.haltsignal":          "lxc.signal.halt",
+	"lxc.id_map":              "lxc.idmap",
+	"lxc.init_cmd":            "lxc.init.cmd",
+	"lxc.init_gid":            "lxc.init.gid",
+	"lxc.init_uid":            "lxc.init.uid",
+	"lxc.limit":               "lxc.prlimit",
+	"lxc.logfile":             "lxc.log.file",
+	"lxc.loglevel":            "lxc.log.level",
+	"lxc.mount":               "lxc.mount.fstab",
+	"lxc.pts":                 "lxc.pty.max",
+	"lxc.rebootsignal":        "lxc.signal.reboot",
+	"lxc.rootfs":              "lxc.rootfs.path",
+	"lxc.se_context":          "lxc.selinux.context",
+	"lxc.seccomp":             "lxc.seccomp.profile",
+	"lxc.stopsignal":          "lxc.signal.stop",
+	"lxc.syslog":              "lxc.log.syslog",
+	"lxc.tty":                 "lxc.tty.max",
+	"lxc.utsname":             "lxc.uts.name",
+}
+
+// newConfigKeys is the reverse of legacyConfigKeys
+var newConfigKeys = map[string]string{}
+
+func init() {
+	for legacy, key := range legacyConfigKeys {
+		newConfigKeys[key] = legacy
+	}
+}
+
+// networkSubKeys are the interface keys that got another name besides the lxc.net.<index> prefix
+var networkSubKeys = map[string]string{
+	"ipv4": "ipv4.address",
+	"ipv6": "ipv6.address",
+}
+
+/*
+LXCConfigKey returns the name of a config key in the new or the legacy
+format, key can be given in either. Keys of network interfaces are mapped
+between lxc.net.<index>.<key> and lxc.network.<key>, the legacy format
+only supports the current interface.
+*/
+func LXCConfigKey(key string, newFormat bool) string {
+	if newFormat {
+		if newKey, ok := legacyConfigKeys[key]; ok {
+			return newKey
+		}
+		if key == "lxc.network" {
+			return "lxc.net"
+		}
+		if strings.HasPrefix(key, "lxc.network.") {
+			subKey := strings.TrimPrefix(key, "lxc.network.")
+			if newSubKey, ok := networkSubKeys[subKey]; ok {
+				subKey = newSubKey
+			}
+			return "lxc.net.0." + subKey
+		}
+		return key
+	}
+
+	if legacy, ok := newConfigKeys[key]; ok {
+		return legacy
+	}
+	if key == "lxc.net" {
+		return "lxc.network"
+	}
+	if strings.HasPrefix(key, "lxc.net.") {
+		parts := strings.SplitN(strings.TrimPrefix(key, "lxc.net."), ".", 2)
+		if len(parts) == 2 {
+			for legacy, subKey := range networkSubKeys {
+				if parts[1] == subKey {
+					parts[1] = legacy
+				}
+			}
+			return "lxc.network." + parts[1]
+		}
+	}
+	return key
+}
+
+// ConfigKey returns the name of a config key understood by the installed lxc
+func ConfigKey(key string) string {
+	return LXCConfigKey(key, LXCNewVersion())
+}
+
+// IsLegacyConfigKey returns true for keys lxc 2.1 renamed
+func IsLegacyConfigKey(key string) bool {
+	_, ok := legacyConfigKeys[key]
+	return ok || key == "lxc.network" || strings.HasPrefix(key, "lxc.network.")
+}
+
+/*
+UpgradeConfigLines translates the legacy keys of a container config to the
+new format, like lxc-update-config does. Each lxc.network.type starts a new
+interface, numbered lxc.network.<index>.<key> lines keep their index.
+Comments and lines with new keys are kept as they are. Returns the new
+lines and whether anything changed.
+*/
+func UpgradeConfigLines(lines []string) ([]string, bool) {
+	upgraded := make([]string, 0, len(lines))
+	changed := false
+	networkIndex := -1
+
+	for _, line := range lines {
+		key := configLineKey(line)
+		if !IsLegacyConfigKey(key) {
+			upgraded = append(upgraded, line)
+			continue
+		}
+
+		newKey := ""
+		switch {
+		case key == "lxc.network":
+			newKey = "lxc.net"
+			networkIndex = -1
+		case strings.HasPrefix(key, "lxc.network."):
+			subKey := strings.TrimPrefix(key, "lxc.network.")
+			index := networkIndex
+			if parts := strings.SplitN(subKey, ".", 2); len(parts) == 2 {
+				if number, err := strconv.Atoi(parts[0]); err == nil {
+					index, subKey = number, parts[1]
+				}
+			}
+			if index == networkIndex && subKey == "type" {
+				networkIndex++
+				index = networkIndex
+			}
+			if index < 0 {
+				index = 0
+			}
+			if newSubKey, ok := networkSubKeys[subKey]; ok {
+				subKey = newSubKey
+			}
+			newKey = fmt.Sprintf("lxc.net.%d.%s", index, subKey)
+		default:
+			newKey = legacyConfigKeys[key]
+		}
+
+		upgraded = append(upgraded, ConfigItem{Key: newKey, Value: configLineValue(line)}.String())
+		changed = true
+	}
+	return upgraded, changed
+}
+
+/*
+UpgradeContainerConfig rewrites the legacy keys in the config of the
+container and of its snapshots, if the installed lxc uses the new format.
+Returns the files that were changed.
+*/
+func UpgradeContainerConfig(container ContainerBackend) ([]string, error) {
+	if !LXCNewVersion() {
+		return nil, nil
+	}
+
+	changed := []string{}
+	configFile := container.ConfigFileName()
+	snapshots, _ := filepath.Glob(filepath.Join(filepath.Dir(configFile), "snaps", "*", "config"))
+
+	for _, fileName := range append([]string{configFile}, snapshots...) {
+		edit, err := LoadConfigEdit(fileName)
+		if err != nil {
+			return changed, err
+		}
+
+		lines, upgraded := UpgradeConfigLines(edit.Lines())
+		if !upgraded {
+			continue
+		}
+		edit.ReplaceLines(lines)
+
+		if fileName == configFile {
+			_, err = edit.Apply(container)
+		} else {
+			_, err = edit.Commit()
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed = append(changed, fileName)
+	}
+	return changed, nil
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLXCVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		parsed  LXCSemVersion
+		newKeys bool
+		fails   bool
+	}{
+		{"2.0.8", LXCSemVersion{Major: 2, Minor: 0, Patch: 8}, false, false},
+		{"2.1", LXCSemVersion{Major: 2, Minor: 1}, true, false},
+		{"2.1.1", LXCSemVersion{Major: 2, Minor: 1, Patch: 1}, true, false},
+		{" 3.0.0~beta1\n", LXCSemVersion{Major: 3, Suffix: "~beta1"}, true, false},
+		{"2.0.11-0ubuntu1", LXCSemVersion{Major: 2, Patch: 11, Suffix: "-0ubuntu1"}, false, false},
+		{"1.1.5", LXCSemVersion{Major: 1, Minor: 1, Patch: 5}, false, false},
+		{"git", LXCSemVersion{}, true, true},
+		{"", LXCSemVersion{}, true, true},
+	}
+
+	for _, test := range tests {
+		parsed, err := ParseLXCVersion(test.version)
+		if (err != nil) != test.fails {
+			t.Errorf("ParseLXCVersion(%q) returned error %v", test.version, err)
+			continue
+		}
+		if parsed != test.parsed {
+			t.Errorf("ParseLXCVersion(%q) = %+v, expected %+v", test.version, parsed, test.parsed)
+		}
+		if newKeys := IsNewConfigFormat(test.version); newKeys != test.newKeys {
+			t.Errorf("IsNewConfigFormat(%q) = %v, expected %v", test.version, newKeys, test.newKeys)
+		}
+	}
+}
+
+func TestLXCSemVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b   LXCSemVersion
+		result int
+	}{
+		{LXCSemVersion{Major: 2, Minor: 1}, NewConfigFormatVersion, 0},
+		{LXCSemVersion{Major: 2, Minor: 0, Patch: 9}, NewConfigFormatVersion, -1},
+		{LXCSemVersion{Major: 3}, NewConfigFormatVersion, 1},
+		{LXCSemVersion{Major: 2, Minor: 1, Patch: 1}, LXCSemVersion{Major: 2, Minor: 1, Patch: 1, Suffix: "~rc1"}, 0},
+	}
+
+	for _, test := range tests {
+		if result := test.a.Compare(test.b); result != test.result {
+			t.Errorf("%v.Compare(%v) = %d, expected %d", test.a, test.b, result, test.result)
+		}
+	}
+}
+
+func TestLXCConfigKey(t *testing.T) {
+	tests := []struct {
+		legacy string
+		key    string
+	}{
+		{"lxc.rootfs", "lxc.rootfs.path"},
+		{"lxc.id_map", "lxc.idmap"},
+		{"lxc.utsname", "lxc.uts.name"},
+		{"lxc.seccomp", "lxc.seccomp.profile"},
+		{"lxc.mount", "lxc.mount.fstab"},
+		{"lxc.mount.entry", "lxc.mount.entry"},
+		{"lxc.network", "lxc.net"},
+		{"lxc.network.type", "lxc.net.0.type"},
+		{"lxc.network.ipv4", "lxc.net.0.ipv4.address"},
+		{"lxc.network.ipv4.gateway", "lxc.net.0.ipv4.gateway"},
+		{"lxc.include", "lxc.include"},
+	}
+
+	for _, test := range tests {
+		if key := LXCConfigKey(test.legacy, true); key != test.key {
+			t.Errorf("LXCConfigKey(%q, true) = %q, expected %q", test.legacy, key, test.key)
+		}
+		if key := LXCConfigKey(test.key, true); key != test.key {
+			t.Errorf("LXCConfigKey(%q, true) = %q, new keys have to stay", test.key, key)
+		}
+		if legacy := LXCConfigKey(test.key, false); legacy != test.legacy {
+			t.Errorf("LXCConfigKey(%q, false) = %q, expected %q", test.key, legacy, test.legacy)
+		}
+	}
+
+	for legacy := range legacyConfigKeys {
+		if !IsLegacyConfigKey(legacy) {
+			t.Errorf("%s is not detected as legacy key", legacy)
+		}
+		if IsLegacyConfigKey(legacyConfigKeys[legacy]) {
+			t.Errorf("%s is detected as legacy key", legacyConfigKeys[legacy])
+		}
+	}
+}
+
+func TestUpgradeConfigLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		upgraded []string
+		changed  bool
+	}{
+		{
+			name:     "new format",
+			lines:    []string{"lxc.rootfs.path = dir:/var/lib/lxc/a/rootfs", "lxc.net.0.type = veth"},
+			upgraded: []string{"lxc.rootfs.path = dir:/var/lib/lxc/a/rootfs", "lxc.net.0.type = veth"},
+		},
+		{
+			name: "renamed keys and comments",
+			lines: []string{
+				"# lxc.utsname = old",
+				"lxc.utsname = a",
+				"lxc.seccomp = /usr/share/lxc/config/common.seccomp",
+				"lxc.mount.entry = /tmp tmp none rbind,create=dir 0 0",
+			},
+			upgraded: []string{
+				"# lxc.utsname = old",
+				"lxc.uts.name = a",
+				"lxc.seccomp.profile = /usr/share/lxc/config/common.seccomp",
+				"lxc.mount.entry = /tmp tmp none rbind,create=dir 0 0",
+			},
+			changed: true,
+		},
+		{
+			name: "every type starts a new interface",
+			lines: []string{
+				"lxc.network.type = veth",
+				"lxc.network.link = lxcbr0",
+				"lxc.network.ipv4 = 10.0.3.2/24",
+				"lxc.network.type = empty",
+				"lxc.network.flags = up",
+			},
+			upgraded: []string{
+				"lxc.net.0.type = veth",
+				"lxc.net.0.link = lxcbr0",
+				"lxc.net.0.ipv4.address = 10.0.3.2/24",
+				"lxc.net.1.type = empty",
+				"lxc.net.1.flags = up",
+			},
+			changed: true,
+		},
+		{
+			name: "indexed interfaces keep their index",
+			lines: []string{
+				"lxc.network.1.type = veth",
+				"lxc.network.1.link = lxcbr0",
+				"lxc.network.0.type = empty",
+			},
+			upgraded: []string{
+				"lxc.net.1.type = veth",
+				"lxc.net.1.link = lxcbr0",
+				"lxc.net.0.type = empty",
+			},
+			changed: true,
+		},
+		{
+			name:     "clearing the network",
+			lines:    []string{"lxc.network = ", "lxc.network.type = veth"},
+			upgraded: []string{"lxc.net = ", "lxc.net.0.type = veth"},
+			changed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		upgraded, changed := UpgradeConfigLines(test.lines)
+		if changed != test.changed {
+			t.Errorf("%s: changed is %v, expected %v", test.name, changed, test.changed)
+		}
+		if !reflect.DeepEqual(upgraded, test.upgraded) {
+			t.Errorf("%s: upgraded to\n%v\nexpected\n%v", test.name, upgraded, test.upgraded)
+		}
+	}
+}
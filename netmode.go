@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// NetworkModeBridged uses the network config of the image and the lxc bridge
+	NetworkModeBridged = "bridged"
+	// NetworkModeNone gives the target only a loopback device, for hermetic builds
+	NetworkModeNone = "none"
+	// NetworkModeHostShared shares the network namespace of the host, e.g. to reach a VPN
+	NetworkModeHostShared = "host-shared"
+)
+
+var NetworkModes = []string{NetworkModeBridged, NetworkModeNone, NetworkModeHostShared}
+
+// CheckNetworkMode fails for unknown network modes
+func CheckNetworkMode(mode string) error {
+	for _, known := range NetworkModes {
+		if mode == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown network mode %s, supported are: %s", mode, strings.Join(NetworkModes, ", "))
+}
+
+// NetworkMode returns the network mode of the target, targets created before
+// the modes existed are bridged
+func (c *LMTargetContainer) NetworkMode() string {
+	if len(c.Network) == 0 {
+		return NetworkModeBridged
+	}
+	return c.Network
+}
+
+/*
+NetworkConfigLines returns the container config lines implementing the network
+mode. The bridged mode keeps the network config of the image and the lxc
+default config, so no lines are needed. The other modes first clear all
+networks, otherwise the old config format would add another interface.
+*/
+func NetworkConfigLines(mode string, newFormat bool) []string {
+	clearKey, typeKey := LXCConfigKey("lxc.net", newFormat), LXCConfigKey("lxc.net.0.type", newFormat)
+
+	switch mode {
+	case NetworkModeNone:
+		return []string{clearKey + " =", ConfigItem{typeKey, "empty"}.String()}
+	case NetworkModeHostShared:
+		return []string{clearKey + " =", ConfigItem{typeKey, "none"}.String()}
+	}
+	return []string{}
+}
+
+// isNetworkModeLine detects the lines written by NetworkConfigLines
+func isNetworkModeLine(line string) bool {
+	switch key := configLineKey(line); key {
+	case "lxc.network", "lxc.net":
+		return true
+	case "lxc.network.type", "lxc.net.0.type":
+		value := configLineValue(line)
+		return value == "empty" || value == "none"
+	}
+	return false
+}
+
+/*
+SetNetworkMode changes the network mode of the target and writes the matching
+container config. The change is active after the next start of the target,
+config-lm has to be written by the caller.
+*/
+func SetNetworkMode(container *LMTargetContainer, mode string) error {
+	if err := CheckNetworkMode(mode); err != nil {
+		return err
+	}
+
+	edit, err := LoadConfigEdit(container.Container.ConfigFileName())
+	if err != nil {
+		return err
+	}
+
+	newConfig := []string{}
+	for _, line := range edit.Lines() {
+		if !isNetworkModeLine(line) {
+			newConfig = append(newConfig, line)
+		}
+	}
+	//appended, so the image network config before is cleared as well
+	edit.ReplaceLines(append(newConfig, NetworkConfigLines(mode, LXCNewVersion())...))
+
+	if _, err = edit.Apply(container.Container); err != nil {
+		return err
+	}
+
+	container.Network = mode
+	return nil
+}
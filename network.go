@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// HostNetwork is a network that is reachable from the host, either because a
+// interface has a address in it or because there is a route to it
+type HostNetwork struct {
+	Network   *net.IPNet
+	Interface string
+	Source    string
+}
+
+func (n HostNetwork) String() string {
+	return fmt.Sprintf("%s on %s (%s)", n.Network, n.Interface, n.Source)
+}
+
+// hostAddressNetworks returns the networks of all addresses configured on the interfaces
+func hostAddressNetworks() ([]HostNetwork, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	networks := []HostNetwork{}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			networks = append(networks, HostNetwork{
+				Network:   &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask},
+				Interface: iface.Name,
+				Source:    "address",
+			})
+		}
+	}
+	return networks, nil
+}
+
+/*
+hostRouteNetworks reads the unicast routes of all routing tables, so routes
+pushed by a VPN into a separate table are found as well. Default routes are
+skipped, they overlap with every network.
+*/
+func hostRouteNetworks() ([]HostNetwork, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the routing table: %v", err)
+	}
+
+	messages, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the routing table: %v", err)
+	}
+
+	networks := []HostNetwork{}
+	for _, message := range messages {
+		if message.Header.Type != syscall.RTM_NEWROUTE || len(message.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		route := (*syscall.RtMsg)(unsafe.Pointer(&message.Data[0]))
+		if route.Type != syscall.RTN_UNICAST || route.Dst_len == 0 {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&message)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the routing table: %v", err)
+		}
+
+		var dst net.IP
+		ifaceName := ""
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				dst = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) < 4 {
+					continue
+				}
+				index := *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+				if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+					ifaceName = iface.Name
+				}
+			}
+		}
+		if dst == nil {
+			continue
+		}
+
+		mask := net.CIDRMask(int(route.Dst_len), len(dst)*8)
+		networks = append(networks, HostNetwork{
+			Network:   &net.IPNet{IP: dst.Mask(mask), Mask: mask},
+			Interface: ifaceName,
+			Source:    "route",
+		})
+	}
+	return networks, nil
+}
+
+// HostNetworks returns all networks the host has a address in or a route to
+func HostNetworks() ([]HostNetwork, error) {
+	addrs, err := hostAddressNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := hostRouteNetworks()
+	if err != nil {
+		return nil, err
+	}
+	return append(addrs, routes...), nil
+}
+
+// NetworksOverlap checks if two networks share any address
+func NetworksOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+/*
+FindNetworkConflicts returns the host networks overlapping with network. The
+networks of ignoreInterface are skipped, that is the bridge itself when it
+is reconfigured.
+*/
+func FindNetworkConflicts(hostNetworks []HostNetwork, network *net.IPNet, ignoreInterface string) []HostNetwork {
+	conflicts := []HostNetwork{}
+	for _, hostNetwork := range hostNetworks {
+		if hostNetwork.Interface == ignoreInterface && len(ignoreInterface) > 0 {
+			continue
+		}
+		//loopback routes cover 127.0.0.0/8 and ::1, nothing we could collide with
+		if hostNetwork.Network.IP.IsLoopback() {
+			continue
+		}
+		if NetworksOverlap(hostNetwork.Network, network) {
+			conflicts = append(conflicts, hostNetwork)
+		}
+	}
+	return conflicts
+}
+
+// CheckBridgeName makes sure name can be used as name for the lxc bridge
+func CheckBridgeName(name string) error {
+	//IFNAMSIZ includes the terminating 0
+	if len(name) == 0 || len(name) > 15 {
+		return fmt.Errorf("The bridge name %s must have 1 to 15 characters", name)
+	}
+	for _, c := range name {
+		if c == '/' || c == ':' || c <= ' ' || c > '~' {
+			return fmt.Errorf("The bridge name %s contains invalid characters", name)
+		}
+	}
+
+	if _, err := net.InterfaceByName(name); err == nil {
+		if _, err := os.Stat(filepath.Join("/sys/class/net", name, "bridge")); err != nil {
+			return fmt.Errorf("The interface %s exists and is not a bridge", name)
+		}
+	}
+	return nil
+}
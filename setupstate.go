@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SetupFileChange records how autosetup changed a file
+type SetupFileChange struct {
+	Path     string `json:"path"`
+	Existed  bool   `json:"existed"`
+	Original string `json:"original"`
+	//permissions of the file before the first change
+	Mode  os.FileMode `json:"mode,omitempty"`
+	Added []string    `json:"added,omitempty"`
+}
+
+// SetupService records a service autosetup enabled and restarted
+type SetupService struct {
+	Name       string `json:"name"`
+	WasEnabled bool   `json:"wasEnabled"`
+}
+
+// HostSetupState is everything autosetup changed on the host for one user
+type HostSetupState struct {
+	User        string            `json:"user"`
+	Updated     time.Time         `json:"updated"`
+	Files       []SetupFileChange `json:"files"`
+	Directories []string          `json:"directories,omitempty"`
+	Services    []SetupService    `json:"services,omitempty"`
+}
+
+// HostSetupStateFile returns the file the host setup of the current user is recorded in
+func HostSetupStateFile() (string, error) {
+	user, err := LxcContainerUser()
+	if err != nil {
+		return "", err
+	}
+
+	//not below StorageRoot(), the state has to survive moving the storage
+	return filepath.Join(DefaultStorageRoot, "autosetup-"+user.Username+".json"), nil
+}
+
+// LoadHostSetupState reads the recorded host setup, a empty state is returned if nothing was recorded yet
+func LoadHostSetupState() (*HostSetupState, error) {
+	fileName, err := HostSetupStateFile()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := LxcContainerUser()
+	if err != nil {
+		return nil, err
+	}
+
+	state := HostSetupState{User: user.Username}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", fileName, err)
+	}
+	return &state, nil
+}
+
+// Save writes the state file, only root can read and change it
+func (s *HostSetupState) Save() error {
+	fileName, err := HostSetupStateFile()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = WriteFileAtomic(fileName, data, 0600); err != nil {
+		return fmt.Errorf("Unable to write %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// FileChange returns the recorded change of a file, or nil
+func (s *HostSetupState) FileChange(fileName string) *SetupFileChange {
+	for i := range s.Files {
+		if s.Files[i].Path == fileName {
+			return &s.Files[i]
+		}
+	}
+	return nil
+}
+
+/*
+RecordFileChange runs change and records how it modified the file. The
+content from before the first recorded change is kept, lines added by
+change are appended to the added entries.
+*/
+func (s *HostSetupState) RecordFileChange(fileName string, change func() error) error {
+	data, err := ioutil.ReadFile(fileName)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	before := string(data)
+
+	var mode os.FileMode
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err = change(); err != nil {
+		return err
+	}
+
+	data, err = ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	after := string(data)
+	if before == after {
+		return nil
+	}
+
+	record := s.FileChange(fileName)
+	if record == nil {
+		s.Files = append(s.Files, SetupFileChange{
+			Path:     fileName,
+			Existed:  existed,
+			Original: before,
+			Mode:     mode,
+		})
+		record = &s.Files[len(s.Files)-1]
+	}
+
+	oldLines := map[string]bool{}
+	for _, line := range SplitLines(before) {
+		oldLines[line] = true
+	}
+	for _, line := range SplitLines(after) {
+		if !oldLines[line] {
+			record.Added = append(record.Added, line)
+		}
+	}
+	return s.Save()
+}
+
+// RecordDirectories remembers which of the required directories do not exist yet
+func (s *HostSetupState) RecordDirectories() error {
+	dirs, err := requiredDirectories()
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir.path); os.IsNotExist(err) {
+			s.Directories = append(s.Directories, dir.path)
+		}
+	}
+	return nil
+}
+
+// RecordService remembers the state of a service before it is enabled, the first state is kept
+func (s *HostSetupState) RecordService(name string, wasEnabled bool) error {
+	for _, service := range s.Services {
+		if service.Name == name {
+			return nil
+		}
+	}
+	s.Services = append(s.Services, SetupService{Name: name, WasEnabled: wasEnabled})
+	return s.Save()
+}
+
+/*
+RemoveAddedLines removes the lines recorded as added from a file, each
+recorded line is removed once. All other lines are kept, so entries that
+were there before autosetup or were added by others survive. Returns the
+number of removed lines.
+*/
+func RemoveAddedLines(fileName string, added []string) (int, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	toRemove := map[string]int{}
+	for _, line := range added {
+		toRemove[strings.TrimSpace(line)]++
+	}
+
+	removed := 0
+	kept := []string{}
+	for _, line := range SplitLines(string(data)) {
+		if key := strings.TrimSpace(line); toRemove[key] > 0 {
+			toRemove[key]--
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	content := ""
+	if len(kept) > 0 {
+		content = strings.Join(kept, "\n") + "\n"
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	if err = WriteFileAtomic(fileName, []byte(content), info.Mode().Perm()); err != nil {
+		return 0, fmt.Errorf("Unable to write %s: %v", fileName, err)
+	}
+	return removed, nil
+}
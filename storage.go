@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// LmStorageEnvVar overrides the storage root of the config file
+const LmStorageEnvVar = "LM_SDK_STORAGE"
+
+// DefaultStorageRoot is used if no storage root is configured
+const DefaultStorageRoot = "/var/lib/lm-sdk"
+
+// StorageConfigFile is the name of the storage config in the config dir of the container user
+const StorageConfigFile = "storage.conf"
+
+/*
+StorageConfigFileName returns the storage config of the container user. The
+config dir of the container user is used instead of ConfigPath(), so the
+storage root is the same when running with sudo. The file has a single
+key=value line:
+
+	root=/data/lm-sdk
+*/
+func StorageConfigFileName() (string, error) {
+	user, err := LxcContainerUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(user.HomeDir, ".config", "lm-sdk", StorageConfigFile), nil
+}
+
+func checkStorageRoot(root string, source string) (string, error) {
+	if !filepath.IsAbs(root) {
+		return "", fmt.Errorf("The storage root %s from %s is not a absolute path", root, source)
+	}
+	root = filepath.Clean(root)
+
+	//root creates the directories of the user below it and changes their owner
+	if os.Geteuid() == 0 {
+		if err := checkRootOwned(root); err != nil {
+			return "", fmt.Errorf("The storage root %s from %s can not be used as root: %v", root, source, err)
+		}
+	}
+	return root, nil
+}
+
+/*
+checkRootOwned makes sure no user can change a path, so it can not be redirected
+with a symlink. The path, its symlinks and their targets must belong to root and
+the directories must not be writable by others. Directories with the sticky bit
+are allowed above existing parts of the path, missing ones are created by root
+in the deepest existing directory, which can not be writable for others.
+*/
+func checkRootOwned(path string) error {
+	existing := path
+	for existing != "/" {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+
+	for _, checked := range []string{existing, resolved} {
+		for dir := checked; ; dir = filepath.Dir(dir) {
+			info, err := os.Lstat(dir)
+			if err != nil {
+				return err
+			}
+			if info.Sys().(*syscall.Stat_t).Uid != 0 {
+				return fmt.Errorf("%s does not belong to root", dir)
+			}
+
+			writable := info.Mode()&os.ModeSymlink == 0 && info.Mode().Perm()&0022 != 0
+			if writable && (info.Mode()&os.ModeSticky == 0 || dir == checked) {
+				return fmt.Errorf("%s is writable by other users", dir)
+			}
+			if dir == "/" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// StorageRoot returns the directory the targets of all users are stored in, which
+// is LmStorageEnvVar, the root in StorageConfigFile or DefaultStorageRoot
+func StorageRoot() (string, error) {
+	if root := os.Getenv(LmStorageEnvVar); len(root) > 0 {
+		return checkStorageRoot(root, LmStorageEnvVar)
+	}
+
+	fileName, err := StorageConfigFileName()
+	if err != nil {
+		return "", err
+	}
+
+	values, err := ReadKeyValueFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	if root, ok := values["root"]; ok && len(root) > 0 {
+		return checkStorageRoot(root, fileName)
+	}
+	return DefaultStorageRoot, nil
+}
+
+// TargetPathInRoot returns the target directory of the container user below a storage root
+func TargetPathInRoot(root string) (string, error) {
+	user, err := LxcContainerUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, user.Username, "containers"), nil
+}
+
+// WriteStorageRoot stores the storage root in StorageConfigFile, owned by the container user
+func WriteStorageRoot(root string) error {
+	root, err := checkStorageRoot(root, "the command line")
+	if err != nil {
+		return err
+	}
+
+	user, err := LxcContainerUser()
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(user.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(user.Gid)
+	if err != nil {
+		return err
+	}
+
+	fileName, err := StorageConfigFileName()
+	if err != nil {
+		return err
+	}
+
+	//create the config dirs as the user, otherwise root owns them when running with sudo
+	created := []string{}
+	for dir := filepath.Dir(fileName); dir != user.HomeDir && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			created = append(created, dir)
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	//the home directory belongs to the user, a directory replaced by a symlink must not change another file
+	for _, dir := range created {
+		os.Lchown(dir, uid, gid)
+	}
+
+	content := fmt.Sprintf("# storage root of the lm-sdk targets, they are in <root>/%s/containers\nroot=%s\n", user.Username, root)
+	if err = WriteFileAtomicOwned(fileName, []byte(content), 0644, uid, gid); err != nil {
+		return fmt.Errorf("Unable to write %s: %v", fileName, err)
+	}
+	return nil
+}
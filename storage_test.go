@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRootOwned(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating files owned by root and other users needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dirs := []struct {
+		path string
+		uid  int
+		perm os.FileMode
+	}{
+		{"root", 0, 0755},
+		{"user", 1000, 0755},
+		{"writable", 0, 0777},
+		{"sticky", 0, 0777 | os.ModeSticky},
+		{"sticky/root", 0, 0755},
+	}
+	for _, d := range dirs {
+		fileName := filepath.Join(dir, d.path)
+		if err = os.Mkdir(fileName, 0755); err == nil {
+			err = os.Chmod(fileName, d.perm)
+		}
+		if err == nil {
+			err = os.Chown(fileName, d.uid, d.uid)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink(filepath.Join(dir, "root"), filepath.Join(dir, "rootlink"))
+	os.Symlink(filepath.Join(dir, "root"), filepath.Join(dir, "userlink"))
+	os.Lchown(filepath.Join(dir, "userlink"), 1000, 1000)
+
+	tests := []struct {
+		path  string
+		fails bool
+	}{
+		{"root", false},
+		{"root/missing/storage", false},
+		{"rootlink/storage", false},
+		{"sticky/root", false},
+		{"user", true},
+		{"user/storage", true},
+		//the user can replace the link or create the missing directory
+		{"userlink/storage", true},
+		{"writable/storage", true},
+		{"sticky/storage", true},
+	}
+
+	for _, test := range tests {
+		if err := checkRootOwned(filepath.Join(dir, test.path)); (err != nil) != test.fails {
+			t.Errorf("checkRootOwned(%s) returned %v", test.path, err)
+		}
+	}
+}
+
+func TestEnsureDirExistsWithPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmsdk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uid, gid := os.Getuid(), os.Getgid()
+	victim := filepath.Join(dir, "victim")
+	os.Mkdir(victim, 0755)
+	os.Symlink(victim, filepath.Join(dir, "link"))
+
+	tests := []struct {
+		path   string
+		fixed  bool
+		broken bool
+	}{
+		{"created/containers", true, true},
+		{"created/containers", true, false},
+		//the owner and mode of the link target are not changed
+		{"link", false, true},
+	}
+
+	for _, test := range tests {
+		fileName := filepath.Join(dir, test.path)
+		if err := EnsureDirExistsWithPermissions(fileName, uid, gid, os.ModeDir|0750, false); (err != nil) != test.broken {
+			t.Errorf("%s: the check returned %v", test.path, err)
+		}
+		if err := EnsureDirExistsWithPermissions(fileName, uid, gid, os.ModeDir|0750, true); (err == nil) != test.fixed {
+			t.Errorf("%s: the fix returned %v", test.path, err)
+		}
+	}
+
+	if info, err := os.Stat(victim); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("The mode of the link target was changed")
+	}
+}
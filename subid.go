@@ -0,0 +1,309 @@
+/*
+ * Copyright (C) 2017 Link Motion Oy
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Benjamin Zeller <benjamin.zeller@link-motion.com>
+ */
+package lm_sdk_tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const SubUidFile = "/etc/subuid"
+const SubGidFile = "/etc/subgid"
+
+// SubIdCount is the minimum amount of ids every container needs
+const SubIdCount = 65536
+
+// firstSubId is where new ranges are allocated if the file has no entries yet
+const firstSubId = 100000
+
+// subIdLockTimeout is how long we wait for a lock, the same as shadow-utils does
+const subIdLockTimeout = 15 * time.Second
+
+type SubIdRange struct {
+	Start uint32
+	Count uint32
+}
+
+type subIdEntry struct {
+	Owner string
+	SubIdRange
+}
+
+// readSubIdFile parses a subuid or subgid file, returns the parsed entries and the raw content
+func readSubIdFile(fileName string) ([]subIdEntry, string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return []subIdEntry{}, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	entries := []subIdEntry{}
+	for i, line := range SplitLines(string(data)) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		values := strings.Split(line, ":")
+		if len(values) != 3 {
+			return nil, "", fmt.Errorf("Invalid entry in %s line %d: %s", fileName, i+1, line)
+		}
+
+		start, err := strconv.ParseUint(values[1], 10, 32)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid start id in %s line %d: %s", fileName, i+1, values[1])
+		}
+
+		count, err := strconv.ParseUint(values[2], 10, 32)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid id count in %s line %d: %s", fileName, i+1, values[2])
+		}
+
+		entries = append(entries, subIdEntry{
+			Owner:      values[0],
+			SubIdRange: SubIdRange{Start: uint32(start), Count: uint32(count)},
+		})
+	}
+	return entries, string(data), nil
+}
+
+// userSubIdRanges returns the sorted ranges of the user, entries can use the name or the uid
+func userSubIdRanges(entries []subIdEntry, owner *user.User) []SubIdRange {
+	ranges := []SubIdRange{}
+	for _, entry := range entries {
+		if entry.Owner == owner.Username || entry.Owner == owner.Uid {
+			ranges = append(ranges, entry.SubIdRange)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return ranges
+}
+
+func countSubIds(ranges []SubIdRange) uint64 {
+	total := uint64(0)
+	for _, r := range ranges {
+		total += uint64(r.Count)
+	}
+	return total
+}
+
+// ReadSubIdRanges returns all ranges of the user in a subuid or subgid file
+func ReadSubIdRanges(fileName string, owner *user.User) ([]SubIdRange, error) {
+	entries, _, err := readSubIdFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := userSubIdRanges(entries, owner)
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No sub id range for user %s in %s, please run lmsdk-target autosetup.", owner.Username, fileName)
+	}
+	return ranges, nil
+}
+
+/*
+lockSubIdFile takes the lock shadow-utils uses for the file, which is a
+file with the .lock suffix containing the pid of the owner. Stale locks of
+processes that do not exist anymore are removed.
+
+Returns a function to release the lock.
+*/
+func lockSubIdFile(fileName string) (func(), error) {
+	lockName := fileName + ".lock"
+	deadline := time.Now().Add(subIdLockTimeout)
+
+	for {
+		lockFile, err := os.OpenFile(lockName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(lockFile, "%d", os.Getpid())
+			lockFile.Close()
+			return func() { os.Remove(lockName) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to lock %s: %v", fileName, err)
+		}
+
+		if data, err := ioutil.ReadFile(lockName); err == nil {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err == nil && pid > 0 && syscall.Kill(pid, 0) == syscall.ESRCH {
+				fmt.Printf("Removing stale lock %s of process %d\n", lockName, pid)
+				os.Remove(lockName)
+				continue
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Unable to lock %s, %s is held by another process", fileName, lockName)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+/*
+PlanSubIdRange computes the content of a subuid or subgid file after making sure
+the user owns at least count ids. Missing ids are added as new range behind all
+existing ranges. Returns the current and the new content, which are equal if
+nothing needs to be changed, and all ranges of the user.
+*/
+func PlanSubIdRange(fileName string, owner *user.User, count uint32) (string, string, []SubIdRange, error) {
+	entries, content, err := readSubIdFile(fileName)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	ranges := userSubIdRanges(entries, owner)
+	available := countSubIds(ranges)
+	if available >= uint64(count) {
+		return content, content, ranges, nil
+	}
+
+	nextStart := uint64(firstSubId)
+	for _, entry := range entries {
+		if end := uint64(entry.Start) + uint64(entry.Count); end > nextStart {
+			nextStart = end
+		}
+	}
+
+	missing := uint64(count) - available
+	if nextStart+missing > 1<<32 {
+		return "", "", nil, fmt.Errorf("No free sub ids left in %s", fileName)
+	}
+
+	newRange := SubIdRange{Start: uint32(nextStart), Count: uint32(missing)}
+	newContent := content
+	if len(newContent) > 0 && !strings.HasSuffix(newContent, "\n") {
+		newContent += "\n"
+	}
+	newContent += fmt.Sprintf("%s:%d:%d\n", owner.Username, newRange.Start, newRange.Count)
+
+	ranges = append(ranges, newRange)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return content, newContent, ranges, nil
+}
+
+/*
+EnsureSubIdRange applies PlanSubIdRange. The file is changed atomically while
+holding the shadow-utils lock.
+
+Returns all ranges of the user.
+*/
+func EnsureSubIdRange(fileName string, owner *user.User, count uint32) ([]SubIdRange, error) {
+	unlock, err := lockSubIdFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	content, newContent, ranges, err := PlanSubIdRange(fileName, owner, count)
+	if err != nil {
+		return nil, err
+	}
+	if content == newContent {
+		fmt.Printf("Found %d sub ids for %s in %s\n", countSubIds(ranges), owner.Username, fileName)
+		return ranges, nil
+	}
+
+	fmt.Printf("Adding ID range to %s\n", fileName)
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(fileName); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err = WriteFileAtomic(fileName, []byte(newContent), perm); err != nil {
+		return nil, fmt.Errorf("Unable to write %s: %v", fileName, err)
+	}
+	return ranges, nil
+}
+
+// mapSubIds maps the container ids [first, first+count) onto the host ranges, beginning
+// at offset in the concatenated ranges. Returns one map entry per touched host range.
+func mapSubIds(kind string, ranges []SubIdRange, first, offset, count uint64) []string {
+	entries := []string{}
+	for _, r := range ranges {
+		if count == 0 {
+			break
+		}
+		if offset >= uint64(r.Count) {
+			offset -= uint64(r.Count)
+			continue
+		}
+
+		length := uint64(r.Count) - offset
+		if length > count {
+			length = count
+		}
+		entries = append(entries, fmt.Sprintf("%s %d %d %d", kind, first, uint64(r.Start)+offset, length))
+		first += length
+		count -= length
+		offset = 0
+	}
+	return entries
+}
+
+/*
+SubIdMap builds the id mappings of one kind ("u" or "g"). Container ids are
+mapped in order onto the host ranges, only containerId is mapped to hostId
+instead. The host id that would belong to containerId stays unused, so the
+ids of existing containers do not move when ranges are added.
+
+All ids of the ranges are mapped, at least SubIdCount ids and the container id
+have to be covered. The three returned slices contain the mappings below,
+of and above the container id.
+*/
+func SubIdMap(kind string, ranges []SubIdRange, containerId, hostId uint32) ([]string, []string, []string, error) {
+	total := countSubIds(ranges)
+
+	required := uint64(SubIdCount)
+	if uint64(containerId)+1 > required {
+		required = uint64(containerId) + 1
+	}
+	if total < required {
+		return nil, nil, nil, fmt.Errorf("The sub %sid ranges cover %d ids, mapping the container %sid %d requires %d. Please run lmsdk-target autosetup.",
+			kind, total, kind, containerId, required)
+	}
+
+	for _, r := range ranges {
+		if uint64(hostId) >= uint64(r.Start) && uint64(hostId) < uint64(r.Start)+uint64(r.Count) {
+			return nil, nil, nil, fmt.Errorf("The host %sid %d is part of the sub id range %d:%d", kind, hostId, r.Start, r.Count)
+		}
+	}
+
+	below := mapSubIds(kind, ranges, 0, 0, uint64(containerId))
+	mapped := []string{fmt.Sprintf("%s %d %d 1", kind, containerId, hostId)}
+	above := mapSubIds(kind, ranges, uint64(containerId)+1, uint64(containerId)+1, total-uint64(containerId)-1)
+	return below, mapped, above, nil
+}
+
+// RemoveSubIdRanges removes the given entries from a subuid or subgid file, returns
+// the number of removed entries
+func RemoveSubIdRanges(fileName string, entries []string) (int, error) {
+	unlock, err := lockSubIdFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	return RemoveAddedLines(fileName, entries)
+}